@@ -1,37 +1,37 @@
 package main
 
 import (
-	"archive/tar"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"strings"
+	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/colinmarc/hdfs"
 	"github.com/testusr/BackUpTest/db"
 	"github.com/testusr/BackUpTest/tape"
 )
 
-// This represents the block size the tape drive uses to read and write data into/from the tape
-var recordSize = 4096
-
-// This constant is the specifier of the end of the tar file; 1024 bytes of 0 after file is copied
-var tarEndPad = 1024
-
 var currentTime time.Time
 
 func init() {
 	currentTime = time.Now().In(time.UTC)
 }
 
+// jobFile is a file of the directory, or subtree, of a job
+type jobFile struct {
+	// Path is the full path of the file in hdfs
+	Path string
+	Info os.FileInfo
+}
+
 type backUpconfig struct {
-	Client              *hdfs.Client
+	Client              source
 	TapeConfig          *tape.Config
-	DB                  *pgdb.DBConn
+	Changer             tape.Changer
+	DB                  pgdb.Catalog
 	syncCronJobs        *sync.Mutex
 	syncTapeChange      *sync.Mutex
 	signalInterruptChan bool
@@ -45,7 +45,7 @@ Description:
 Parameters:
 	(See cronJob)
 */
-func (config *backUpconfig) makeJobs(poolID string, jobType string, makeJobCompleted chan error, root string, errorFound chan error) {
+func (config *backUpconfig) makeJobs(poolID string, jobType string, level string, makeJobCompleted chan error, root string, errorFound chan error) {
 	err := config.Client.Walk(root, func(path string, info os.FileInfo, err error) error {
 		select {
 		case err := <-errorFound:
@@ -79,9 +79,18 @@ func (config *backUpconfig) makeJobs(poolID string, jobType string, makeJobCompl
 					return err
 				}
 			}
+			// The job of a recursive directory covers its subtree, whose directories get no job of their own
+			recursive, err := config.DB.IsPathSpecRecursive(pathspecid)
+			if err != nil {
+				return err
+			}
+			done := error(nil)
+			if recursive {
+				done = filepath.SkipDir
+			}
 			// Check if the backup schedule of the directory is different
 			if schedule != jobType {
-				return nil
+				return done
 			}
 			// Check if the Jobs has already been created and not executed
 			jobExists, err := config.DB.CheckJobExists(path, poolID)
@@ -89,19 +98,71 @@ func (config *backUpconfig) makeJobs(poolID string, jobType string, makeJobCompl
 				return err
 			}
 			if jobExists {
-				return nil
+				return done
 			}
-			err = config.DB.AddJob(path, poolID, pathspecid)
+			// A job that failed partway continues after the last file it wrote, rather than starting again
+			resumable, err := config.DB.GetResumableJob(path, poolID, level)
 			if err != nil {
 				return err
 			}
-			return nil
+			if resumable != nil {
+				if err := config.DB.ResumeJob(resumable.ID); err != nil {
+					return err
+				}
+				return done
+			}
+			// A failed job of another level is stale, eg an incremental when a full is scheduled: it is closed
+			// as Interrupted, and is no longer resumed once the new job is added
+			if err := config.closeStaleJobs(path, poolID); err != nil {
+				return err
+			}
+			err = config.DB.AddJob(path, poolID, pathspecid, level)
+			if err != nil {
+				return err
+			}
+			return done
 		}
 	})
+	// execJobs reads one value, the error or nil
+	makeJobCompleted <- err
+}
+
+/**
+Description:
+	This function closes the InComplete jobs of a directory since its last complete job as Interrupted, when
+	none of them is resumed. Their start time, duration and number of files are kept
+Parameter:
+	path: The absolute path of the directory
+	poolID: The pool of the jobs
+Return:
+	error: any error occured while execution, or nil
+*/
+func (config *backUpconfig) closeStaleJobs(path string, poolID string) error {
+	complete, err := config.DB.GetJobsByState(poolID, pgdb.States.Complete)
 	if err != nil {
-		makeJobCompleted <- err
+		return err
+	}
+	lastComplete := 0
+	for _, job := range complete {
+		if job.Name == path {
+			lastComplete = job.ID
+		}
+	}
+	jobs, err := config.DB.GetJobsByState(poolID, pgdb.States.InComplete)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.Name != path || job.ID < lastComplete {
+			continue
+		}
+		duration := time.Duration(job.DurationInMinutes.Int64) * time.Minute
+		err := config.DB.UpdateJob(job.ID, job.Name, job.StartTime.Time, duration, int(job.NumOfFiles.Int64), pgdb.States.Interrupted, job.PoolID)
+		if err != nil {
+			return err
+		}
 	}
-	makeJobCompleted <- nil
+	return nil
 }
 
 /**
@@ -115,33 +176,24 @@ Return:
 */
 func (config *backUpconfig) execJobs(poolID string, makeJobCompleted chan error, sendError chan error) error {
 
+	// makeJobCompleted is only received from here, in the routine of execJobs, so these two need no locking
 	jobCreationCompleted := false
 	var errorMakingJobs error
-	waitForMakeJob := make(chan int)
 
 	defer func() {
+		if jobCreationCompleted {
+			return
+		}
 		select {
-		// If the makeJob routine has not been terminated yet, send signal to terminated it and defer out
-		// of the routine
+		// If the makeJob routine has not been terminated yet, send signal to terminated it, and wait for it
+		// to return
 		case sendError <- errors.New("Error While Executing"):
-			break
+			<-makeJobCompleted
 		// If the makeJob routine has been terminated, go ahead and defer out of the routine
-		case <-waitForMakeJob:
-			break
+		case <-makeJobCompleted:
 		}
 	}()
 
-	// This go routine waits for the completion of makeJob go routine, needed as a check to
-	// end the forever loop below
-	// Has to be a go routine to avoid a deadlock when sendError channel is waiting for makeJob
-	// but makeJob already terminated, but before makeJob terminated, there was a error in execJob
-	// causing the PC for thread to enter defer
-	go func() {
-		errorMakingJobs = <-makeJobCompleted
-		jobCreationCompleted = true
-		waitForMakeJob <- 1
-	}()
-
 	// Jump to the position where new data needs to ne added to tape
 	if err := config.TapeConfig.JumpToEOM(); err != nil {
 		return err
@@ -149,6 +201,17 @@ func (config *backUpconfig) execJobs(poolID string, makeJobCompleted chan error,
 
 	for {
 
+		// Check for the completion of makeJob without waiting for it. It is checked before getting a job:
+		// makeJob may add its last job and complete while the DB is queried, and that job must still be
+		// executed
+		if !jobCreationCompleted {
+			select {
+			case errorMakingJobs = <-makeJobCompleted:
+				jobCreationCompleted = true
+			default:
+			}
+		}
+
 		// Return if there was an error while creating a job
 		if errorMakingJobs != nil {
 			return errorMakingJobs
@@ -169,7 +232,7 @@ func (config *backUpconfig) execJobs(poolID string, makeJobCompleted chan error,
 		}
 
 		// If there is no error, and all the jobs has been executed return nil
-		if errorMakingJobs == nil && jobCreationCompleted && aJob == nil {
+		if jobCreationCompleted && aJob == nil {
 			return nil
 		}
 		// Continue the loop until makeJob routine adds a job to DB or sends complete signal
@@ -177,38 +240,67 @@ func (config *backUpconfig) execJobs(poolID string, makeJobCompleted chan error,
 			continue
 		}
 
+		// A resumed job keeps the start time of its first run, so that the files changed since then are
+		// backed up by the next job of the directory, and adds up the time of its runs
+		jobStartTime := startTime
+		var previousDuration time.Duration
+		if aJob.StartTime.Valid {
+			jobStartTime = aJob.StartTime.Time
+			previousDuration = time.Duration(aJob.DurationInMinutes.Int64) * time.Minute
+		}
+
 		// Set up the writing of the acquired Job
-		numOfFiles, err := config.execSingleJob(aJob.ID, aJob.Name, tapeID, poolID)
+		numOfFiles, err := config.execSingleJob(aJob.ID, aJob.Name, aJob.Level, aJob.PathSpecID, tapeID, poolID)
 
-		duration := time.Now().In(time.UTC).Sub(startTime)
+		duration := previousDuration + time.Now().In(time.UTC).Sub(startTime)
 
 		if err != nil {
-			updateErr := config.DB.UpdateJob(aJob.ID, aJob.Name, startTime, duration, numOfFiles, pgdb.States.InComplete, aJob.PoolID)
+			updateErr := config.DB.UpdateJob(aJob.ID, aJob.Name, jobStartTime, duration, numOfFiles, pgdb.States.InComplete, aJob.PoolID)
 			if updateErr != nil {
 				return updateErr
 			}
 			return err
 		}
-		err = config.DB.UpdateJob(aJob.ID, aJob.Name, startTime, duration, numOfFiles, pgdb.States.Complete, aJob.PoolID)
+		err = config.DB.UpdateJob(aJob.ID, aJob.Name, jobStartTime, duration, numOfFiles, pgdb.States.Complete, aJob.PoolID)
 		if err != nil {
 			return err
 		}
+		// Restores of an earlier time leave the job out, its files being newer than that
+		if err := config.DB.SetJobEndTime(aJob.ID, time.Now().In(time.UTC)); err != nil {
+			return err
+		}
 	}
 }
 
 /**
 Description:
-	This function gets all the contents of the directory (Job) and calls other functions to write to the tape one by one
+	This function gets all the contents of the directory (Job) and calls other functions to write them to the tape.
+	The job of a recursive PathSpec covers the subtree of the directory. The files a resumed job already wrote
+	are skipped
 Parameter:
 	(See cronJob)
 Return:
-	int: number of files that was written to the tape
+	int: number of files of the job on tape, those of its previous runs included
 	error: any error occured while execution, or nil
 */
-func (config *backUpconfig) execSingleJob(jobID int, path string, tapeID int, poolID string) (int, error) {
+func (config *backUpconfig) execSingleJob(jobID int, path string, level string, pathSpecID int, tapeID int, poolID string) (int, error) {
+
+	// The files written by the previous runs of a resumed job
+	written, err := config.DB.GetFilesOfJob(jobID)
+	if err != nil {
+		return 0, err
+	}
+	alreadyWritten := make(map[string]bool)
+	for _, file := range written {
+		alreadyWritten[file.Name] = true
+	}
 
-	filesAdded := 0
-	allFiles, err := config.Client.ReadDir(path)
+	filesAdded := len(alreadyWritten)
+	recursive, err := config.DB.IsPathSpecRecursive(pathSpecID)
+	if err != nil {
+		return filesAdded, err
+	}
+	allFiles, err := config.jobContents(path, recursive)
 	if err != nil {
 		return filesAdded, err
 	}
@@ -217,67 +309,63 @@ func (config *backUpconfig) execSingleJob(jobID int, path string, tapeID int, po
 		return filesAdded, err
 	}
 
+	// The files the directory has now, so that a restore leaves out the ones deleted since earlier jobs
+	if err := config.DB.SetJobListing(jobID, listingOf(allFiles)); err != nil {
+		return filesAdded, err
+	}
+
 	// For testing purpose
 	fmt.Println(poolID, path)
 
-	// Get the time when directory "path" was last backed up
-	lastExecTime, err := config.DB.GetLastExec(path, poolID)
+	// Get the time when directory "path" was last backed up, by the job the level is based on
+	lastExecTime, err := config.DB.GetLastExec(path, poolID, level)
 	if err != nil {
 		return filesAdded, err
 	}
 
-	for _, fileInfo := range allFiles {
-
-		if config.signalInterruptChan {
-			err := errors.New("Signal Interrupt")
-			return filesAdded, err
-		}
-
-		if !config.checkBackUpNeeded(fileInfo, lastExecTime) {
-			continue
+	var files []jobFile
+	for _, file := range allFiles {
+		if config.checkBackUpNeeded(file.Info, lastExecTime) && !alreadyWritten[file.Path] {
+			files = append(files, file)
 		}
+	}
 
-		fullPath := path + "/" + fileInfo.Name()
-
-		fileReader, err := config.Client.Open(fullPath)
-		if err != nil {
+	// The job header is only written once there is a file to back up, so that jobs with nothing to back up
+	// don't take space on tape
+	if len(files) == 0 {
+		return filesAdded, nil
+	}
+	// The room left after the early warning is for closing what was written, so a job doesn't start there
+	if config.TapeConfig.EarlyWarning() {
+		if tapeID, err = config.changeTape(poolID); err != nil {
 			return filesAdded, err
 		}
-
-		// Call writeOneFile function that streams bytes from hdfs to tape
-		err = config.writeOneFile(fullPath, fileInfo, fileReader)
-		if err != nil {
-			if !strings.Contains(err.Error(), "no space left on device") {
-				return filesAdded, err
-			}
-
-			newTapeID, err := config.changeTape(poolID)
-			if err != nil {
-				return filesAdded, err
-			}
-
-			fileReader.Close()
-
-			err = config.restartJob(fullPath, fileInfo, path, jobID, newTapeID)
-			if err != nil {
-				return filesAdded, err
-			}
-
-			tapeID = newTapeID
-		}
-
-		err = config.DB.AddFile(fullPath, jobID, tapeID, config.TapeConfig.GetFileMarkNum())
-		if err != nil {
+		if err := config.DB.AddJobTapeMap(path, jobID, tapeID); err != nil {
 			return filesAdded, err
 		}
+	}
+	// The header of a resumed job continues the job of its previous runs
+	continuation := len(alreadyWritten) > 0
+	if err := config.writeJobRecord(tape.JobHeaderEntryName, jobID, path, level, poolID, continuation, 0); err != nil {
+		return filesAdded, err
+	}
 
-		filesAdded++
+	added, err := config.writeArchives(jobID, path, level, poolID, tapeID, files)
+	filesAdded += added
+	if err != nil {
+		return filesAdded, err
+	}
 
-		// Writing end of file marker on tape to distinguish one file from another
-		if err := config.TapeConfig.WriteEOF(); err != nil {
+	// Neither does the trailer when the archives ended past the early warning: the job is continued on the
+	// next tape, where the trailer is written after the header of the continuation
+	if config.TapeConfig.EarlyWarning() {
+		if _, err := config.continueOnNewTape(jobID, path, level, poolID); err != nil {
 			return filesAdded, err
 		}
-
+	}
+	err = config.writeJobRecord(tape.JobTrailerEntryName, jobID, path, level, poolID, false, filesAdded)
+	if err != nil {
+		return filesAdded, err
 	}
 
 	return filesAdded, nil
@@ -285,28 +373,61 @@ func (config *backUpconfig) execSingleJob(jobID int, path string, tapeID int, po
 
 /**
 Description:
-	This function restarts the writing to the tape for a specific file. This function is called when tape has just been changed
-	and complete file needs to be backed up to the tape
+	This function writes a job header or trailer to the tape, so that the tape describes which job its
+	files belong to without the DB
 Parameter:
-	(see cronJob)
+	entryName: tape.JobHeaderEntryName or tape.JobTrailerEntryName
+	jobID, path, level, poolID: The job being executed
+	continuation: Whether the header starts the continuation of the job on a new tape
+	numOfFiles: The number of files written by the job, for the trailer
 Return:
 	error if any
 */
-func (config *backUpconfig) restartJob(fullPath string, fileInfo os.FileInfo, path string, jobID int, newTapeID int) error {
-	fileReader, err := config.Client.Open(fullPath)
+func (config *backUpconfig) writeJobRecord(entryName string, jobID int, path string, level string, poolID string, continuation bool, numOfFiles int) error {
+	pool, err := strconv.Atoi(poolID)
 	if err != nil {
 		return err
 	}
+	record := &tape.JobRecord{
+		JobID:        jobID,
+		Name:         path,
+		PoolID:       pool,
+		StartTime:    time.Now().In(time.UTC),
+		Continuation: continuation,
+		Level:        level,
+	}
+	if entryName == tape.JobTrailerEntryName {
+		record.EndTime = record.StartTime
+		record.StartTime = time.Time{}
+		record.NumOfFiles = numOfFiles
+		return config.TapeConfig.WriteJobTrailer(record)
+	}
+	return config.TapeConfig.WriteJobHeader(record)
+}
 
-	err = config.writeOneFile(fullPath, fileInfo, fileReader)
+/**
+Description:
+	This function continues a job on the next tape of the pool: the tape is changed, and the job gets a
+	continuation header on the new tape, which is mapped to the job
+Parameter:
+	jobID, path, level, poolID: The job being executed
+Return:
+	int: The ID of the new tape
+	error if any
+*/
+func (config *backUpconfig) continueOnNewTape(jobID int, path string, level string, poolID string) (int, error) {
+	tapeID, err := config.changeTape(poolID)
 	if err != nil {
-		return err
+		return -1, err
 	}
-
-	if err := config.DB.AddJobTapeMap(path, jobID, newTapeID); err != nil {
-		return err
+	err = config.writeJobRecord(tape.JobHeaderEntryName, jobID, path, level, poolID, true, 0)
+	if err != nil {
+		return -1, err
 	}
-	return nil
+	if err := config.DB.AddJobTapeMap(path, jobID, tapeID); err != nil {
+		return -1, err
+	}
+	return tapeID, nil
 }
 
 /**
@@ -325,7 +446,12 @@ func (config *backUpconfig) changeTape(poolID string) (int, error) {
 	config.syncTapeChange.Lock()
 	defer config.syncTapeChange.Unlock()
 
-	fromSlot, newTapeID, err := config.DB.GetTapeFromPool(poolID)
+	inventory, err := tape.GetInventory(config.Changer)
+	if err != nil {
+		return -1, err
+	}
+
+	fromSlot, newTapeID, err := config.selectTape(poolID, inventory)
 	if err != nil {
 		return -1, err
 	}
@@ -339,7 +465,7 @@ func (config *backUpconfig) changeTape(poolID string) (int, error) {
 		return -1, err
 	}
 
-	unloadTo, err := tape.GetAEmptySlot()
+	unloadTo, err := inventory.EmptySlot()
 	if err != nil {
 		return -1, err
 	}
@@ -354,12 +480,37 @@ func (config *backUpconfig) changeTape(poolID string) (int, error) {
 		return -1, err
 	}
 
-	// Refresh the tape to get correct file mark number
-	config.TapeConfig.RetensionOfTape()
-
 	return newTapeID, nil
 }
 
+/**
+Description:
+	This function selects the next tape of the pool to write to. The candidates come from the DB, but a
+	candidate is only used if the library actually has it in a storage slot, and the slot the library
+	reports is used to load it
+Parameter:
+	poolID: The pool that needs a new tape
+	inventory: The current inventory of the library
+Return:
+	int: The slot of the selected tape
+	int: The id of the selected tape
+	error if any
+*/
+func (config *backUpconfig) selectTape(poolID string, inventory *tape.Inventory) (int, int, error) {
+	candidates, err := config.DB.GetTapesFromPool(poolID)
+	if err != nil {
+		return -1, -1, err
+	}
+	for _, candidate := range candidates {
+		slot := inventory.FindSlot(candidate.Name)
+		if slot == nil || slot.ImportExport {
+			continue
+		}
+		return slot.Number, candidate.ID, nil
+	}
+	return -1, -1, errors.New("None of the usable tapes of pool " + poolID + " is in the tape library")
+}
+
 /**
 Description:
 	This function loads a new tape to the tape drive, and updates the changes to the DB
@@ -371,7 +522,7 @@ Return:
 	error if any
 */
 func (config *backUpconfig) loadAndUpdate(driveNum int, fromSlot int, newTapeID int) error {
-	err := tape.Load(driveNum, fromSlot)
+	err := config.Changer.Load(driveNum, fromSlot)
 	if err != nil {
 		return err
 	}
@@ -382,16 +533,58 @@ func (config *backUpconfig) loadAndUpdate(driveNum int, fromSlot int, newTapeID
 		return err
 	}
 
-	err = config.DB.UpdateTapeTable(0, false, false, newTapeID)
+	// Refresh the tape to get correct file mark number
+	config.TapeConfig.RetensionOfTape()
+
+	// Make sure the right tape was loaded before anything is written to it
+	err = config.prepareTape(newTapeID)
 	if err != nil {
 		return err
 	}
-	err = config.DB.UpdateStorage(newTapeID, config.TapeConfig.TapePath)
+
+	return config.DB.LoadTape(config.TapeConfig.TapePath, newTapeID, true)
+}
+
+/**
+Description:
+	This function checks the volume label of the tape in the drive against the tape the DB expects, so that
+	a wrong tape is detected before anything is written to it. A blank tape gets labeled. Tapes written
+	before labels were introduced have no label; they are used as they are. The tape is left at the end
+	of its data, where new data is added.
+Parameter:
+	tapeID: The ID of the tape that should be in the drive
+Return:
+	error if any
+*/
+func (config *backUpconfig) prepareTape(tapeID int) error {
+	tapeInfo, err := config.DB.GetTape(tapeID)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	label, err := config.TapeConfig.ReadLabel()
+	if err == tape.ErrNoLabel {
+		log.Println("Tape " + tapeInfo.Name + " has no volume label")
+		return config.TapeConfig.JumpToEOM()
+	}
+	if err != nil {
+		return err
+	}
+
+	if label == nil {
+		return config.TapeConfig.WriteLabel(&tape.Label{
+			TapeName:      tapeInfo.Name,
+			PoolID:        tapeInfo.PoolID,
+			LabelTime:     time.Now().In(time.UTC),
+			FormatVersion: tape.FormatVersion,
+		})
+	}
+
+	if label.TapeName != tapeInfo.Name {
+		return errors.New("Wrong tape in drive " + config.TapeConfig.TapePath + ": expected " + tapeInfo.Name +
+			" but the volume label is " + label.TapeName)
+	}
+	return config.TapeConfig.JumpToEOM()
 }
 
 /**
@@ -405,23 +598,75 @@ Return:
 	error if any
 */
 func (config *backUpconfig) unloadAndUpdate(driveNum int, unloadTo int, tapeID int) error {
-	err := tape.Unload(driveNum, unloadTo)
+	err := config.Changer.Unload(driveNum, unloadTo)
 	if err != nil {
 		return err
 	}
 
-	err = config.DB.UpdateTapeTable(unloadTo, true, false, tapeID)
-	if err != nil {
-		return err
+	// The tape is changed because it is full
+	return config.DB.UnloadTape(config.TapeConfig.TapePath, tapeID, unloadTo, true)
+}
+
+/**
+Description:
+	This function lists the files of a job: the files directly in its directory, or every file of the
+	subtree of the directory for a recursive job
+Parameter:
+	path: The path of the directory
+	recursive: Whether the job covers the subtree of the directory
+Return:
+	[]jobFile: The files, the directories left out
+	error if any
+*/
+func (config *backUpconfig) jobContents(path string, recursive bool) ([]jobFile, error) {
+	var files []jobFile
+	if !recursive {
+		allFiles, err := config.Client.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileInfo := range allFiles {
+			if !fileInfo.IsDir() {
+				files = append(files, jobFile{Path: path + "/" + fileInfo.Name(), Info: fileInfo})
+			}
+		}
+		return files, nil
 	}
 
-	// -1 representing the NULL value in the DB, when a tape is taken out from the tapeDrive
-	err = config.DB.UpdateStorage(-1, config.TapeConfig.TapePath)
+	err := config.Client.Walk(path, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fileInfo.IsDir() {
+			files = append(files, jobFile{Path: filePath, Info: fileInfo})
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return files, nil
+}
 
-	return nil
+/**
+Description:
+	This function builds the listing of a directory recorded by a job, which holds the files of the
+	job whether they need backing up or not
+Parameter:
+	files: The files of the job
+Return:
+	[]pgdb.ListingEntry: The listing
+*/
+func listingOf(files []jobFile) []pgdb.ListingEntry {
+	var entries []pgdb.ListingEntry
+	for _, file := range files {
+		entries = append(entries, pgdb.ListingEntry{
+			Name:    file.Path,
+			Size:    file.Info.Size(),
+			ModTime: file.Info.ModTime().In(time.UTC),
+		})
+	}
+	return entries
 }
 
 /**
@@ -437,8 +682,7 @@ func (config *backUpconfig) checkBackUpNeeded(fileInfo os.FileInfo, lastExecTime
 	if fileInfo.IsDir() {
 		return false
 	}
-	// Only for testing purpose
-	if fileInfo.Size() > 12000000 {
+	if appSettings.Limits.MaxFileSize > 0 && fileInfo.Size() > appSettings.Limits.MaxFileSize {
 		return false
 	}
 	if (fileInfo.ModTime().In(time.UTC)).Before(lastExecTime) {
@@ -449,75 +693,47 @@ func (config *backUpconfig) checkBackUpNeeded(fileInfo os.FileInfo, lastExecTime
 
 /**
 Description:
-	This function does the actual reading from the hdfs and writing to the tape
+	This function gets the address of the tape in the /dev/ directory and opens tape for use
 Parameters:
-	Path: represents the absolute path of the file that is being written to the tape
-	fileheader: represents the struct that has information about the file
-	fileReader: represents the io.Reader that will stream content of the file from hdfs
-	tapeWriter: represtns the io.Writer that will stream the content of the tape
+	PoolID: Which pool tape needs to be set
+	readOnly: Whether the drive is only read from, so that write protected tapes can be read
 Return:
+	tape.Config: represents the struct that will be used perform tape operations
 	error: any error occured while execution, or nil
 */
-func (config *backUpconfig) writeOneFile(path string, fileheader os.FileInfo, fileReader *hdfs.FileReader) error {
-
-	tw := tar.NewWriter(config.TapeConfig.TapeWriter)
-
-	header := new(tar.Header)
-	header.Name = path
-	header.Size = fileheader.Size()
-	header.Mode = int64(fileheader.Mode())
-	header.ModTime = fileheader.ModTime()
-
-	// Write tar header to the tape
-	if err := tw.WriteHeader(header); err != nil {
-		return err
-	}
-
-	// Write the actual file to the tape
-	if fileheader.Size() != 0 {
-		if _, err := io.Copy(config.TapeConfig.TapeWriter, fileReader); err != nil {
-			return err
-		}
-
-		// Pad to get the valid 512 block size of written data
-		config.TapeConfig.TapeWriter.Write(make([]byte, (512 - (config.TapeConfig.TapeWriter.Buffered() % 512))))
-	}
-
-	// Write the tar footer- 1024 bytes of 0 marking end of tar file
-	config.TapeConfig.TapeWriter.Write(make([]byte, tarEndPad))
-
-	// Fill the buffer to flush the remaning bytes to the tape
-	_, err := config.TapeConfig.TapeWriter.Write(make([]byte, config.TapeConfig.TapeWriter.Available()))
+func (config *backUpconfig) setUpTape(poolID string, readOnly bool) error {
+	tapePath, err := poolDrivePath(config.DB, poolID)
 	if err != nil {
 		return err
 	}
-
-	// Flush both buffers
-	err = config.TapeConfig.FlushBuffers()
-	if err != nil {
+	if readOnly {
+		config.TapeConfig, err = tape.NewReadOnly(tapePath, appSettings.Limits.RecordSize)
 		return err
 	}
-
-	return nil
-
+	config.TapeConfig, err = tape.New(tapePath, appSettings.Limits.RecordSize)
+	return err
 }
 
 /**
 Description:
-	This function gets the address of the tape in the /dev/ directory and opens tape for use
+	This function returns the path of the drive the tapes of a pool are written with, from the configuration
+	file if the pool is there, otherwise from the Storage table
 Parameters:
-	PoolID: Which pool tape needs to be set
+	catalog: The DB connection
+	poolID: The pool whose drive is needed
 Return:
-	tape.Config: represents the struct that will be used perform tape operations
+	string: The path of the drive
 	error: any error occured while execution, or nil
 */
-func (config *backUpconfig) setUpTape(poolID string) error {
-	tapePath, err := config.DB.GetStoragePath(poolID)
+func poolDrivePath(catalog pgdb.Catalog, poolID string) (string, error) {
+	id, err := strconv.Atoi(poolID)
 	if err != nil {
-		return err
+		return "", errors.New(poolID + " is not a valid poolID")
 	}
-	config.TapeConfig, err = tape.New(tapePath, recordSize)
-	return nil
+	if tapePath := appSettings.PoolDrive(id); tapePath != "" {
+		return tapePath, nil
+	}
+	return catalog.GetStoragePath(poolID)
 }
 
 /**
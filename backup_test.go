@@ -0,0 +1,676 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/db/memdb"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+// localSource is a source backed by a local directory, where the hdfs path /a/b is root/a/b
+type localSource struct {
+	root string
+}
+
+// localFile is a file of a localSource opened for reading
+type localFile struct {
+	*os.File
+}
+
+func (source *localSource) path(name string) string {
+	return filepath.Join(source.root, filepath.FromSlash(name))
+}
+
+func (source *localSource) Walk(root string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(source.path(root), func(filePath string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(source.root, filePath)
+		if relErr != nil {
+			return relErr
+		}
+		return walkFn(filepath.ToSlash(filepath.Join("/", rel)), info, err)
+	})
+}
+
+func (source *localSource) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(source.path(dirname))
+}
+
+func (source *localSource) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(source.path(name))
+}
+
+func (source *localSource) Open(name string) (sourceFile, error) {
+	file, err := os.Open(source.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return localFile{file}, nil
+}
+
+func (source *localSource) Close() error {
+	return nil
+}
+
+// Checksum returns the MD5 of the content of the file, read through a reader of its own
+func (file localFile) Checksum() ([]byte, error) {
+	content, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(content)
+	return sum[:], nil
+}
+
+// testLibrary is a simulated tape library with one drive, the tapes of pool 1, and a local directory
+// backed up as if it was hdfs
+type testLibrary struct {
+	dir       string
+	source    *localSource
+	statePath string
+	drivePath string
+	barcodes  []string
+	// files is the content of the files of the source, by hdfs path
+	files map[string][]byte
+}
+
+// newTestLibrary creates the library in a temporary directory with the tapes of the capacity, the first
+// one loaded, and points the settings at it. The returned function removes it and restores the settings
+func newTestLibrary(t *testing.T, capacity int64, files map[string]int) (*testLibrary, func()) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	library := &testLibrary{
+		dir:       dir,
+		source:    &localSource{root: filepath.Join(dir, "hdfs")},
+		statePath: filepath.Join(dir, "library.json"),
+		drivePath: filepath.Join(dir, "nst0"),
+		barcodes:  []string{"T00001", "T00002", "T00003"},
+		files:     make(map[string][]byte),
+	}
+
+	// The files are older than the backups, like files that aren't being written to
+	random := rand.New(rand.NewSource(1))
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	// In order, for the same content in every test
+	sort.Strings(names)
+	for _, name := range names {
+		content := make([]byte, files[name])
+		random.Read(content)
+		library.writeFile(t, name, content, modTime)
+	}
+
+	simulated := &tape.SimulatedLibrary{
+		TapeDir:  filepath.Join(dir, "tapes"),
+		Capacity: capacity,
+		Drives:   []tape.SimulatedDrive{{Path: library.drivePath}},
+	}
+	if err := tape.CreateSimulatedLibrary(library.statePath, simulated, 5, 1, library.barcodes); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&tape.SimulatedChanger{StatePath: library.statePath}).Load(0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	savedSettings, savedCatalog, savedSource := *appSettings, openCatalog, openSource
+	appSettings.Changer.Device = library.statePath
+	appSettings.Limits.RecordSize = 4096
+	openSource = func() (source, error) { return library.source, nil }
+	return library, func() {
+		*appSettings, openCatalog, openSource = savedSettings, savedCatalog, savedSource
+		os.RemoveAll(dir)
+	}
+}
+
+// writeFile writes the file of the source with the content and modification time
+func (library *testLibrary) writeFile(t *testing.T, name string, content []byte, modTime time.Time) {
+	library.files[name] = content
+	filePath := library.source.path(name)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filePath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The catalogs the tests run with: the SQLite one, and the in-memory one that has the same semantics
+var catalogBackends = []string{"sqlite", "memdb"}
+
+// newCatalog creates a catalog of the library with the backend, and makes it the one openCatalog opens.
+// The tapes are where the library has them
+func (library *testLibrary) newCatalog(t *testing.T, backend string, name string) pgdb.Catalog {
+	if backend == "memdb" {
+		catalog := memdb.New()
+		catalog.AddPool("pool1", catalog.AddStorage(library.drivePath, 0))
+		library.addTapes(t, catalog)
+		openCatalog = func() (pgdb.Catalog, error) { return catalog, nil }
+		return catalog
+	}
+
+	options := pgdb.Options{Driver: pgdb.DriverSQLite, Path: filepath.Join(library.dir, name)}
+	catalog, err := pgdb.ConnectWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := catalog.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := catalog.DBSql.Exec("INSERT INTO Storage (name, drivenumber) VALUES (?, 0)", library.drivePath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := catalog.DBSql.Exec("INSERT INTO Pool (name, storageid) VALUES ('pool1', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	library.addTapes(t, catalog)
+
+	openCatalog = func() (pgdb.Catalog, error) {
+		catalog, err := pgdb.ConnectWith(options)
+		if err != nil {
+			return nil, err
+		}
+		return catalog, nil
+	}
+	return catalog
+}
+
+// addTapes adds the tapes of the library to the catalog, in the slot or the drive they are in
+func (library *testLibrary) addTapes(t *testing.T, catalog pgdb.Catalog) {
+	inventory, err := tape.GetInventory(&tape.SimulatedChanger{StatePath: library.statePath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, barcode := range library.barcodes {
+		if slot := inventory.FindSlot(barcode); slot != nil {
+			if err := catalog.AddTape(barcode, 1, slot.Number); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := catalog.AddTape(barcode, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := catalog.LoadTape(library.drivePath, i+1, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// backup runs the backup of the jobs of the schedule below root, like a cron job of pool 1 does
+func (library *testLibrary) backup(t *testing.T, root string, schedule string, level string) {
+	config := new(backUpconfig)
+	defer config.closeAll()
+	if err := setupBackupConfig(config, "1"); err != nil {
+		t.Fatal(err)
+	}
+	config.syncTapeChange = new(sync.Mutex)
+
+	makeJobCompleted := make(chan error)
+	errorWhileExecuting := make(chan error)
+	go config.makeJobs("1", schedule, level, makeJobCompleted, root, errorWhileExecuting)
+	if err := config.execJobs("1", makeJobCompleted, errorWhileExecuting); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restore restores the files of the directory as they are now below a new local directory, and checks
+// their content
+func (library *testLibrary) restore(t *testing.T, catalog pgdb.Catalog, name string, want []string) {
+	files, err := directoryFilesAsOf(catalog, name, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if !equalStrings(names, want) {
+		t.Fatalf("files of %s = %q, want %q", name, names, want)
+	}
+
+	session := &restoreSession{DB: catalog, conflict: conflictPolicies.Overwrite, drives: make(map[int]*backUpconfig)}
+	defer session.closeAll()
+	dest, err := ioutil.TempDir(library.dir, "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := session.restore(files, &localTarget{root: dest}); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dest, filepath.FromSlash(file.Name)))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !bytes.Equal(content, library.files[file.Name]) {
+			t.Errorf("restored %d bytes of %s, want %d bytes", len(content), file.Name, len(library.files[file.Name]))
+		}
+	}
+}
+
+// scan adds the files of the tapes of the library to the catalog, reading them back from tape
+func (library *testLibrary) scan(t *testing.T, catalog pgdb.Catalog) {
+	session := &restoreSession{DB: catalog, drives: make(map[int]*backUpconfig)}
+	defer session.closeAll()
+	tapes, err := catalog.GetTapes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range tapes {
+		drive, err := session.drive(tapes[i].PoolID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := drive.scanTape(&tapes[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// tapeFiles returns the name of the first entry of every file of the virtual tape with the barcode
+func (library *testLibrary) tapeFiles(t *testing.T, barcode string) []string {
+	drive, err := tape.OpenVirtualReadOnly(filepath.Join(library.dir, "tapes", barcode+".vtape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drive.Close()
+	tapeConfig := tape.NewWithDrive(barcode, drive, appSettings.Limits.RecordSize)
+	if err := tapeConfig.JumpToEOM(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	fileMarks := tapeConfig.GetFileMarkNum()
+	for fileMarkNum := 0; fileMarkNum < fileMarks; fileMarkNum++ {
+		reader, err := tapeConfig.NewArchiveReader(fileMarkNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := tar.NewReader(reader).Next()
+		if err != nil {
+			t.Fatalf("file %d of %s: %v", fileMarkNum, barcode, err)
+		}
+		names = append(names, header.Name)
+	}
+	return names
+}
+
+// latestFiles returns the latest entry of every file of the library in the catalog, by name
+func (library *testLibrary) latestFiles(t *testing.T, catalog pgdb.Catalog) map[string]pgdb.File {
+	files := make(map[string]pgdb.File)
+	for name := range library.files {
+		file, err := catalog.GetLatestFile(name, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file == nil {
+			t.Errorf("%s isn't in the catalog", name)
+			continue
+		}
+		files[name] = *file
+	}
+	return files
+}
+
+// sortedNames returns the names of the files of the library below the directory, sorted
+func (library *testLibrary) sortedNames(dir string) []string {
+	var names []string
+	for name := range library.files {
+		if len(name) > len(dir) && name[:len(dir)+1] == dir+"/" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// summary describes the jobs, files and tapes of the catalog, leaving out the times, which differ
+// between two runs of the same backups
+func summary(t *testing.T, catalog pgdb.Catalog) []string {
+	var lines []string
+	jobs, err := catalog.GetJobsByState("1", pgdb.States.Complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, job := range jobs {
+		lines = append(lines, fmt.Sprintf("job %d %s %s %s of %d files", job.ID, job.Name, job.Level, job.State, job.NumOfFiles.Int64))
+		files, err := catalog.GetFilesOfJob(job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			segments, err := catalog.GetFileSegments(file.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines = append(lines, fmt.Sprintf("file %d %s on tape %d at %d:%d continued on %v, %d bytes %s",
+				file.ID, file.Name, file.TapeID, file.FileMarkNum, file.Offset, segments, file.Size, file.Checksum))
+		}
+	}
+	tapes, err := catalog.GetTapes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tape := range tapes {
+		lines = append(lines, fmt.Sprintf("tape %d %s in slot %d full %t error %t invalid from %d:%d", tape.ID, tape.Name,
+			tape.SlotNumber, tape.IsFull, tape.ErrorInTape, tape.InvalidFileMark, tape.InvalidOffset))
+	}
+	storages, err := catalog.GetStorages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range storages {
+		lines = append(lines, fmt.Sprintf("storage %d has tape %d", storage.ID, storage.TapeID))
+	}
+	return lines
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The files of the tests. The tapes fill up before the last file, which is larger than what is left of a
+// tape and continues on the next one
+var testFiles = map[string]int{
+	"/data/a.csv":            3000,
+	"/data/empty":            0,
+	"/data/logs/b.log":       60000,
+	"/data/logs/c.log":       100,
+	"/data/logs/old/d.log":   40000,
+	"/data/logs/old/e.log.z": 150000,
+}
+
+// The capacity of the tapes of the tests
+const testCapacity = 256 << 10
+
+// fullBackup creates the catalog with the backend, and runs a full backup of /data as one recursive job
+func (library *testLibrary) fullBackup(t *testing.T, backend string) pgdb.Catalog {
+	catalog := library.newCatalog(t, backend, "catalog.db")
+	if err := catalog.AddPathSpec("/data", "nightly"); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.SetPathSpecRecursive("/data", true); err != nil {
+		t.Fatal(err)
+	}
+	library.backup(t, "/data", "nightly", pgdb.Levels.Full)
+	return catalog
+}
+
+func TestBackupScanRestore(t *testing.T) {
+	for _, backend := range catalogBackends {
+		t.Run(backend, func(t *testing.T) {
+			testBackupScanRestore(t, backend, 4096)
+		})
+	}
+}
+
+func TestBackupScanRestoreSmallRecords(t *testing.T) {
+	// Records smaller than the 4096 bytes of a default bufio buffer
+	testBackupScanRestore(t, "sqlite", 512)
+}
+
+func testBackupScanRestore(t *testing.T, backend string, recordSize int) {
+	library, cleanup := newTestLibrary(t, testCapacity, testFiles)
+	defer cleanup()
+	appSettings.Limits.RecordSize = recordSize
+	catalog := library.fullBackup(t, backend)
+	defer catalog.Close()
+
+	// Every file is cataloged with what it had when backed up
+	backedUp := library.latestFiles(t, catalog)
+	continued := 0
+	for name, file := range backedUp {
+		sum := sha256.Sum256(library.files[name])
+		if file.Checksum != hex.EncodeToString(sum[:]) || file.Size != int64(len(library.files[name])) {
+			t.Errorf("%s has checksum %s and size %d, want %x and %d", name, file.Checksum, file.Size, sum, len(library.files[name]))
+		}
+		continued += file.Segments
+	}
+	if continued == 0 {
+		t.Error("no file was continued on another tape")
+	}
+
+	library.restore(t, catalog, "/data", library.sortedNames("/data"))
+	library.restore(t, catalog, "/data/logs/old", library.sortedNames("/data/logs/old"))
+
+	// A catalog rebuilt from the tapes alone has the same entries, and restores the same files
+	scanned := library.newCatalog(t, backend, "scanned.db")
+	defer scanned.Close()
+	library.scan(t, scanned)
+	for name, file := range library.latestFiles(t, scanned) {
+		want := backedUp[name]
+		if file.TapeID != want.TapeID || file.FileMarkNum != want.FileMarkNum || file.Offset != want.Offset ||
+			file.Segments != want.Segments || file.Size != want.Size {
+			t.Errorf("scanned %+v, want %+v", file, want)
+		}
+		// The checksum of a continued file covers parts on other tapes, so it is only known from the backup
+		if file.Segments == 0 && file.Checksum != want.Checksum {
+			t.Errorf("scanned checksum %s of %s, want %s", file.Checksum, name, want.Checksum)
+		}
+		segments, err := scanned.GetFileSegments(file.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantSegments, err := catalog.GetFileSegments(want.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(segments) != len(wantSegments) {
+			t.Errorf("scanned segments %+v of %s, want %+v", segments, name, wantSegments)
+			continue
+		}
+		for i := range segments {
+			if segments[i] != wantSegments[i] {
+				t.Errorf("scanned segments %+v of %s, want %+v", segments, name, wantSegments)
+				break
+			}
+		}
+	}
+	library.restore(t, scanned, "/data", library.sortedNames("/data"))
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	summaries := make(map[string][]string)
+	for _, backend := range catalogBackends {
+		t.Run(backend, func(t *testing.T) {
+			summaries[backend] = testIncrementalBackup(t, backend)
+		})
+	}
+
+	// The same backups give the same catalog whatever its backend
+	want := summaries[catalogBackends[0]]
+	for _, backend := range catalogBackends[1:] {
+		got := summaries[backend]
+		if equalStrings(got, want) {
+			continue
+		}
+		for i := 0; i < len(got) || i < len(want); i++ {
+			var gotLine, wantLine string
+			if i < len(got) {
+				gotLine = got[i]
+			}
+			if i < len(want) {
+				wantLine = want[i]
+			}
+			if gotLine != wantLine {
+				t.Errorf("%s catalog has %q, %s has %q", backend, gotLine, catalogBackends[0], wantLine)
+			}
+		}
+	}
+}
+
+// testIncrementalBackup runs a full then an incremental backup with the backend, and returns the summary
+// of the catalog
+func testIncrementalBackup(t *testing.T, backend string) []string {
+	library, cleanup := newTestLibrary(t, testCapacity, testFiles)
+	defer cleanup()
+	catalog := library.fullBackup(t, backend)
+	defer catalog.Close()
+	full := library.latestFiles(t, catalog)
+
+	// A file changed and a file added after the full backup
+	modTime := time.Now().Add(time.Minute).Truncate(time.Second)
+	library.writeFile(t, "/data/logs/c.log", []byte("changed after the full backup\n"), modTime)
+	library.writeFile(t, "/data/logs/new.log", bytes.Repeat([]byte("new\n"), 5000), modTime)
+	library.backup(t, "/data", "nightly", pgdb.Levels.Incremental)
+
+	jobs, err := catalog.GetJobsByState("1", pgdb.States.Complete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[1].Level != pgdb.Levels.Incremental || jobs[1].NumOfFiles.Int64 != 2 {
+		t.Fatalf("complete jobs %+v, want the full job and an incremental job of 2 files", jobs)
+	}
+	for name, file := range library.latestFiles(t, catalog) {
+		changed := name == "/data/logs/c.log" || name == "/data/logs/new.log"
+		if changed && file.JobID != jobs[1].ID {
+			t.Errorf("latest %s is of job %d, want the incremental job %d", name, file.JobID, jobs[1].ID)
+		}
+		if !changed && file.ID != full[name].ID {
+			t.Errorf("latest %s is %+v, want the one of the full backup %+v", name, file, full[name])
+		}
+	}
+
+	// The restore takes the unchanged files from the full backup and the others from the incremental one
+	library.restore(t, catalog, "/data", library.sortedNames("/data"))
+	return summary(t, catalog)
+}
+
+func TestScheduledLevelRunsAfterFailedJob(t *testing.T) {
+	for _, backend := range catalogBackends {
+		t.Run(backend, func(t *testing.T) {
+			library, cleanup := newTestLibrary(t, testCapacity, testFiles)
+			defer cleanup()
+			catalog := library.fullBackup(t, backend)
+			defer catalog.Close()
+
+			// An incremental that failed before the next full is scheduled
+			if err := catalog.AddJob("/data", "1", 1, pgdb.Levels.Incremental); err != nil {
+				t.Fatal(err)
+			}
+			failed, err := catalog.GetAJob("1", time.Now().In(time.UTC))
+			if err != nil || failed == nil {
+				t.Fatalf("GetAJob() = %+v, %v", failed, err)
+			}
+			if err := catalog.UpdateJob(failed.ID, failed.Name, time.Now().In(time.UTC), time.Minute, 0, pgdb.States.InComplete, 1); err != nil {
+				t.Fatal(err)
+			}
+
+			// The full runs as a new job rather than resuming the incremental, which is closed
+			library.backup(t, "/data", "nightly", pgdb.Levels.Full)
+			jobs, err := catalog.GetJobsByState("1", pgdb.States.Complete)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(jobs) != 2 || jobs[1].Level != pgdb.Levels.Full || jobs[1].NumOfFiles.Int64 != int64(len(testFiles)) {
+				t.Errorf("complete jobs %+v, want two full jobs of %d files", jobs, len(testFiles))
+			}
+			interrupted, err := catalog.GetJobsByState("1", pgdb.States.Interrupted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(interrupted) != 1 || interrupted[0].ID != failed.ID {
+				t.Errorf("interrupted jobs %+v, want the failed incremental %d", interrupted, failed.ID)
+			}
+		})
+	}
+}
+
+func TestRecoveryClosesDanglingArchive(t *testing.T) {
+	for _, backend := range catalogBackends {
+		t.Run(backend, func(t *testing.T) {
+			library, cleanup := newTestLibrary(t, testCapacity, testFiles)
+			defer cleanup()
+			catalog := library.fullBackup(t, backend)
+			defer catalog.Close()
+
+			// What a backup stopped by a signal leaves: its jobs aren't In-Progress, but the archive it was
+			// writing has no file mark
+			tapeConfig, err := tape.New(library.drivePath, appSettings.Limits.RecordSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tapeConfig.JumpToEOM(); err != nil {
+				t.Fatal(err)
+			}
+			fileMarks := tapeConfig.GetFileMarkNum()
+			if _, err := tapeConfig.Drive.Write(make([]byte, appSettings.Limits.RecordSize)); err != nil {
+				t.Fatal(err)
+			}
+			tapeConfig.CloseTape()
+
+			config := new(backUpconfig)
+			defer config.closeAll()
+			if err := setupBackupConfig(config, "1"); err != nil {
+				t.Fatal(err)
+			}
+			lastFileMark, danglingData, err := config.inspectEndOfData()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lastFileMark != fileMarks+1 || danglingData {
+				t.Errorf("inspectEndOfData() = %d, %v after recovery, want %d, false", lastFileMark, danglingData, fileMarks+1)
+			}
+		})
+	}
+}
+
+func TestEarlyWarningOnTrailer(t *testing.T) {
+	for _, backend := range catalogBackends {
+		t.Run(backend, func(t *testing.T) {
+			// With the label and the job header, the archive of the file ends at the early warning of the
+			// first tape, 64 KiB before its end, by its last record
+			library, cleanup := newTestLibrary(t, testCapacity, map[string]int{"/data/a.bin": 186368})
+			defer cleanup()
+			catalog := library.fullBackup(t, backend)
+			defer catalog.Close()
+
+			// The trailer was written on the next tape, after the header of the continuation, rather than in
+			// the room left on the first one
+			first := library.tapeFiles(t, "T00001")
+			if want := []string{tape.LabelEntryName, tape.JobHeaderEntryName, "/data/a.bin"}; !equalStrings(first, want) {
+				t.Errorf("files of the first tape start with %q, want %q", first, want)
+			}
+			second := library.tapeFiles(t, "T00002")
+			if want := []string{tape.LabelEntryName, tape.JobHeaderEntryName, tape.JobTrailerEntryName}; !equalStrings(second, want) {
+				t.Errorf("files of the second tape start with %q, want %q", second, want)
+			}
+			library.restore(t, catalog, "/data", []string{"/data/a.bin"})
+
+			scanned := library.newCatalog(t, backend, "scanned.db")
+			defer scanned.Close()
+			library.scan(t, scanned)
+			library.restore(t, scanned, "/data", []string{"/data/a.bin"})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package pgdb
+
+import "time"
+
+// Catalog is the record of the backup: the jobs, the files they wrote, the tapes and drives the files were
+// written with, and the path specs of the directories. DBConn is the implementation used in production,
+// on Postgres or SQLite; the memdb package keeps the same records in memory. Pool IDs are passed as strings where the
+// callers have them from the command line.
+type Catalog interface {
+	// Jobs
+	AddJob(name string, poolID string, pathspecid int, level string) error
+	AddCompleteJob(name string, poolID int, pathspecid int, startTime time.Time, level string) (int, error)
+	GetAJob(poolID string, startTime time.Time) (*Job, error)
+	GetJobsByState(poolID string, state string) ([]Job, error)
+	RequeueJob(ID int) error
+	GetResumableJob(name string, poolID string, level string) (*Job, error)
+	ResumeJob(ID int) error
+	CheckJobExists(name string, poolID string) (bool, error)
+	UpdateJob(id int, name string, startTime time.Time, duration time.Duration, numOfFiles int, state string, poolID int) error
+	SetJobEndTime(ID int, endTime time.Time) error
+	InterruptCloseJob(poolID string) error
+	GetLastExec(path string, poolID string, level string) (time.Time, error)
+	AddJobTapeMap(jobName string, jobID int, tapeID int) error
+
+	// Files
+	AddFile(fileName string, jobID int, tapeID int, fileMarkNum int, offset int64, checksum string, size int64, modTime time.Time) (int, error)
+	AddFileSegment(fileID int, segment FileSegment) error
+	GetFileSegments(fileID int) ([]FileSegment, error)
+	GetFileOnTape(name string, tapeID int, fileMarkNum int) (*File, error)
+	GetLatestFile(name string, poolID string) (*File, error)
+	GetFilesAsOf(jobName string, poolID string, asOf time.Time) ([]File, error)
+	GetFilesOfJob(jobID int) ([]File, error)
+	DeleteFile(ID int) error
+	SetJobListing(jobID int, entries []ListingEntry) error
+	GetJobListing(jobID int) ([]ListingEntry, bool, error)
+
+	// Tapes
+	AddTape(name string, poolID int, slotNum int) error
+	RelabelTape(ID int, poolID int, slotNum int) error
+	GetTape(ID int) (*Tape, error)
+	GetTapeByName(name string) (*Tape, error)
+	GetTapes() ([]Tape, error)
+	GetTapesFromPool(poolID string) ([]Tape, error)
+	UpdateTapeTable(slotNum int, isFull bool, errorinTape bool, ID int) error
+	SetInvalidTail(ID int, fileMarkNum int, offset int64) error
+	UpdateTapeSlot(slotNum int, ID int) error
+	LoadTape(drivePath string, tapeID int, forWriting bool) error
+	UnloadTape(drivePath string, tapeID int, slotNum int, isFull bool) error
+	UpdateErrorInTapeReason(poolID string, reason string) error
+
+	// Pools and storage
+	GetPair(poolID string) (string, error)
+	GetStoragePath(poolID string) (string, error)
+	GetStorages() ([]Storage, error)
+	GetTapeInfo(tapePath string) (int, int, error)
+	UpdateStorage(tapeID int, name string) error
+
+	// Path specs
+	GetPathSpec(path string) (int, string, error)
+	AddPathSpec(path string, schedule string) error
+	IsPathSpecRecursive(ID int) (bool, error)
+	SetPathSpecRecursive(path string, recursive bool) error
+
+	Close()
+}
+
+var _ Catalog = (*DBConn)(nil)
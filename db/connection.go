@@ -0,0 +1,228 @@
+package pgdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DSNEnv is the environment variable that can hold a full connection string or postgres:// URL. It takes
+// precedence over every other setting
+const DSNEnv = "BACKUPTEST_DB_DSN"
+
+// ConnOptions are the settings New connects with. The main package sets them from the configuration file
+var ConnOptions = Options{
+	CredentialsFile: "dbAuthen.txt",
+	ConnectTimeout:  10 * time.Second,
+}
+
+// Options describe how to connect to the catalog DB. Connection parameters left empty are taken by lib/pq
+// from the standard PGHOST, PGPORT, PGUSER, PGPASSWORD, PGDATABASE, PGSSLMODE... environment variables
+type Options struct {
+	// Driver is DriverPostgres or DriverSQLite; empty is DriverPostgres
+	Driver string
+	// Path is the file of a SQLite catalog; the pg settings are ignored for SQLite
+	Path string
+	// ReadOnly opens an existing SQLite catalog without writing to it
+	ReadOnly bool
+
+	// DSN is a full connection string or postgres:// URL; the other connection parameters are ignored when set
+	DSN string
+	// CredentialsFile holds the user, password and dbname. It is skipped when it doesn't exist, and refused
+	// when other users can read it
+	CredentialsFile string
+
+	Host     string
+	Port     int
+	User     string
+	DBName   string
+	SSLMode  string
+	// SSLRootCert is the CA certificate the server certificate is checked with
+	SSLRootCert string
+	// SSLCert and SSLKey are the client certificate and its key
+	SSLCert string
+	SSLKey  string
+
+	// Connection pool sizing, 0 for the database/sql defaults
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// ConnectTimeout bounds the ping done when connecting
+	ConnectTimeout time.Duration
+}
+
+// credentials are the content of the credentials file
+type credentials struct {
+	User     string
+	Password string
+	DBName   string
+}
+
+var passwordReg = regexp.MustCompile(`password=('(\\.|[^'])*'|\S+)`)
+
+/**
+Description:
+	This function builds the connection string from the options: the DSN environment variable, else the
+	DSN option, else the connection parameters and the credentials file
+Parameter:
+	options: The connection options
+Return:
+	string: The connection string given to lib/pq
+	error if the credentials file can't be used
+*/
+func (options *Options) connectionString() (string, error) {
+	if dsn := os.Getenv(DSNEnv); dsn != "" {
+		return dsn, nil
+	}
+	if options.DSN != "" {
+		return options.DSN, nil
+	}
+
+	params := make(map[string]string)
+	if options.CredentialsFile != "" {
+		creds, err := readCredentials(options.CredentialsFile)
+		if err != nil {
+			return "", err
+		}
+		if creds != nil {
+			params["user"] = creds.User
+			params["password"] = creds.Password
+			params["dbname"] = creds.DBName
+		}
+	}
+
+	set := func(key string, value string) {
+		if value != "" {
+			params[key] = value
+		}
+	}
+	set("host", options.Host)
+	if options.Port != 0 {
+		set("port", fmt.Sprint(options.Port))
+	}
+	set("user", options.User)
+	set("dbname", options.DBName)
+	set("sslmode", options.SSLMode)
+	set("sslrootcert", options.SSLRootCert)
+	set("sslcert", options.SSLCert)
+	set("sslkey", options.SSLKey)
+
+	var pairs []string
+	for _, key := range []string{"host", "port", "user", "password", "dbname", "sslmode", "sslrootcert", "sslcert", "sslkey"} {
+		if value, found := params[key]; found && value != "" {
+			pairs = append(pairs, key+"="+quoteParam(value))
+		}
+	}
+	return strings.Join(pairs, " "), nil
+}
+
+/**
+Description:
+	This function quotes a value of a key=value connection string, so that spaces, quotes and backslashes
+	in passwords survive
+*/
+func quoteParam(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+/**
+Description:
+	This function reads the credentials file. Two formats are accepted: the original one line
+		(username) (password) (databasename)
+	and one key=value per line, where the password can contain spaces
+		user=backup
+		password=my secret
+		dbname=backupTest
+	Surrounding whitespace, eg a trailing newline, is ignored
+Parameter:
+	credentialsPath: The path of the file
+Return:
+	*credentials: The credentials, nil if the file doesn't exist
+	error if the file can't be read, is readable by other users or is malformed
+*/
+func readCredentials(credentialsPath string) (*credentials, error) {
+	file, err := os.Open(credentialsPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, errors.New(credentialsPath + " can be read by other users (mode " +
+			fmt.Sprintf("%#o", info.Mode().Perm()) + "), please chmod 600 it")
+	}
+
+	// The non empty lines, and their line numbers
+	var lines []string
+	var lineNums []int
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+			lineNums = append(lineNums, lineNum)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	creds := new(credentials)
+	if len(lines) == 1 && !strings.Contains(lines[0], "=") {
+		fields := strings.Fields(lines[0])
+		if len(fields) != 3 {
+			return nil, errors.New(credentialsPath + ": expected (username) (password) (databasename)")
+		}
+		creds.User, creds.Password, creds.DBName = fields[0], fields[1], fields[2]
+		return creds, nil
+	}
+
+	for i, line := range lines {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: line %d: expected key=value", credentialsPath, lineNums[i])
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		switch key {
+		case "user":
+			creds.User = value
+		case "password":
+			creds.Password = value
+		case "dbname":
+			creds.DBName = value
+		default:
+			return nil, fmt.Errorf("%s: line %d: unknown key %q", credentialsPath, lineNums[i], key)
+		}
+	}
+	return creds, nil
+}
+
+/**
+Description:
+	This function returns the connection string without its password, to be shown in error messages
+*/
+func redact(dsn string) string {
+	if dsn == "" {
+		return "the PG environment variables"
+	}
+	if u, err := url.Parse(dsn); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		if u.User != nil {
+			u.User = url.User(u.User.Username())
+		}
+		return u.String()
+	}
+	return passwordReg.ReplaceAllString(dsn, "password=xxxxx")
+}
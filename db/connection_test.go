@@ -0,0 +1,156 @@
+package pgdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCredentials writes a credentials file with the mode, and returns its path
+func writeCredentials(t *testing.T, dir string, content string, mode os.FileMode) string {
+	credentialsPath := filepath.Join(dir, "dbAuthen.txt")
+	// The file of a previous test may be read only
+	os.Remove(credentialsPath)
+	if err := ioutil.WriteFile(credentialsPath, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// The umask may have removed bits of mode
+	if err := os.Chmod(credentialsPath, mode); err != nil {
+		t.Fatal(err)
+	}
+	return credentialsPath
+}
+
+func TestReadCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		mode    os.FileMode
+		want    *credentials
+		// err is part of the expected error, "" for none
+		err string
+	}{
+		{"one line", "backup s3cret backupTest\n", 0600, &credentials{"backup", "s3cret", "backupTest"}, ""},
+		{"key=value", "user=backup\npassword=my secret\ndbname=backupTest\n", 0600,
+			&credentials{"backup", "my secret", "backupTest"}, ""},
+		{"comments and blank lines", "# catalog\n\nuser = backup\npassword = a=b\n\ndbname = backupTest\n", 0400,
+			&credentials{"backup", "a=b", "backupTest"}, ""},
+		{"readable by others", "backup s3cret backupTest\n", 0644, nil, "chmod 600"},
+		{"readable by the group", "backup s3cret backupTest\n", 0640, nil, "chmod 600"},
+		{"missing field", "backup s3cret\n", 0600, nil, "expected (username) (password) (databasename)"},
+		{"unknown key", "user=backup\nhost=db\n", 0600, nil, `line 2: unknown key "host"`},
+		{"not key=value", "user=backup\npassword\n", 0600, nil, "line 2: expected key=value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			creds, err := readCredentials(writeCredentials(t, dir, test.content, test.mode))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected an error with %q, got %+v, %v", test.err, creds, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *creds != *test.want {
+				t.Errorf("got %+v, want %+v", creds, test.want)
+			}
+		})
+	}
+
+	// A missing file is skipped
+	if creds, err := readCredentials(filepath.Join(dir, "missing.txt")); creds != nil || err != nil {
+		t.Errorf("got %+v, %v for a missing file, want nil, nil", creds, err)
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	credentialsPath := writeCredentials(t, dir, "user=backup\npassword=it's a \\secret\ndbname=backupTest\n", 0600)
+
+	defer os.Setenv(DSNEnv, os.Getenv(DSNEnv))
+	os.Unsetenv(DSNEnv)
+
+	tests := []struct {
+		name    string
+		options Options
+		want    string
+	}{
+		{"nothing set", Options{}, ""},
+		{"missing credentials file", Options{CredentialsFile: filepath.Join(dir, "missing.txt"), Host: "db"}, "host='db'"},
+		{"credentials file", Options{CredentialsFile: credentialsPath},
+			`user='backup' password='it\'s a \\secret' dbname='backupTest'`},
+		{"parameters override the file", Options{CredentialsFile: credentialsPath, Host: "db.example.com", Port: 5433,
+			User: "restore", SSLMode: "verify-full", SSLRootCert: "/etc/ssl/root.crt"},
+			`host='db.example.com' port='5433' user='restore' password='it\'s a \\secret' dbname='backupTest' ` +
+				`sslmode='verify-full' sslrootcert='/etc/ssl/root.crt'`},
+		{"client certificate", Options{Host: "db", SSLCert: "client.crt", SSLKey: "client key"},
+			`host='db' sslcert='client.crt' sslkey='client key'`},
+		{"dsn", Options{DSN: "postgres://backup@db/backupTest", CredentialsFile: credentialsPath, Host: "other"},
+			"postgres://backup@db/backupTest"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.options.connectionString()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// The environment variable takes precedence over every option
+	os.Setenv(DSNEnv, "host=env dbname=backupTest")
+	options := Options{DSN: "postgres://backup@db/backupTest", CredentialsFile: credentialsPath}
+	if got, err := options.connectionString(); err != nil || got != "host=env dbname=backupTest" {
+		t.Errorf("got %s, %v, want the DSN of the environment", got, err)
+	}
+	os.Unsetenv(DSNEnv)
+
+	// A credentials file readable by others is refused rather than skipped
+	if err := os.Chmod(credentialsPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	options = Options{CredentialsFile: credentialsPath}
+	if got, err := options.connectionString(); err == nil {
+		t.Errorf("got %s, want an error", got)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		dsn  string
+		want string
+	}{
+		{"", "the PG environment variables"},
+		{"host='db' user='backup' password='it\\'s secret' dbname='backupTest'",
+			"host='db' user='backup' password=xxxxx dbname='backupTest'"},
+		{"host=db password=s3cret dbname=backupTest", "host=db password=xxxxx dbname=backupTest"},
+		{"postgres://backup:s3cret@db:5432/backupTest?sslmode=require",
+			"postgres://backup@db:5432/backupTest?sslmode=require"},
+		{"postgresql://db/backupTest", "postgresql://db/backupTest"},
+	}
+
+	for _, test := range tests {
+		if got := redact(test.dsn); got != test.want {
+			t.Errorf("redact(%q) = %q, want %q", test.dsn, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package pgdb
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// copyTables are the tables of the catalog, in an order where every row only references rows copied before
+// it. Storage.TapeID is the exception: it is set once the tapes are copied
+var copyTables = []string{"storage", "pool", "tape", "pathspec", "job", "file", "filesegment", "jobtapemap", "joblisting"}
+
+// TableCount is the number of rows copied to a table
+type TableCount struct {
+	Table string
+	Rows  int
+}
+
+/**
+Description:
+	This method copies every row of the catalog to another catalog, keeping the ids, in one transaction. It
+	is used to move a SQLite catalog to a pg server when a site grows. The target must be migrated to the
+	same schema version, and be empty
+Parameter:
+	target: The catalog the rows are copied to
+Return:
+	[]TableCount: The number of rows copied to each table
+	error if any; nothing is copied then
+*/
+func (db *DBConn) CopyTo(target *DBConn) ([]TableCount, error) {
+	for _, table := range copyTables {
+		var count int
+		if err := target.queryRow("SELECT count(*) FROM " + table).Scan(&count); err != nil {
+			return nil, errors.New(err.Error() + "; couldn't count the rows of " + table + " in the target")
+		}
+		if count != 0 {
+			return nil, errors.New("The " + table + " table of the target already has " + strconv.Itoa(count) +
+				" row(s), the catalog can only be copied to an empty DB")
+		}
+	}
+
+	tx, err := target.DBSql.Begin()
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't start the copy transaction")
+	}
+	fail := func(err error, context string) ([]TableCount, error) {
+		tx.Rollback()
+		return nil, errors.New(err.Error() + "; " + context)
+	}
+
+	// The tape in each drive, set after the tapes are copied
+	storageTapes := make(map[int64]interface{})
+	var counts []TableCount
+	for _, table := range copyTables {
+		rows, err := db.query("SELECT * FROM " + table + " ORDER BY id")
+		if err != nil {
+			return fail(err, "couldn't read the "+table+" table")
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return fail(err, "couldn't read the columns of "+table)
+		}
+		params := make([]string, len(columns))
+		for i := range columns {
+			params[i] = "$" + strconv.Itoa(i+1)
+		}
+		insert := target.rebind("INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" +
+			strings.Join(params, ", ") + ")")
+
+		count := 0
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for i := range values {
+				pointers[i] = &values[i]
+			}
+			if err := rows.Scan(pointers...); err != nil {
+				rows.Close()
+				return fail(err, "error while scanning the "+table+" table")
+			}
+			if table == "storage" {
+				for i, column := range columns {
+					if strings.ToLower(column) == "tapeid" {
+						storageTapes[values[0].(int64)] = values[i]
+						values[i] = nil
+					}
+				}
+			}
+			if _, err := tx.Exec(insert, target.bindArgs(values)...); err != nil {
+				rows.Close()
+				return fail(err, "couldn't copy a row of the "+table+" table")
+			}
+			count++
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fail(err, "error while iterating the "+table+" table")
+		}
+		counts = append(counts, TableCount{Table: table, Rows: count})
+	}
+
+	for storageID, tapeID := range storageTapes {
+		query := target.rebind("UPDATE Storage SET tapeid=$1 WHERE id=$2")
+		if _, err := tx.Exec(query, tapeID, storageID); err != nil {
+			return fail(err, "couldn't set the tape of drive "+strconv.FormatInt(storageID, 10))
+		}
+	}
+
+	// The ids were copied, so the sequences must continue after them
+	if target.driver == DriverPostgres {
+		for _, table := range copyTables {
+			query := "SELECT setval(pg_get_serial_sequence('" + table + "', 'id'), max(id)) FROM " + table +
+				" HAVING max(id) IS NOT NULL"
+			if _, err := tx.Exec(query); err != nil {
+				return fail(err, "couldn't set the id sequence of "+table)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err, "couldn't commit the copy")
+	}
+	return counts, nil
+}
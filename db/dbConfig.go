@@ -1,13 +1,12 @@
 package pgdb
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/lib/pq"
@@ -15,6 +14,8 @@ import (
 
 type DBConn struct {
 	DBSql *sql.DB
+	// driver is DriverPostgres or DriverSQLite
+	driver string
 }
 
 type Job struct {
@@ -25,11 +26,117 @@ type Job struct {
 	NumOfFiles        sql.NullInt64
 	State             string
 	PoolID            int
-	PathSpecID        int
+	// PathSpecID is -1 for the jobs a scan found of a directory without a path spec
+	PathSpecID int
+	// Level is one of Levels
+	Level string
+	// EndTime is when the job became Complete, NULL before
+	EndTime pq.NullTime
+}
+
+// jobColumns are the columns of the Job table, in the order scanJob reads them
+const jobColumns = "id, name, starttime, durationinminutes, numoffiles, state, poolid, COALESCE(pathspecid, -1), level, endtime"
+
+// rowScanner is a *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// fileColumns are the columns of the File table, in the order scanFile reads them
+const fileColumns = "File.id, File.name, File.jobid, File.filemarknum, File.tapeid, COALESCE(File.taroffset, -1), " +
+	"File.segments, COALESCE(File.checksum, ''), COALESCE(File.size, -1), File.modtime"
+
+// tapeColumns are the columns of the Tape table, in the order scanTape reads them
+const tapeColumns = "id, name, poolid, slotnumber, isfull, errorintape, COALESCE(invalidfilemark, -1), " +
+	"COALESCE(invalidoffset, -1)"
+
+/**
+Description:
+	This function reads a row of tapeColumns
+*/
+func scanTape(row rowScanner, tape *Tape) error {
+	return row.Scan(&tape.ID, &tape.Name, &tape.PoolID, &tape.SlotNumber, &tape.IsFull, &tape.ErrorInTape,
+		&tape.InvalidFileMark, &tape.InvalidOffset)
+}
+
+/**
+Description:
+	This function reads a row of jobColumns
+*/
+func scanJob(row rowScanner, job *Job) error {
+	return row.Scan(&job.ID, &job.Name, &job.StartTime, &job.DurationInMinutes, &job.NumOfFiles, &job.State, &job.PoolID, &job.PathSpecID, &job.Level,
+		&job.EndTime)
+}
+
+/**
+Description:
+	This function reads a row of fileColumns
+*/
+func scanFile(row rowScanner, file *File) error {
+	return row.Scan(&file.ID, &file.Name, &file.JobID, &file.FileMarkNum, &file.TapeID, &file.Offset, &file.Segments,
+		&file.Checksum, &file.Size, &file.ModTime)
+}
+
+type File struct {
+	ID          int
+	Name        string
+	JobID       int
+	FileMarkNum int
+	TapeID      int
+	// Offset is where the tar header of the file starts in the archive at FileMarkNum, -1 for the files
+	// cataloged before offsets were recorded, which are found by reading the archive from its start
+	Offset int64
+	// Segments is the number of FileSegments continuing the file on other tapes, 0 when the whole file
+	// is at FileMarkNum
+	Segments int
+	// Checksum is the hex SHA-256 of the content written to tape, "" when it isn't known. Size (-1 when
+	// it isn't known) and ModTime are what the file had when it was backed up
+	Checksum string
+	Size     int64
+	ModTime  pq.NullTime
+}
+
+// FileSegment is the part of a file that didn't fit on the tape of its File row, or of the segment before
+// it: the tar entry at Offset of the archive at FileMarkNum, whose content starts at FileOffset of the file
+type FileSegment struct {
+	TapeID      int
+	FileMarkNum int
+	Offset      int64
+	FileOffset  int64
+}
+
+// ListingEntry is a file of a directory as it was listed by a job
+type ListingEntry struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+type Tape struct {
+	ID          int
+	Name        string
+	PoolID      int
+	SlotNumber  int
+	IsFull      bool
+	ErrorInTape bool
+	// InvalidFileMark and InvalidOffset are where the data left on the tape when it filled up starts, up to
+	// the end of the archive at InvalidFileMark; -1 when the tape has no invalid tail
+	InvalidFileMark int
+	InvalidOffset   int64
+}
+
+type Storage struct {
+	ID          int
+	Name        string
+	TapeID      int // -1 when no tape is in the drive
+	DriveNumber int
 }
 
 var States State
 
+// Levels are the backup levels of a job: which files of the directory it backs up
+var Levels Level
+
 type State struct {
 	Initialized string
 	InProgress  string
@@ -38,11 +145,24 @@ type State struct {
 	InComplete  string
 }
 
+type Level struct {
+	// Full backs up every file
+	Full string
+	// Differential backs up the files changed since the last full job
+	Differential string
+	// Incremental backs up the files changed since the last job of any level
+	Incremental string
+}
+
 /**
 Description:
-	Set up different possible states, so that there's no spelling mistake when user is typing the states
+	Set up different possible states and levels, so that there's no spelling mistake when user is typing them
 */
 func init() {
+	Levels.Full = "full"
+	Levels.Differential = "differential"
+	Levels.Incremental = "incremental"
+
 	States.Complete = "Complete"
 	States.Initialized = "Initialized"
 	States.InProgress = "In-Progress"
@@ -52,7 +172,7 @@ func init() {
 
 func (db *DBConn) UpdateErrorInTapeReason(poolID string, reason string) error {
 	query := "SELECT storage.tapeid FROM pool join storage on storage.id=pool.storageid WHERE pool.id=$1"
-	row := db.DBSql.QueryRow(query, poolID)
+	row := db.queryRow(query, poolID)
 	var tapeID int
 	err := row.Scan(&tapeID)
 	if err != nil {
@@ -60,7 +180,7 @@ func (db *DBConn) UpdateErrorInTapeReason(poolID string, reason string) error {
 	}
 
 	query = "Update Tape set errorinTape=true, errorreason=$2 where id=$1"
-	_, err = db.DBSql.Exec(query, tapeID, reason)
+	_, err = db.exec(query, tapeID, reason)
 	if err != nil {
 		return errors.New(err.Error() + "; couldn't update tape with sent error reason")
 	}
@@ -75,13 +195,50 @@ Parameter:
 */
 func (db *DBConn) UpdateTapeTable(slotNum int, isFull bool, errorinTape bool, ID int) error {
 	query := "UPDATE TAPE SET slotnumber=$1, isfull=$2, errorintape=$3 where id=$4"
-	_, err := db.DBSql.Exec(query, slotNum, isFull, errorinTape, ID)
+	_, err := db.exec(query, slotNum, isFull, errorinTape, ID)
 	if err != nil {
 		return errors.New(err.Error() + "; couldn't update tape with slotnumber, isfull, & errorinTape")
 	}
 	return nil
 }
 
+/**
+Description:
+	This method records where the data left on a tape that filled up starts. What was being written when
+	the end of the tape was reached is cut short there, and is written again on the next tape
+Parameter:
+	ID: The id of the tape
+	fileMarkNum: The file mark number of the archive that was cut short
+	offset: The offset in the archive where the invalid data starts
+Return:
+	error if any
+*/
+func (db *DBConn) SetInvalidTail(ID int, fileMarkNum int, offset int64) error {
+	query := "UPDATE Tape SET invalidfilemark=$1, invalidoffset=$2 WHERE id=$3"
+	_, err := db.exec(query, fileMarkNum, offset, ID)
+	if err != nil {
+		return errors.New(err.Error() + "; couldn't record the invalid tail of the tape")
+	}
+	return nil
+}
+
+/**
+Description:
+	This method is used to record the new slot of a tape that was moved by the changer, without
+	touching its isfull and errorintape flags. Slot 0 represents a tape that is in a drive.
+Parameter:
+	slotNum: The slot where the tape now resides
+	ID: The id of the tape
+*/
+func (db *DBConn) UpdateTapeSlot(slotNum int, ID int) error {
+	query := "UPDATE TAPE SET slotnumber=$1 where id=$2"
+	_, err := db.exec(query, slotNum, ID)
+	if err != nil {
+		return errors.New(err.Error() + "; couldn't update tape with slotnumber")
+	}
+	return nil
+}
+
 /**
 Description:
 	This method is used to update the storage table after the tape has been changed
@@ -91,20 +248,82 @@ Parameter:
 func (db *DBConn) UpdateStorage(tapeID int, name string) error {
 	if tapeID < 0 {
 		query := "UPDATE Storage SET tapeid=NULL where name=$1"
-		_, err := db.DBSql.Exec(query, name)
+		_, err := db.exec(query, name)
 		if err != nil {
 			return errors.New(err.Error() + "; couldn't update storage")
 		}
 		return nil
 	}
 	query := "UPDATE Storage SET tapeid=$1 where name=$2"
-	_, err := db.DBSql.Exec(query, tapeID, name)
+	_, err := db.exec(query, tapeID, name)
 	if err != nil {
 		return errors.New(err.Error() + "; couldn't update storage")
 	}
 	return nil
 }
 
+/**
+Description:
+	This method is used to record that a tape was loaded in a drive: the tape is in slot 0, and the drive
+	holds it. Both are updated in one transaction, so that the tape is never recorded in two places
+Parameter:
+	drivePath: The path of the drive, which is its name in the Storage table
+	tapeID: The id of the tape that was loaded
+	forWriting: true if the tape was loaded to be written to by a backup; it is then no longer full and
+		has no errors, as when the tape was loaded before
+Return:
+	error if any; nothing is updated then
+*/
+func (db *DBConn) LoadTape(drivePath string, tapeID int, forWriting bool) error {
+	return db.inTransaction(func(tx *txConn) error {
+		query := "UPDATE Tape SET slotnumber=0 WHERE id=$1"
+		if forWriting {
+			query = "UPDATE Tape SET slotnumber=0, isfull=false, errorintape=false WHERE id=$1"
+		}
+		if _, err := tx.exec(query, tapeID); err != nil {
+			return errors.New(err.Error() + "; couldn't update the slot of the loaded tape")
+		}
+		// A drive that was recorded with the tape can't have it anymore
+		query = "UPDATE Storage SET tapeid=NULL WHERE tapeid=$1 AND name<>$2"
+		if _, err := tx.exec(query, tapeID, drivePath); err != nil {
+			return errors.New(err.Error() + "; couldn't update storage")
+		}
+		if _, err := tx.exec("UPDATE Storage SET tapeid=$1 WHERE name=$2", tapeID, drivePath); err != nil {
+			return errors.New(err.Error() + "; couldn't update storage")
+		}
+		return nil
+	})
+}
+
+/**
+Description:
+	This method is used to record that the tape of a drive was unloaded to a slot, in one transaction
+Parameter:
+	drivePath: The path of the drive, which is its name in the Storage table
+	tapeID: The id of the tape that was unloaded, -1 if the tape isn't in the Tape table
+	slotNum: The slot where the tape now resides
+	isFull: true if the tape was unloaded because it is full
+Return:
+	error if any; nothing is updated then
+*/
+func (db *DBConn) UnloadTape(drivePath string, tapeID int, slotNum int, isFull bool) error {
+	return db.inTransaction(func(tx *txConn) error {
+		if tapeID >= 0 {
+			query := "UPDATE Tape SET slotnumber=$1 WHERE id=$2"
+			if isFull {
+				query = "UPDATE Tape SET slotnumber=$1, isfull=true WHERE id=$2"
+			}
+			if _, err := tx.exec(query, slotNum, tapeID); err != nil {
+				return errors.New(err.Error() + "; couldn't update the slot of the unloaded tape")
+			}
+		}
+		if _, err := tx.exec("UPDATE Storage SET tapeid=NULL WHERE name=$1", drivePath); err != nil {
+			return errors.New(err.Error() + "; couldn't update storage")
+		}
+		return nil
+	})
+}
+
 /**
 Description:
 	This method is used to the retrieve tapeID and the drive num of the
@@ -113,46 +332,146 @@ Parameter:
 	The path of the drive whose infor we need
 Return:
 	The driveNum it correspondes to
-	The id of the tape
+	The id of the tape, -1 if the drive has no tape of the DB
 	error if any
 */
 func (db *DBConn) GetTapeInfo(tapePath string) (int, int, error) {
 	query := "Select drivenumber, tapeid From storage where name=$1"
-	row := db.DBSql.QueryRow(query, tapePath)
+	row := db.queryRow(query, tapePath)
 
-	var driveNum, tapeID int
+	var driveNum int
+	var tapeID sql.NullInt64
 
 	err := row.Scan(&driveNum, &tapeID)
 	if err != nil {
 		return -1, -1, errors.New(err.Error() + "; couldn't find driveNum with given tapePath")
 	}
-	return driveNum, tapeID, nil
+	if !tapeID.Valid {
+		return driveNum, -1, nil
+	}
+	return driveNum, int(tapeID.Int64), nil
 }
 
 /**
 Description:
-	This method is used to get another tape from certain pool
+	This method is used to get the tapes of a pool that can still be written to, and aren't in a drive
 Parameter:
 	PoolID: The pool from where we need additional tape
 Return:
-	The slot where the additional tape resides
-	The tapeID of the tape
+	[]Tape: The tapes, ordered by name
 	error if any
 */
-func (db *DBConn) GetTapeFromPool(poolID string) (int, int, error) {
-	query := `SELECT slotnumber, id FROM Tape 
+func (db *DBConn) GetTapesFromPool(poolID string) ([]Tape, error) {
+	query := `SELECT ` + tapeColumns + ` FROM Tape
 	WHERE poolid=$1 AND slotnumber <> 0 AND isFull=false AND errorintape=false ORDER BY name`
 
-	row := db.DBSql.QueryRow(query, poolID)
+	rows, err := db.query(query, poolID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't find next tape from the pool")
+	}
+	defer rows.Close()
+
+	var tapes []Tape
+	for rows.Next() {
+		var tape Tape
+		err := scanTape(rows, &tape)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		tapes = append(tapes, tape)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return tapes, nil
+}
+
+/**
+Description:
+	This method is used to get a tape entry by its name, which is the barcode of the tape
+Parameter:
+	name: The name of the tape
+Return:
+	*Tape: The tape entry, nil if there is no tape with that name
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetTapeByName(name string) (*Tape, error) {
+	query := "SELECT " + tapeColumns + " FROM Tape WHERE name=$1"
+	row := db.queryRow(query, name)
+	var tape Tape
+	err := scanTape(row, &tape)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't find tape with given name")
+	}
+	return &tape, nil
+}
+
+/**
+Description:
+	This method is used to get every tape in the Tape table
+Return:
+	[]Tape: The tapes, ordered by name
+	error if any
+*/
+func (db *DBConn) GetTapes() ([]Tape, error) {
+	query := "SELECT " + tapeColumns + " FROM Tape ORDER BY name"
+	rows, err := db.query(query)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering the tapes")
+	}
+	defer rows.Close()
 
-	var fromslot, ID int
+	var tapes []Tape
+	for rows.Next() {
+		var tape Tape
+		err := scanTape(rows, &tape)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		tapes = append(tapes, tape)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return tapes, nil
+}
 
-	err := row.Scan(&fromslot, &ID)
+/**
+Description:
+	This method is used to get every drive in the Storage table
+Return:
+	[]Storage: The drives, ordered by drive number
+	error if any
+*/
+func (db *DBConn) GetStorages() ([]Storage, error) {
+	query := "SELECT id, name, tapeid, drivenumber FROM Storage ORDER BY drivenumber"
+	rows, err := db.query(query)
 	if err != nil {
-		return -1, -1, errors.New(err.Error() + "; couldn't find next tape from the pool")
+		return nil, errors.New(err.Error() + "; error while quering the storage")
 	}
+	defer rows.Close()
 
-	return fromslot, ID, nil
+	var storages []Storage
+	for rows.Next() {
+		var storage Storage
+		var tapeID sql.NullInt64
+		err := rows.Scan(&storage.ID, &storage.Name, &tapeID, &storage.DriveNumber)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		storage.TapeID = -1
+		if tapeID.Valid {
+			storage.TapeID = int(tapeID.Int64)
+		}
+		storages = append(storages, storage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return storages, nil
 }
 
 /**
@@ -169,7 +488,7 @@ Return:
 */
 func (db *DBConn) GetPathSpec(path string) (int, string, error) {
 	query := "SELECT id, schedule From PathSpec WHERE name=$1"
-	row := db.DBSql.QueryRow(query, path)
+	row := db.queryRow(query, path)
 
 	var schedule string
 	var id int
@@ -195,13 +514,9 @@ Return:
 	error: any error occured while execution, or nil
 */
 func (db *DBConn) AddPathSpec(path string, schedule string) error {
-	query := "INSERT INTO PathSpec VALUES (DEFAULT, $1, $2)"
-	_, err := db.DBSql.Exec(query, path, schedule)
+	query := "INSERT INTO PathSpec (name, schedule) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING"
+	_, err := db.exec(query, path, schedule)
 	if err != nil {
-		err2, _ := err.(*pq.Error)
-		if err2.Code.Name() == "unique_violation" {
-			return nil
-		}
 		return errors.New(err.Error() + "; error adding a new pathspec entry")
 	}
 	return nil
@@ -209,18 +524,70 @@ func (db *DBConn) AddPathSpec(path string, schedule string) error {
 
 /**
 Description:
-	This method retrieves the startTime of the latest entry of a completed Job. If Job doesn't
-		exists then it returns the 0001/01/01 date
+	This method tells whether the job of a PathSpec covers the whole subtree of its directory, rather than
+	only the files directly in it
+Parameter:
+	ID: The id of the PathSpec
+Return:
+	bool: true for a recursive PathSpec
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) IsPathSpecRecursive(ID int) (bool, error) {
+	var recursive bool
+	err := db.queryRow("SELECT COALESCE(recursive, false) FROM PathSpec WHERE id=$1", ID).Scan(&recursive)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.New(err.Error() + "; error finding the pathspec")
+	}
+	return recursive, nil
+}
+
+/**
+Description:
+	This method sets whether the job of a PathSpec covers the whole subtree of its directory
+Parameter:
+	path: The directory of the PathSpec
+	recursive: true for one job for the subtree, false for a job for every directory
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) SetPathSpecRecursive(path string, recursive bool) error {
+	result, err := db.exec("UPDATE PathSpec SET recursive=$1 WHERE name=$2", recursive, path)
+	if err != nil {
+		return errors.New(err.Error() + "; error updating the pathspec")
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return errors.New("There is no pathspec for " + path)
+	}
+	return nil
+}
+
+/**
+Description:
+	This method retrieves the startTime of the latest entry of a completed Job that a job of the given level
+		is based on: none for a full job, the latest full job for a differential one and the latest job of
+		any level for an incremental one. If Job doesn't exists then it returns the 0001/01/01 date, so
+		that every file is backed up
 Parameter:
 	path: represents the absolute path of a directory/Job
 	poolID: represents the type of backup with respect to the type of tape.
+	level: The level of the job being executed, one of Levels
 Return:
 	time: The latest time when the path Job was performed to completion.
 	error: any error occured while execution, or nil
 */
-func (db *DBConn) GetLastExec(path string, poolID string) (time.Time, error) {
-	query := "SELECT starttime FROM Job WHERE name=$1 AND poolID = $2 AND state=$3 ORDER BY startTime DESC"
-	rows, err := db.DBSql.Query(query, path, poolID, States.Complete)
+func (db *DBConn) GetLastExec(path string, poolID string, level string) (time.Time, error) {
+	if level == Levels.Full {
+		return time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC), nil
+	}
+	query := "SELECT starttime FROM Job WHERE name=$1 AND poolID = $2 AND state=$3 AND ($4 = '' OR level=$4) ORDER BY startTime DESC"
+	baseLevel := ""
+	if level == Levels.Differential {
+		baseLevel = Levels.Full
+	}
+	rows, err := db.query(query, path, poolID, States.Complete, baseLevel)
 	if err != nil {
 		return time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC),
 			errors.New(err.Error() + "; error quering the list of job with specific name")
@@ -248,8 +615,8 @@ Return:
 	error: any error occured while execution, or nil
 */
 func (db *DBConn) AddJobTapeMap(jobName string, jobID int, tapeID int) error {
-	query := "INSERT INTO JobTapeMap VALUES(DEFAULT, $1, $2, $3)"
-	_, err := db.DBSql.Exec(query, jobName, jobID, tapeID)
+	query := "INSERT INTO JobTapeMap (name, jobid, tapeid) VALUES ($1, $2, $3)"
+	_, err := db.exec(query, jobName, jobID, tapeID)
 	if err != nil {
 		return errors.New(err.Error() + "; error while adding entry to jobtapemap table")
 	}
@@ -267,7 +634,7 @@ Return:
 */
 func (db *DBConn) InterruptCloseJob(poolID string) error {
 	query := "UPDATE Job SET state=$2 WHERE poolID=$1 AND state=$3"
-	_, err := db.DBSql.Exec(query, poolID, States.Interrupted, States.InProgress)
+	_, err := db.exec(query, poolID, States.Interrupted, States.InProgress)
 	if err != nil {
 		return errors.New(err.Error() + "; error while updating job table with interrupt close")
 	}
@@ -284,13 +651,30 @@ Return:
 */
 func (db *DBConn) UpdateJob(id int, name string, startTime time.Time, duration time.Duration, numOfFiles int, state string, poolID int) error {
 	query := "UPDATE Job SET startTime=$3, durationInMinutes=$4, numOfFiles=$5, state=$6 WHERE id=$1 AND NAME=$2 AND poolID=$7"
-	_, err := db.DBSql.Exec(query, id, name, startTime, int(duration.Minutes()), numOfFiles, state, poolID)
+	_, err := db.exec(query, id, name, startTime, int(duration.Minutes()), numOfFiles, state, poolID)
 	if err != nil {
 		return errors.New(err.Error() + "; error while updating job")
 	}
 	return nil
 }
 
+/**
+Description:
+	This method records when a job became Complete, so that a restore of an earlier time leaves out the
+	files it wrote
+Parameter:
+	ID: The id of the job
+	endTime: When the job ended, or when its last file was written for a job found by a scan
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) SetJobEndTime(ID int, endTime time.Time) error {
+	if _, err := db.exec("UPDATE Job SET endtime=$2 WHERE id=$1", ID, endTime); err != nil {
+		return errors.New(err.Error() + "; error while recording the end of the job")
+	}
+	return nil
+}
+
 /**
 Description:
 	This method is used to get the path of tape drive according to the poolID sent as parameter
@@ -303,7 +687,7 @@ Return:
 */
 func (db *DBConn) GetStoragePath(poolID string) (string, error) {
 	query := "SELECT Storage.Name FROM Storage Join Pool ON Storage.Id = Pool.StorageId Where Pool.Id =$1"
-	rows, err := db.DBSql.Query(query, poolID)
+	rows, err := db.query(query, poolID)
 	if err != nil {
 		return "", errors.New(err.Error() + "; couldn't find the storage name for specific pool")
 	}
@@ -326,34 +710,150 @@ func (db *DBConn) GetStoragePath(poolID string) (string, error) {
 /**
 Description:
 	This method is used to get one initialized job from the DB. It will also update the state of
-	the job that it just retrieved to be in-progress.
+	the job that it just retrieved to be in-progress. The job is claimed in a transaction, and the rows
+	locked by another process are skipped, so that two processes never run the same job. A resumed job
+	keeps the start time of its first run.
 Parameter:
 	poolID: represents the poolID whose job we need to perform
 	startTime: represents that time that symbolizes the Job has not been scheduled
 Return:
-	*Job: The struct pointer that has the information about the Job that was just scheduled
+	*Job: The struct pointer that has the information about the Job that was just scheduled, as it was
+		before it was updated; nil if there is no initialized job
 	error: any error occured while execution, or nil
 */
 func (db *DBConn) GetAJob(poolID string, startTime time.Time) (*Job, error) {
-	query := "SELECT * FROM Job WHERE state='Initialized' AND poolID =$1 ORDER BY ID"
-	rows, err := db.DBSql.Query(query, poolID)
+	query := "SELECT " + jobColumns + " FROM Job WHERE state=$2 AND poolID =$1 ORDER BY ID LIMIT 1"
+	// SQLite has no row locks; the transaction holds the write lock of the whole file instead
+	if db.driver != DriverSQLite {
+		query += " FOR UPDATE SKIP LOCKED"
+	}
+
+	var job *Job
+	err := db.inTransaction(func(tx *txConn) error {
+		var tempJob Job
+		row := tx.queryRow(query, poolID, States.Initialized)
+		err := scanJob(row, &tempJob)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return errors.New(err.Error() + "; error while quering for job")
+		}
+
+		query := "UPDATE Job SET startTime=COALESCE(startTime, $2), durationInMinutes=0, numOfFiles=0, state=$3 WHERE id=$1"
+		if _, err := tx.exec(query, tempJob.ID, startTime, States.InProgress); err != nil {
+			return errors.New(err.Error() + "; error while updating job")
+		}
+		job = &tempJob
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+/**
+Description:
+	This method is used to get the jobs of a pool that are in a state
+Parameter:
+	poolID: The pool of the jobs
+	state: The state of the jobs, one of States
+Return:
+	[]Job: The jobs, ordered by id
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetJobsByState(poolID string, state string) ([]Job, error) {
+	query := "SELECT " + jobColumns + " FROM Job WHERE poolid=$1 AND state=$2 ORDER BY id"
+	rows, err := db.query(query, poolID, state)
 	if err != nil {
-		return nil, errors.New(err.Error() + "; error while quering for job")
+		return nil, errors.New(err.Error() + "; error while quering the jobs")
 	}
 	defer rows.Close()
+
+	var jobs []Job
 	for rows.Next() {
-		var tempJob Job
-		err := rows.Scan(&tempJob.ID, &tempJob.Name, &tempJob.StartTime, &tempJob.DurationInMinutes, &tempJob.NumOfFiles, &tempJob.State, &tempJob.PoolID, &tempJob.PathSpecID)
+		var job Job
+		err := scanJob(rows, &job)
 		if err != nil {
 			return nil, errors.New(err.Error() + "; error while scanning the result set")
 		}
-		err = db.UpdateJob(tempJob.ID, tempJob.Name, startTime, 0, 0, States.InProgress, tempJob.PoolID)
-		if err != nil {
-			return nil, err
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return jobs, nil
+}
+
+/**
+Description:
+	This method puts an In-Progress job back in the queue, as if it never ran, so that it is executed
+	again. Its JobTapeMap entries are removed with it, in one transaction
+Parameter:
+	ID: The id of the job
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) RequeueJob(ID int) error {
+	return db.inTransaction(func(tx *txConn) error {
+		if _, err := tx.exec("DELETE FROM JobTapeMap WHERE jobid=$1", ID); err != nil {
+			return errors.New(err.Error() + "; couldn't remove the tapes of the job")
 		}
-		return &tempJob, nil
+		query := `UPDATE Job SET starttime=NULL, durationinminutes=NULL, numoffiles=NULL, state=$2
+		WHERE id=$1 AND state=$3`
+		if _, err := tx.exec(query, ID, States.Initialized, States.InProgress); err != nil {
+			return errors.New(err.Error() + "; couldn't requeue the job")
+		}
+		return nil
+	})
+}
+
+/**
+Description:
+	This method is used to find the job of a directory that failed partway since the directory was last
+	backed up completely, so that it can be resumed instead of being started again. Only a job of the level
+	being scheduled is resumed, and only if no job of another level was added after it
+Parameter:
+	name: The absolute path of the directory
+	poolID: The pool of the job
+	level: The level of the job being scheduled, one of Levels
+Return:
+	*Job: The latest InComplete or Interrupted job of the level, nil if there is none
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetResumableJob(name string, poolID string, level string) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM Job WHERE name=$1 AND poolid=$2 AND (state=$3 OR state=$4) AND level=$6
+	AND id > COALESCE((SELECT max(id) FROM Job WHERE name=$1 AND poolid=$2 AND (state=$5 OR level<>$6)), 0)
+	ORDER BY id DESC LIMIT 1`
+	row := db.queryRow(query, name, poolID, States.InComplete, States.Interrupted, States.Complete, level)
+	var job Job
+	err := scanJob(row, &job)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while looking for a resumable job")
+	}
+	return &job, nil
+}
+
+/**
+Description:
+	This method puts an InComplete or Interrupted job back in the queue. Its files and start time are kept,
+	so that it continues after the last file it wrote
+Parameter:
+	ID: The id of the job
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) ResumeJob(ID int) error {
+	query := "UPDATE Job SET state=$2 WHERE id=$1 AND (state=$3 OR state=$4)"
+	_, err := db.exec(query, ID, States.Initialized, States.InComplete, States.Interrupted)
+	if err != nil {
+		return errors.New(err.Error() + "; couldn't resume the job")
 	}
-	return nil, nil
+	return nil
 }
 
 /**
@@ -367,7 +867,7 @@ Return:
 */
 func (db *DBConn) CheckJobExists(name string, poolID string) (bool, error) {
 	query := "SELECT name FROM Job WHERE name=$1 AND poolid=$2 AND (state=$3 OR state=$4)"
-	row := db.DBSql.QueryRow(query, name, poolID, States.Initialized, States.InProgress)
+	row := db.queryRow(query, name, poolID, States.Initialized, States.InProgress)
 	var tempString string
 	err := row.Scan(&tempString)
 	if err != nil && err != sql.ErrNoRows {
@@ -387,33 +887,458 @@ Parameter:
 Return:
 	error: any error occured while execution, or nil
 */
-func (db *DBConn) AddJob(name string, poolID string, pathspecid int) error {
+func (db *DBConn) AddJob(name string, poolID string, pathspecid int, level string) error {
 	// Make a new job only if error is norow found
-	query := "INSERT INTO JOB(id, name, state, poolid, pathspecid) VALUES (DEFAULT, $1, $2, $3, $4);"
-	_, err := db.DBSql.Exec(query, name, States.Initialized, poolID, pathspecid)
+	query := "INSERT INTO JOB(name, state, poolid, pathspecid, level) VALUES ($1, $2, $3, $4, $5);"
+	_, err := db.exec(query, name, States.Initialized, poolID, pathspecid, level)
 	if err != nil {
 		return errors.New(err.Error() + "; error while adding a Job")
 	}
 	return nil
 }
 
+/**
+Description:
+	This method adds a Job that is already Complete to the Job table; it is used when the catalog is rebuilt
+	from what is on tape
+Parameter:
+	name: The absolute path of the directory
+	poolID: The pool of the tape the job was found on
+	pathspecid: The pathspec of the directory, -1 if the directory has none
+	startTime: The time the job is recorded to have started
+	level: The level of the job, one of Levels
+Return:
+	int: The id of the new job
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) AddCompleteJob(name string, poolID int, pathspecid int, startTime time.Time, level string) (int, error) {
+	var pathspec sql.NullInt64
+	if pathspecid >= 0 {
+		pathspec = sql.NullInt64{Int64: int64(pathspecid), Valid: true}
+	}
+	query := `INSERT INTO JOB(name, starttime, durationinminutes, numoffiles, state, poolid, pathspecid, level)
+	VALUES ($1, $2, 0, 0, $3, $4, $5, $6) RETURNING id`
+	row := db.queryRow(query, name, startTime, States.Complete, poolID, pathspec, level)
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, errors.New(err.Error() + "; error while adding a complete Job")
+	}
+	return id, nil
+}
+
+/**
+Description:
+	This method is used to find the entry of a file at a specific position on tape
+Parameter:
+	name: The absolute hdfs path of the file
+	tapeID: The tape the file is on
+	fileMarkNum: The file mark number where the file is on the tape
+Return:
+	*File: The file entry, nil if the file isn't in the catalog
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetFileOnTape(name string, tapeID int, fileMarkNum int) (*File, error) {
+	query := "SELECT " + fileColumns + " FROM File WHERE name=$1 AND tapeid=$2 AND filemarknum=$3"
+	row := db.queryRow(query, name, tapeID, fileMarkNum)
+	var file File
+	err := scanFile(row, &file)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while looking up the file")
+	}
+	return &file, nil
+}
+
 /**
 Description:
 	This method adds a new entry to File Table.
 Parameter:
-	The parameters are the columns of table
+	The parameters are the columns of table; offset is where the tar header of the file starts in its
+	archive, checksum is the hex SHA-256 of its content ("" when it isn't known), and size (-1 when it
+	isn't known) and modTime are what the file had when it was backed up
+Return:
+	int: The id of the new entry
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) AddFile(fileName string, jobID int, tapeID int, fileMarkNum int, offset int64, checksum string, size int64, modTime time.Time) (int, error) {
+	query := `INSERT INTO File (name, jobid, filemarknum, tapeid, taroffset, checksum, size, modtime)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	row := db.queryRow(query, fileName, jobID, fileMarkNum, tapeID, offset,
+		sql.NullString{String: checksum, Valid: checksum != ""}, sql.NullInt64{Int64: size, Valid: size >= 0},
+		pq.NullTime{Time: modTime.In(time.UTC), Valid: !modTime.IsZero()})
+	var id int
+	if err := row.Scan(&id); err != nil {
+		return -1, errors.New(err.Error() + "; error while adding a File")
+	}
+	return id, nil
+}
+
+/**
+Description:
+	This method records that a file continues on another tape, after the segments already recorded
+Parameter:
+	fileID: The id of the file entry
+	segment: The position of the continuation on tape
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) AddFileSegment(fileID int, segment FileSegment) error {
+	return db.inTransaction(func(tx *txConn) error {
+		query := "INSERT INTO FileSegment (fileid, tapeid, filemarknum, taroffset, fileoffset) VALUES ($1, $2, $3, $4, $5)"
+		_, err := tx.exec(query, fileID, segment.TapeID, segment.FileMarkNum, segment.Offset, segment.FileOffset)
+		if err != nil {
+			return errors.New(err.Error() + "; error while adding a FileSegment")
+		}
+		if _, err := tx.exec("UPDATE File SET segments=segments+1 WHERE id=$1", fileID); err != nil {
+			return errors.New(err.Error() + "; error while counting the segments of the file")
+		}
+		return nil
+	})
+}
+
+/**
+Description:
+	This method is used to get the segments continuing a file on other tapes
+Parameter:
+	fileID: The id of the file entry
+Return:
+	[]FileSegment: The segments, in the order of their content in the file
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetFileSegments(fileID int) ([]FileSegment, error) {
+	query := "SELECT tapeid, filemarknum, taroffset, fileoffset FROM FileSegment WHERE fileid=$1 ORDER BY fileoffset"
+	rows, err := db.query(query, fileID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering the segments of the file")
+	}
+	defer rows.Close()
+	var segments []FileSegment
+	for rows.Next() {
+		var segment FileSegment
+		err := rows.Scan(&segment.TapeID, &segment.FileMarkNum, &segment.Offset, &segment.FileOffset)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		segments = append(segments, segment)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return segments, nil
+}
+
+/**
+Description:
+	This method is used to get the files written by a job
+Parameter:
+	jobID: The id of the job
+Return:
+	[]File: The files, in the order they were written
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetFilesOfJob(jobID int) ([]File, error) {
+	query := "SELECT " + fileColumns + " FROM File WHERE jobid=$1 ORDER BY id"
+	rows, err := db.query(query, jobID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering the files of the job")
+	}
+	defer rows.Close()
+	var files []File
+	for rows.Next() {
+		var file File
+		err := scanFile(rows, &file)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return files, nil
+}
+
+/**
+Description:
+	This method removes the entry of a file that didn't make it to tape
+Parameter:
+	ID: The id of the file entry
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) DeleteFile(ID int) error {
+	return db.inTransaction(func(tx *txConn) error {
+		if _, err := tx.exec("DELETE FROM FileSegment WHERE fileid=$1", ID); err != nil {
+			return errors.New(err.Error() + "; error while removing the segments of a File")
+		}
+		if _, err := tx.exec("DELETE FROM File WHERE id=$1", ID); err != nil {
+			return errors.New(err.Error() + "; error while removing a File")
+		}
+		return nil
+	})
+}
+
+/**
+Description:
+	This method is used to find the most recent copy of a file on tape, written by a Complete job
+Parameter:
+	name: The absolute hdfs path of the file
+	poolID: The pool whose copy is wanted, or "" for a copy from any pool
+Return:
+	*File: The file entry of the latest copy, nil if the file was never backed up
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetLatestFile(name string, poolID string) (*File, error) {
+	query := "SELECT " + fileColumns + ` FROM File
+	JOIN Job ON Job.id = File.jobid WHERE File.name=$1 AND ($2 = '' OR CAST(Job.poolid AS varchar) = $2)
+	AND Job.state=$3 ORDER BY Job.starttime DESC, File.id DESC`
+	row := db.queryRow(query, name, poolID, States.Complete)
+	var file File
+	err := scanFile(row, &file)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while looking up the file")
+	}
+	return &file, nil
+}
+
+/**
+Description:
+	This method records the files a directory had when a job listed it, whether they were backed up by
+	the job or not, so that the files deleted since are known. The listing of a job that is run again
+	replaces its previous one
+Parameter:
+	jobID: The id of the job
+	entries: The files of the directory
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) SetJobListing(jobID int, entries []ListingEntry) error {
+	return db.inTransaction(func(tx *txConn) error {
+		if _, err := tx.exec("DELETE FROM JobListing WHERE jobid=$1", jobID); err != nil {
+			return errors.New(err.Error() + "; couldn't remove the previous listing of the job")
+		}
+		query := "INSERT INTO JobListing (jobid, name, size, modtime) VALUES ($1, $2, $3, $4)"
+		for _, entry := range entries {
+			if _, err := tx.exec(query, jobID, entry.Name, entry.Size, entry.ModTime); err != nil {
+				return errors.New(err.Error() + "; couldn't record the listing of the job")
+			}
+		}
+		if _, err := tx.exec("UPDATE Job SET listed=true WHERE id=$1", jobID); err != nil {
+			return errors.New(err.Error() + "; couldn't record the listing of the job")
+		}
+		return nil
+	})
+}
+
+/**
+Description:
+	This method returns the files a directory had when a job listed it
+Parameter:
+	jobID: The id of the job
+Return:
+	[]ListingEntry: The files, ordered by name
+	bool: false if the job has no listing, because it ran before listings were recorded
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetJobListing(jobID int) ([]ListingEntry, bool, error) {
+	var listed bool
+	if err := db.queryRow("SELECT listed FROM Job WHERE id=$1", jobID).Scan(&listed); err != nil {
+		return nil, false, errors.New(err.Error() + "; couldn't find the job")
+	}
+	if !listed {
+		return nil, false, nil
+	}
+
+	rows, err := db.query("SELECT name, size, modtime FROM JobListing WHERE jobid=$1 ORDER BY name", jobID)
+	if err != nil {
+		return nil, false, errors.New(err.Error() + "; error while quering the listing of the job")
+	}
+	defer rows.Close()
+	var entries []ListingEntry
+	for rows.Next() {
+		var entry ListingEntry
+		if err := rows.Scan(&entry.Name, &entry.Size, &entry.ModTime); err != nil {
+			return nil, false, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return entries, true, nil
+}
+
+/**
+Description:
+	This method is used to find the version of every file of a Job (directory) as it was at a point in time,
+	which is the newest copy written by a job that was Complete at that time: a job still running then, or
+	resumed after it, wrote files that were newer than that time. Jobs completed before their end time was
+	recorded count from their start. The chain of
+	jobs restored starts at the latest full job of that time: files only found in older jobs had been
+	deleted by the time of the full job, and aren't restored. When the latest job of that time listed the
+	directory, only the files of its listing are returned, so that files deleted since any backup aren't
+	restored either
+Parameter:
+	jobName: The absolute hdfs path of the directory
+	poolID: The pool whose copies are wanted, or "" for copies from any pool
+	asOf: The point in time being restored
+Return:
+	[]File: One entry per file, ordered by name
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetFilesAsOf(jobName string, poolID string, asOf time.Time) ([]File, error) {
+	lastJobQuery := `SELECT id, listed FROM Job WHERE name=$1 AND ($2 = '' OR CAST(poolid AS varchar) = $2)
+	AND state=$3 AND COALESCE(endtime, starttime) <= $4 ORDER BY starttime DESC, id DESC LIMIT 1`
+	var lastJobID int
+	var listed bool
+	err := db.queryRow(lastJobQuery, jobName, poolID, States.Complete, asOf).Scan(&lastJobID, &listed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while looking up the latest job")
+	}
+
+	query := "SELECT " + fileColumns + ` FROM File
+	JOIN Job ON Job.id = File.jobid WHERE Job.name=$1 AND ($2 = '' OR CAST(Job.poolid AS varchar) = $2)
+	AND Job.state=$3 AND COALESCE(Job.endtime, Job.starttime) <= $4 AND NOT EXISTS (SELECT 1 FROM Job AS FullJob
+		WHERE FullJob.name=$1 AND ($2 = '' OR CAST(FullJob.poolid AS varchar) = $2) AND FullJob.state=$3
+		AND FullJob.level=$5 AND COALESCE(FullJob.endtime, FullJob.starttime) <= $4 AND FullJob.starttime > Job.starttime)`
+	args := []interface{}{jobName, poolID, States.Complete, asOf, Levels.Full}
+	if listed {
+		query += " AND File.name IN (SELECT name FROM JobListing WHERE jobid=$6)"
+		args = append(args, lastJobID)
+	}
+	query += " ORDER BY File.name, Job.starttime DESC, File.id DESC"
+	rows, err := db.query(query, args...)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering the files of the job")
+	}
+	defer rows.Close()
+	var files []File
+	for rows.Next() {
+		var file File
+		err := scanFile(rows, &file)
+		if err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		// Rows are ordered newest first within a name, so only the first row of a name is kept
+		if len(files) > 0 && files[len(files)-1].Name == file.Name {
+			continue
+		}
+		files = append(files, file)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return files, nil
+}
+
+/**
+Description:
+	This method is used to get a tape entry by its id
+Parameter:
+	ID: The id of the tape
+Return:
+	*Tape: The tape entry
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) GetTape(ID int) (*Tape, error) {
+	query := "SELECT " + tapeColumns + " FROM Tape WHERE id=$1"
+	row := db.queryRow(query, ID)
+	var tape Tape
+	err := scanTape(row, &tape)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't find tape with given id")
+	}
+	return &tape, nil
+}
+
+/**
+Description:
+	This method is used to add a newly labeled tape to the Tape table
+Parameter:
+	name: The name of the tape, which is its barcode
+	poolID: The pool the tape belongs to
+	slotNum: The slot where the tape resides
 Return:
 	error: any error occured while execution, or nil
 */
-func (db *DBConn) AddFile(fileName string, jobID int, tapeID int, fileMarkNum int) error {
-	query := "INSERT INTO File VALUES(DEFAULT, $1, $2, $3, $4)"
-	_, err := db.DBSql.Exec(query, fileName, jobID, fileMarkNum, tapeID)
+func (db *DBConn) AddTape(name string, poolID int, slotNum int) error {
+	query := "INSERT INTO Tape (name, poolid, slotnumber, isfull, errorintape) VALUES ($1, $2, $3, false, false)"
+	_, err := db.exec(query, name, poolID, slotNum)
 	if err != nil {
-		return errors.New(err.Error() + "; error while adding a File")
+		return errors.New(err.Error() + "; couldn't add the tape")
 	}
 	return nil
 }
 
+/**
+Description:
+	This method is used to update a tape that was labeled again: it moves to the new pool, and being
+	erased it is no longer full nor in error. What was on the tape is gone, so the File, FileSegment and
+	JobTapeMap entries of the tape are removed in the same transaction; a file continued on the tape from
+	another one can't be restored either, and is removed with all its segments
+Parameter:
+	ID: The id of the tape
+	poolID: The pool the tape now belongs to
+	slotNum: The slot where the tape resides
+Return:
+	error: any error occured while execution, or nil
+*/
+func (db *DBConn) RelabelTape(ID int, poolID int, slotNum int) error {
+	return db.inTransaction(func(tx *txConn) error {
+		rows, err := tx.query("SELECT DISTINCT fileid FROM FileSegment WHERE tapeid=$1", ID)
+		if err != nil {
+			return errors.New(err.Error() + "; error while looking up the files continued on the tape")
+		}
+		var continued []int
+		for rows.Next() {
+			var fileID int
+			if err := rows.Scan(&fileID); err != nil {
+				rows.Close()
+				return errors.New(err.Error() + "; error while scanning the result set")
+			}
+			continued = append(continued, fileID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return errors.New(err.Error() + "; error while iterating the result set")
+		}
+		for _, fileID := range continued {
+			if _, err := tx.exec("DELETE FROM FileSegment WHERE fileid=$1", fileID); err != nil {
+				return errors.New(err.Error() + "; error while removing the segments of a File")
+			}
+			if _, err := tx.exec("DELETE FROM File WHERE id=$1", fileID); err != nil {
+				return errors.New(err.Error() + "; error while removing a File")
+			}
+		}
+
+		query := "DELETE FROM FileSegment WHERE fileid IN (SELECT id FROM File WHERE tapeid=$1)"
+		if _, err := tx.exec(query, ID); err != nil {
+			return errors.New(err.Error() + "; error while removing the segments of the files of the tape")
+		}
+		if _, err := tx.exec("DELETE FROM File WHERE tapeid=$1", ID); err != nil {
+			return errors.New(err.Error() + "; error while removing the files of the tape")
+		}
+		if _, err := tx.exec("DELETE FROM JobTapeMap WHERE tapeid=$1", ID); err != nil {
+			return errors.New(err.Error() + "; error while removing the JobTapeMap entries of the tape")
+		}
+
+		query = `UPDATE Tape SET poolid=$1, slotnumber=$2, isfull=false, errorintape=false, invalidfilemark=NULL,
+		invalidoffset=NULL WHERE id=$3`
+		if _, err := tx.exec(query, poolID, slotNum, ID); err != nil {
+			return errors.New(err.Error() + "; couldn't update the relabeled tape")
+		}
+		return nil
+	})
+}
+
 /**
 Description:
 	This function is used to get the tape from the pool that is for different location,
@@ -425,7 +1350,7 @@ Return:
 */
 func (db *DBConn) GetPair(poolID string) (string, error) {
 	query := "SELECT name FROM Tape WHERE poolid=$1 ORDER BY name"
-	row := db.DBSql.QueryRow(query, poolID)
+	row := db.queryRow(query, poolID)
 	var poolName string
 	err := row.Scan(&poolName)
 	if err != nil {
@@ -434,7 +1359,7 @@ func (db *DBConn) GetPair(poolID string) (string, error) {
 	// Getting the string eg ST_000L7 (3rd slot represents the location)
 	pairPoolName := poolName[:2] + "_" + poolName[3:]
 	query = "SELECT poolid From Tape WHERE poolID<>$1 AND name LIKE $2 ORDER BY name"
-	row = db.DBSql.QueryRow(query, poolID, pairPoolName)
+	row = db.queryRow(query, poolID, pairPoolName)
 	var pairPoolID int
 	err = row.Scan(&pairPoolID)
 	if err != nil {
@@ -444,32 +1369,95 @@ func (db *DBConn) GetPair(poolID string) (string, error) {
 }
 
 /**
-Description: This method is used to connect to the pg server
+Description: This method is used to connect to the catalog DB, and makes sure the schema is up to date
 */
 func New() (*DBConn, error) {
-	bytesRead, err := ioutil.ReadFile("dbAuthen.txt")
+	db, err := Connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := db.CheckSchema(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+/**
+Description: This method is used to connect to the catalog DB with ConnOptions, without checking the schema
+*/
+func Connect() (*DBConn, error) {
+	return ConnectWith(ConnOptions)
+}
+
+/**
+Description:
+	This method is used to connect to the catalog DB, without checking the schema. The pg server is pinged,
+	so that a wrong address or password fails here rather than at the first query
+Parameter:
+	options: How to connect to the DB
+Return:
+	*DBConn: The connection
+	error if any
+*/
+func ConnectWith(options Options) (*DBConn, error) {
+	if options.Driver == DriverSQLite {
+		db, err := openSQLite(options)
+		if err != nil {
+			return nil, err
+		}
+		return &DBConn{
+			DBSql:  db,
+			driver: DriverSQLite,
+		}, nil
+	}
+	if options.Driver != "" && options.Driver != DriverPostgres {
+		return nil, errors.New("Unknown database driver " + options.Driver)
+	}
+
+	connStr, err := options.connectionString()
 	if err != nil {
 		return nil, err
 	}
-	auth := string(bytesRead)
-	autharr := strings.Split(auth, " ")
-	connStr := "user=" + autharr[0] + " password=" + autharr[1] + " dbname=" + autharr[2]
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		return nil, err
+		return nil, errors.New(err.Error() + "; invalid connection settings " + redact(connStr))
+	}
+	db.SetMaxOpenConns(options.MaxOpenConns)
+	db.SetMaxIdleConns(options.MaxIdleConns)
+	db.SetConnMaxLifetime(options.ConnMaxLifetime)
+
+	ctx := context.Background()
+	if options.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ConnectTimeout)
+		defer cancel()
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, errors.New(err.Error() + "; couldn't connect to the database with " + redact(connStr))
 	}
 
 	return &DBConn{
-		DBSql: db,
+		DBSql:  db,
+		driver: DriverPostgres,
 	}, nil
 }
 
 /**
 Description:
-	This method is used to close the connection to the pg server
+	This method is used to close the connection to the catalog DB
 */
 func (db *DBConn) Close() {
 	db.DBSql.Close()
 }
+
+/**
+Description:
+	This method returns the driver the catalog is kept with, DriverPostgres or DriverSQLite
+*/
+func (db *DBConn) Driver() string {
+	return db.driver
+}
@@ -0,0 +1,905 @@
+// Package memdb is an in-memory implementation of pgdb.Catalog with the same semantics as the Postgres
+// catalog, so that the backup and restore logic can run without a database, eg in unit tests.
+package memdb
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/testusr/BackUpTest/db"
+)
+
+// neverRan is the time GetLastExec returns for a job that never completed
+var neverRan = time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// tape is a row of the Tape table
+type tape struct {
+	pgdb.Tape
+	ErrorReason string
+}
+
+// pool is a row of the Pool table
+type pool struct {
+	ID        int
+	Name      string
+	StorageID int
+}
+
+// pathSpec is a row of the PathSpec table
+type pathSpec struct {
+	ID        int
+	Name      string
+	Schedule  string
+	Recursive bool
+}
+
+// jobTapeMap is a row of the JobTapeMap table
+type jobTapeMap struct {
+	Name   string
+	JobID  int
+	TapeID int
+}
+
+// Catalog holds the tables in memory. The zero value isn't usable; use New
+type Catalog struct {
+	mutex sync.Mutex
+	// lastID is the last id given out, per table, like the Serial columns
+	lastID      map[string]int
+	jobs        []pgdb.Job
+	files       []pgdb.File
+	tapes       []tape
+	pools       []pool
+	storages    []pgdb.Storage
+	pathSpecs   []pathSpec
+	jobTapeMaps []jobTapeMap
+	// listings are the listings of the jobs, a job without one isn't listed
+	listings map[int][]pgdb.ListingEntry
+	// segments are the FileSegment rows, by file id
+	segments map[int][]pgdb.FileSegment
+}
+
+var _ pgdb.Catalog = (*Catalog)(nil)
+
+// New returns an empty catalog
+func New() *Catalog {
+	return &Catalog{
+		lastID:   make(map[string]int),
+		listings: make(map[int][]pgdb.ListingEntry),
+		segments: make(map[int][]pgdb.FileSegment),
+	}
+}
+
+func (catalog *Catalog) nextID(table string) int {
+	catalog.lastID[table]++
+	return catalog.lastID[table]
+}
+
+func parsePoolID(poolID string) (int, error) {
+	id, err := strconv.Atoi(poolID)
+	if err != nil {
+		return -1, errors.New("invalid input syntax for integer: \"" + poolID + "\"")
+	}
+	return id, nil
+}
+
+// AddStorage adds a drive to the Storage table, with no tape loaded, and returns its id. The Storage and
+// Pool tables are filled by hand in Postgres, so they have no method in pgdb.Catalog
+func (catalog *Catalog) AddStorage(name string, driveNumber int) int {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id := catalog.nextID("storage")
+	catalog.storages = append(catalog.storages, pgdb.Storage{ID: id, Name: name, TapeID: -1, DriveNumber: driveNumber})
+	return id
+}
+
+// AddPool adds a pool written with the drive storageID to the Pool table, and returns its id
+func (catalog *Catalog) AddPool(name string, storageID int) int {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id := catalog.nextID("pool")
+	catalog.pools = append(catalog.pools, pool{ID: id, Name: name, StorageID: storageID})
+	return id
+}
+
+// Jobs returns a copy of the Job table, ordered by id
+func (catalog *Catalog) Jobs() []pgdb.Job {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	return append([]pgdb.Job(nil), catalog.jobs...)
+}
+
+// Files returns a copy of the File table, ordered by id
+func (catalog *Catalog) Files() []pgdb.File {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	return append([]pgdb.File(nil), catalog.files...)
+}
+
+// TapeErrorReason returns the error reason recorded for a tape
+func (catalog *Catalog) TapeErrorReason(ID int) string {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tape := catalog.tape(ID); tape != nil {
+		return tape.ErrorReason
+	}
+	return ""
+}
+
+func (catalog *Catalog) AddJob(name string, poolID string, pathspecid int, level string) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return errors.New(err.Error() + "; error while adding a Job")
+	}
+	catalog.jobs = append(catalog.jobs, pgdb.Job{
+		ID:         catalog.nextID("job"),
+		Name:       name,
+		State:      pgdb.States.Initialized,
+		PoolID:     id,
+		PathSpecID: pathspecid,
+		Level:      level,
+	})
+	return nil
+}
+
+func (catalog *Catalog) AddCompleteJob(name string, poolID int, pathspecid int, startTime time.Time, level string) (int, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	job := pgdb.Job{
+		ID:        catalog.nextID("job"),
+		Name:      name,
+		StartTime: pq.NullTime{Time: startTime, Valid: true},
+		State:     pgdb.States.Complete,
+		PoolID:    poolID,
+		// -1 stands for NULL, like the Postgres catalog
+		PathSpecID: pathspecid,
+		Level:      level,
+	}
+	job.DurationInMinutes.Valid = true
+	job.NumOfFiles.Valid = true
+	catalog.jobs = append(catalog.jobs, job)
+	return job.ID, nil
+}
+
+func (catalog *Catalog) GetAJob(poolID string, startTime time.Time) (*pgdb.Job, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering for job")
+	}
+	for i := range catalog.jobs {
+		job := &catalog.jobs[i]
+		if job.State != pgdb.States.Initialized || job.PoolID != id {
+			continue
+		}
+		// The job is returned as it was selected, before it was updated
+		selected := *job
+		if job.StartTime.Valid {
+			// A resumed job keeps the start time of its first run
+			startTime = job.StartTime.Time
+		}
+		catalog.updateJob(job, startTime, 0, 0, pgdb.States.InProgress)
+		return &selected, nil
+	}
+	return nil, nil
+}
+
+func (catalog *Catalog) updateJob(job *pgdb.Job, startTime time.Time, duration time.Duration, numOfFiles int, state string) {
+	job.StartTime = pq.NullTime{Time: startTime, Valid: true}
+	job.DurationInMinutes.Int64, job.DurationInMinutes.Valid = int64(duration.Minutes()), true
+	job.NumOfFiles.Int64, job.NumOfFiles.Valid = int64(numOfFiles), true
+	job.State = state
+}
+
+func (catalog *Catalog) CheckJobExists(name string, poolID string) (bool, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return true, errors.New(err.Error() + "; error while checking if job exists")
+	}
+	for _, job := range catalog.jobs {
+		if job.Name == name && job.PoolID == id &&
+			(job.State == pgdb.States.Initialized || job.State == pgdb.States.InProgress) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (catalog *Catalog) UpdateJob(id int, name string, startTime time.Time, duration time.Duration, numOfFiles int, state string, poolID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for i := range catalog.jobs {
+		job := &catalog.jobs[i]
+		if job.ID == id && job.Name == name && job.PoolID == poolID {
+			catalog.updateJob(job, startTime, duration, numOfFiles, state)
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) SetJobEndTime(ID int, endTime time.Time) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if job := catalog.job(ID); job != nil {
+		job.EndTime = pq.NullTime{Time: endTime, Valid: true}
+	}
+	return nil
+}
+
+func (catalog *Catalog) GetJobsByState(poolID string, state string) ([]pgdb.Job, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while quering the jobs")
+	}
+	var jobs []pgdb.Job
+	for _, job := range catalog.jobs {
+		if job.PoolID == id && job.State == state {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+func (catalog *Catalog) RequeueJob(ID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	job := catalog.job(ID)
+	if job == nil || job.State != pgdb.States.InProgress {
+		return nil
+	}
+	maps := catalog.jobTapeMaps[:0]
+	for _, jobTapeMap := range catalog.jobTapeMaps {
+		if jobTapeMap.JobID != ID {
+			maps = append(maps, jobTapeMap)
+		}
+	}
+	catalog.jobTapeMaps = maps
+	job.StartTime = pq.NullTime{}
+	job.DurationInMinutes.Int64, job.DurationInMinutes.Valid = 0, false
+	job.NumOfFiles.Int64, job.NumOfFiles.Valid = 0, false
+	job.State = pgdb.States.Initialized
+	return nil
+}
+
+func (catalog *Catalog) GetResumableJob(name string, poolID string, level string) (*pgdb.Job, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; error while looking for a resumable job")
+	}
+	var resumable *pgdb.Job
+	for i := range catalog.jobs {
+		job := catalog.jobs[i]
+		if job.Name != name || job.PoolID != id {
+			continue
+		}
+		switch {
+		case job.State == pgdb.States.Complete || job.Level != level:
+			resumable = nil
+		case job.State == pgdb.States.InComplete || job.State == pgdb.States.Interrupted:
+			resumable = &job
+		}
+	}
+	return resumable, nil
+}
+
+func (catalog *Catalog) ResumeJob(ID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if job := catalog.job(ID); job != nil &&
+		(job.State == pgdb.States.InComplete || job.State == pgdb.States.Interrupted) {
+		job.State = pgdb.States.Initialized
+	}
+	return nil
+}
+
+func (catalog *Catalog) InterruptCloseJob(poolID string) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return errors.New(err.Error() + "; error while updating job table with interrupt close")
+	}
+	for i := range catalog.jobs {
+		if catalog.jobs[i].PoolID == id && catalog.jobs[i].State == pgdb.States.InProgress {
+			catalog.jobs[i].State = pgdb.States.Interrupted
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) GetLastExec(path string, poolID string, level string) (time.Time, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return neverRan, errors.New(err.Error() + "; error quering the list of job with specific name")
+	}
+	if level == pgdb.Levels.Full {
+		return neverRan, nil
+	}
+	last := neverRan
+	found := false
+	for _, job := range catalog.jobs {
+		if job.Name != path || job.PoolID != id || job.State != pgdb.States.Complete || !job.StartTime.Valid {
+			continue
+		}
+		// A differential job is based on the last full job, an incremental one on the last job
+		if level == pgdb.Levels.Differential && job.Level != pgdb.Levels.Full {
+			continue
+		}
+		if !found || job.StartTime.Time.After(last) {
+			last = job.StartTime.Time
+			found = true
+		}
+	}
+	return last, nil
+}
+
+func (catalog *Catalog) AddJobTapeMap(jobName string, jobID int, tapeID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if catalog.job(jobID) == nil || catalog.tape(tapeID) == nil {
+		return errors.New("violates foreign key constraint; error while adding entry to jobtapemap table")
+	}
+	catalog.jobTapeMaps = append(catalog.jobTapeMaps, jobTapeMap{Name: jobName, JobID: jobID, TapeID: tapeID})
+	return nil
+}
+
+func (catalog *Catalog) job(ID int) *pgdb.Job {
+	for i := range catalog.jobs {
+		if catalog.jobs[i].ID == ID {
+			return &catalog.jobs[i]
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) AddFile(fileName string, jobID int, tapeID int, fileMarkNum int, offset int64, checksum string, size int64, modTime time.Time) (int, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if catalog.job(jobID) == nil || catalog.tape(tapeID) == nil {
+		return -1, errors.New("violates foreign key constraint; error while adding a File")
+	}
+	id := catalog.nextID("file")
+	catalog.files = append(catalog.files, pgdb.File{
+		ID:          id,
+		Name:        fileName,
+		JobID:       jobID,
+		FileMarkNum: fileMarkNum,
+		TapeID:      tapeID,
+		Offset:      offset,
+		Checksum:    checksum,
+		Size:        size,
+		ModTime:     pq.NullTime{Time: modTime.In(time.UTC), Valid: !modTime.IsZero()},
+	})
+	return id, nil
+}
+
+func (catalog *Catalog) AddFileSegment(fileID int, segment pgdb.FileSegment) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if catalog.tape(segment.TapeID) == nil {
+		return errors.New("violates foreign key constraint; error while adding a FileSegment")
+	}
+	for i := range catalog.files {
+		if catalog.files[i].ID == fileID {
+			catalog.files[i].Segments++
+			catalog.segments[fileID] = append(catalog.segments[fileID], segment)
+			return nil
+		}
+	}
+	return errors.New("violates foreign key constraint; error while adding a FileSegment")
+}
+
+func (catalog *Catalog) GetFileSegments(fileID int) ([]pgdb.FileSegment, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	segments := append([]pgdb.FileSegment{}, catalog.segments[fileID]...)
+	sort.Slice(segments, func(i, j int) bool { return segments[i].FileOffset < segments[j].FileOffset })
+	return segments, nil
+}
+
+func (catalog *Catalog) GetFileOnTape(name string, tapeID int, fileMarkNum int) (*pgdb.File, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, file := range catalog.files {
+		if file.Name == name && file.TapeID == tapeID && file.FileMarkNum == fileMarkNum {
+			return &file, nil
+		}
+	}
+	return nil, nil
+}
+
+func (catalog *Catalog) GetFilesOfJob(jobID int) ([]pgdb.File, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	var files []pgdb.File
+	for _, file := range catalog.files {
+		if file.JobID == jobID {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (catalog *Catalog) DeleteFile(ID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for i, file := range catalog.files {
+		if file.ID == ID {
+			catalog.files = append(catalog.files[:i], catalog.files[i+1:]...)
+			delete(catalog.segments, ID)
+			break
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) SetJobListing(jobID int, entries []pgdb.ListingEntry) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	catalog.listings[jobID] = append([]pgdb.ListingEntry{}, entries...)
+	return nil
+}
+
+func (catalog *Catalog) GetJobListing(jobID int) ([]pgdb.ListingEntry, bool, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if catalog.job(jobID) == nil {
+		return nil, false, errors.New("couldn't find the job")
+	}
+	entries, listed := catalog.listings[jobID]
+	if !listed {
+		return nil, false, nil
+	}
+	entries = append([]pgdb.ListingEntry{}, entries...)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, true, nil
+}
+
+// newerCopy reports whether file a, written by job jobA, sorts before file b in "ORDER BY Job.starttime
+// DESC, File.id DESC", where Postgres puts NULL start times first
+func newerCopy(a pgdb.File, jobA *pgdb.Job, b pgdb.File, jobB *pgdb.Job) bool {
+	if jobA.StartTime.Valid != jobB.StartTime.Valid {
+		return !jobA.StartTime.Valid
+	}
+	if jobA.StartTime.Valid && !jobA.StartTime.Time.Equal(jobB.StartTime.Time) {
+		return jobA.StartTime.Time.After(jobB.StartTime.Time)
+	}
+	return a.ID > b.ID
+}
+
+// inPool reports whether a job belongs to the pool, where "" stands for any pool
+func inPool(job *pgdb.Job, poolID string) bool {
+	return poolID == "" || strconv.Itoa(job.PoolID) == poolID
+}
+
+func (catalog *Catalog) GetLatestFile(name string, poolID string) (*pgdb.File, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	var latest *pgdb.File
+	var latestJob *pgdb.Job
+	for i := range catalog.files {
+		file := catalog.files[i]
+		job := catalog.job(file.JobID)
+		if file.Name != name || !inPool(job, poolID) || job.State != pgdb.States.Complete {
+			continue
+		}
+		if latest == nil || newerCopy(file, job, *latest, latestJob) {
+			latest, latestJob = &file, job
+		}
+	}
+	return latest, nil
+}
+
+func (catalog *Catalog) GetFilesAsOf(jobName string, poolID string, asOf time.Time) ([]pgdb.File, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	// A job counts from its end, or from its start when its end wasn't recorded, like COALESCE does
+	restored := func(job *pgdb.Job) bool {
+		end := job.EndTime
+		if !end.Valid {
+			end = job.StartTime
+		}
+		return job.Name == jobName && inPool(job, poolID) && job.State == pgdb.States.Complete &&
+			end.Valid && !end.Time.After(asOf)
+	}
+
+	// The chain starts at the latest full job of that time, and the latest job tells which files existed
+	var chainStart time.Time
+	var lastJob *pgdb.Job
+	for i := range catalog.jobs {
+		job := &catalog.jobs[i]
+		if !restored(job) {
+			continue
+		}
+		if job.Level == pgdb.Levels.Full && job.StartTime.Time.After(chainStart) {
+			chainStart = job.StartTime.Time
+		}
+		if lastJob == nil || job.StartTime.Time.After(lastJob.StartTime.Time) ||
+			(job.StartTime.Time.Equal(lastJob.StartTime.Time) && job.ID > lastJob.ID) {
+			lastJob = job
+		}
+	}
+	var existing map[string]bool
+	if lastJob != nil {
+		if entries, listed := catalog.listings[lastJob.ID]; listed {
+			existing = make(map[string]bool)
+			for _, entry := range entries {
+				existing[entry.Name] = true
+			}
+		}
+	}
+
+	newest := make(map[string]pgdb.File)
+	for _, file := range catalog.files {
+		job := catalog.job(file.JobID)
+		if !restored(job) || job.StartTime.Time.Before(chainStart) || (existing != nil && !existing[file.Name]) {
+			continue
+		}
+		current, found := newest[file.Name]
+		if !found || newerCopy(file, job, current, catalog.job(current.JobID)) {
+			newest[file.Name] = file
+		}
+	}
+
+	var files []pgdb.File
+	for _, file := range newest {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (catalog *Catalog) tape(ID int) *tape {
+	for i := range catalog.tapes {
+		if catalog.tapes[i].ID == ID {
+			return &catalog.tapes[i]
+		}
+	}
+	return nil
+}
+
+// sortedTapes returns the tapes that match, ordered by name
+func (catalog *Catalog) sortedTapes(match func(tape *tape) bool) []pgdb.Tape {
+	var tapes []pgdb.Tape
+	for i := range catalog.tapes {
+		if match(&catalog.tapes[i]) {
+			tapes = append(tapes, catalog.tapes[i].Tape)
+		}
+	}
+	sort.SliceStable(tapes, func(i, j int) bool { return tapes[i].Name < tapes[j].Name })
+	return tapes
+}
+
+func (catalog *Catalog) AddTape(name string, poolID int, slotNum int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	catalog.tapes = append(catalog.tapes, tape{Tape: pgdb.Tape{
+		ID:              catalog.nextID("tape"),
+		Name:            name,
+		PoolID:          poolID,
+		SlotNumber:      slotNum,
+		InvalidFileMark: -1,
+		InvalidOffset:   -1,
+	}})
+	return nil
+}
+
+func (catalog *Catalog) RelabelTape(ID int, poolID int, slotNum int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	files := catalog.files[:0]
+	for _, file := range catalog.files {
+		onTape := file.TapeID == ID
+		for _, segment := range catalog.segments[file.ID] {
+			onTape = onTape || segment.TapeID == ID
+		}
+		if onTape {
+			delete(catalog.segments, file.ID)
+			continue
+		}
+		files = append(files, file)
+	}
+	catalog.files = files
+	maps := catalog.jobTapeMaps[:0]
+	for _, jobTapeMap := range catalog.jobTapeMaps {
+		if jobTapeMap.TapeID != ID {
+			maps = append(maps, jobTapeMap)
+		}
+	}
+	catalog.jobTapeMaps = maps
+
+	if tape := catalog.tape(ID); tape != nil {
+		tape.PoolID = poolID
+		tape.SlotNumber = slotNum
+		tape.IsFull = false
+		tape.ErrorInTape = false
+		tape.InvalidFileMark = -1
+		tape.InvalidOffset = -1
+	}
+	return nil
+}
+
+func (catalog *Catalog) GetTape(ID int) (*pgdb.Tape, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	tape := catalog.tape(ID)
+	if tape == nil {
+		return nil, errors.New("sql: no rows in result set; couldn't find tape with given id")
+	}
+	found := tape.Tape
+	return &found, nil
+}
+
+func (catalog *Catalog) GetTapeByName(name string) (*pgdb.Tape, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, tape := range catalog.tapes {
+		if tape.Name == name {
+			found := tape.Tape
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (catalog *Catalog) GetTapes() ([]pgdb.Tape, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	return catalog.sortedTapes(func(tape *tape) bool { return true }), nil
+}
+
+func (catalog *Catalog) GetTapesFromPool(poolID string) ([]pgdb.Tape, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't find next tape from the pool")
+	}
+	return catalog.sortedTapes(func(tape *tape) bool {
+		return tape.PoolID == id && tape.SlotNumber != 0 && !tape.IsFull && !tape.ErrorInTape
+	}), nil
+}
+
+func (catalog *Catalog) UpdateTapeTable(slotNum int, isFull bool, errorinTape bool, ID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tape := catalog.tape(ID); tape != nil {
+		tape.SlotNumber = slotNum
+		tape.IsFull = isFull
+		tape.ErrorInTape = errorinTape
+	}
+	return nil
+}
+
+func (catalog *Catalog) SetInvalidTail(ID int, fileMarkNum int, offset int64) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tape := catalog.tape(ID); tape != nil {
+		tape.InvalidFileMark = fileMarkNum
+		tape.InvalidOffset = offset
+	}
+	return nil
+}
+
+func (catalog *Catalog) UpdateTapeSlot(slotNum int, ID int) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tape := catalog.tape(ID); tape != nil {
+		tape.SlotNumber = slotNum
+	}
+	return nil
+}
+
+func (catalog *Catalog) LoadTape(drivePath string, tapeID int, forWriting bool) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	tape := catalog.tape(tapeID)
+	if tape == nil {
+		return errors.New("violates foreign key constraint; couldn't update storage")
+	}
+	tape.SlotNumber = 0
+	if forWriting {
+		tape.IsFull = false
+		tape.ErrorInTape = false
+	}
+	for i := range catalog.storages {
+		if catalog.storages[i].Name == drivePath {
+			catalog.storages[i].TapeID = tapeID
+		} else if catalog.storages[i].TapeID == tapeID {
+			catalog.storages[i].TapeID = -1
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) UnloadTape(drivePath string, tapeID int, slotNum int, isFull bool) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tape := catalog.tape(tapeID); tape != nil {
+		tape.SlotNumber = slotNum
+		tape.IsFull = tape.IsFull || isFull
+	}
+	for i := range catalog.storages {
+		if catalog.storages[i].Name == drivePath {
+			catalog.storages[i].TapeID = -1
+		}
+	}
+	return nil
+}
+
+// poolStorage returns the drive of a pool
+func (catalog *Catalog) poolStorage(poolID string) *pgdb.Storage {
+	for _, pool := range catalog.pools {
+		if strconv.Itoa(pool.ID) != poolID {
+			continue
+		}
+		for i := range catalog.storages {
+			if catalog.storages[i].ID == pool.StorageID {
+				return &catalog.storages[i]
+			}
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) UpdateErrorInTapeReason(poolID string, reason string) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	storage := catalog.poolStorage(poolID)
+	if storage == nil || storage.TapeID < 0 {
+		return errors.New("sql: no rows in result set; No TapeID with that poolID")
+	}
+	if tape := catalog.tape(storage.TapeID); tape != nil {
+		tape.ErrorInTape = true
+		tape.ErrorReason = reason
+	}
+	return nil
+}
+
+// likePattern reports whether name matches a LIKE pattern whose only wildcard is "_"
+func likePattern(name string, pattern string) bool {
+	if len(name) != len(pattern) {
+		return false
+	}
+	for i := range pattern {
+		if pattern[i] != '_' && pattern[i] != name[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (catalog *Catalog) GetPair(poolID string) (string, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	id, err := parsePoolID(poolID)
+	if err != nil {
+		return "", errors.New(err.Error() + "; error while scanning the result set")
+	}
+	tapes := catalog.sortedTapes(func(tape *tape) bool { return tape.PoolID == id })
+	if len(tapes) == 0 || len(tapes[0].Name) < 3 {
+		return "", errors.New("sql: no rows in result set; error while scanning the result set")
+	}
+	// Getting the string eg ST_000L7 (3rd slot represents the location)
+	poolName := tapes[0].Name
+	pairPoolName := poolName[:2] + "_" + poolName[3:]
+	pairs := catalog.sortedTapes(func(tape *tape) bool {
+		return tape.PoolID != id && likePattern(tape.Name, pairPoolName)
+	})
+	if len(pairs) == 0 {
+		return "", errors.New("sql: no rows in result set; error while scanning the result set")
+	}
+	return strconv.Itoa(pairs[0].PoolID), nil
+}
+
+func (catalog *Catalog) GetStoragePath(poolID string) (string, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	storage := catalog.poolStorage(poolID)
+	if storage == nil {
+		return "", errors.New(`Tape From That Pool Is Not Loaded Or the DB is Not Updated!
+		Please load the Tape and/or update the DB`)
+	}
+	return storage.Name, nil
+}
+
+func (catalog *Catalog) GetStorages() ([]pgdb.Storage, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	storages := append([]pgdb.Storage(nil), catalog.storages...)
+	sort.SliceStable(storages, func(i, j int) bool { return storages[i].DriveNumber < storages[j].DriveNumber })
+	return storages, nil
+}
+
+func (catalog *Catalog) GetTapeInfo(tapePath string) (int, int, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, storage := range catalog.storages {
+		if storage.Name != tapePath {
+			continue
+		}
+		return storage.DriveNumber, storage.TapeID, nil
+	}
+	return -1, -1, errors.New("sql: no rows in result set; couldn't find driveNum with given tapePath")
+}
+
+func (catalog *Catalog) UpdateStorage(tapeID int, name string) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	if tapeID >= 0 && catalog.tape(tapeID) == nil {
+		return errors.New("violates foreign key constraint; couldn't update storage")
+	}
+	for i := range catalog.storages {
+		if catalog.storages[i].Name == name {
+			catalog.storages[i].TapeID = tapeID
+			if tapeID < 0 {
+				catalog.storages[i].TapeID = -1
+			}
+		}
+	}
+	return nil
+}
+
+func (catalog *Catalog) GetPathSpec(path string) (int, string, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, spec := range catalog.pathSpecs {
+		if spec.Name == path {
+			return spec.ID, spec.Schedule, nil
+		}
+	}
+	return -1, "", nil
+}
+
+func (catalog *Catalog) AddPathSpec(path string, schedule string) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, spec := range catalog.pathSpecs {
+		// Like the unique_violation the Postgres catalog ignores
+		if spec.Name == path {
+			return nil
+		}
+	}
+	catalog.pathSpecs = append(catalog.pathSpecs, pathSpec{ID: catalog.nextID("pathspec"), Name: path, Schedule: schedule})
+	return nil
+}
+
+func (catalog *Catalog) IsPathSpecRecursive(ID int) (bool, error) {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for _, spec := range catalog.pathSpecs {
+		if spec.ID == ID {
+			return spec.Recursive, nil
+		}
+	}
+	return false, nil
+}
+
+func (catalog *Catalog) SetPathSpecRecursive(path string, recursive bool) error {
+	catalog.mutex.Lock()
+	defer catalog.mutex.Unlock()
+	for i := range catalog.pathSpecs {
+		if catalog.pathSpecs[i].Name == path {
+			catalog.pathSpecs[i].Recursive = recursive
+			return nil
+		}
+	}
+	return errors.New("There is no pathspec for " + path)
+}
+
+// Close does nothing; the content of the catalog stays available
+func (catalog *Catalog) Close() {}
@@ -0,0 +1,321 @@
+package memdb
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/testusr/BackUpTest/db"
+)
+
+// openSQLite opens a migrated SQLite catalog in a temporary directory with the drives and pools of
+// openMemdb, and returns it with the error reason of a tape and the function that removes it
+func openSQLite(t *testing.T) (pgdb.Catalog, func(ID int) string, func()) {
+	dir, err := ioutil.TempDir("", "memdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, err := pgdb.ConnectWith(pgdb.Options{Driver: pgdb.DriverSQLite, Path: filepath.Join(dir, "catalog.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		catalog.Close()
+		os.RemoveAll(dir)
+	}
+	if _, err := catalog.MigrateUp(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		"INSERT INTO Storage (name, drivenumber) VALUES ('/dev/nst0', 0)",
+		"INSERT INTO Storage (name, drivenumber) VALUES ('/dev/nst1', 1)",
+		"INSERT INTO Pool (name, storageid) VALUES ('onsite', 1)",
+		"INSERT INTO Pool (name, storageid) VALUES ('offsite', 2)",
+	} {
+		if _, err := catalog.DBSql.Exec(statement); err != nil {
+			cleanup()
+			t.Fatal(err)
+		}
+	}
+	errorReason := func(ID int) string {
+		var reason sql.NullString
+		if err := catalog.DBSql.QueryRow("SELECT errorreason FROM Tape WHERE id = ?", ID).Scan(&reason); err != nil {
+			t.Fatal(err)
+		}
+		return reason.String
+	}
+	return catalog, errorReason, cleanup
+}
+
+// openMemdb returns an in-memory catalog with two drives and a pool written with each
+func openMemdb(t *testing.T) (pgdb.Catalog, func(ID int) string, func()) {
+	catalog := New()
+	catalog.AddPool("onsite", catalog.AddStorage("/dev/nst0", 0))
+	catalog.AddPool("offsite", catalog.AddStorage("/dev/nst1", 1))
+	return catalog, catalog.TapeErrorReason, func() {}
+}
+
+// recorder records the results of the calls to a catalog, with the times in UTC so that the results
+// compare whatever the time zone the catalog returns them in
+type recorder struct {
+	lines []string
+}
+
+func utc(t pq.NullTime) pq.NullTime {
+	return pq.NullTime{Time: t.Time.UTC(), Valid: t.Valid}
+}
+
+func (r *recorder) record(call string, result interface{}, err error) {
+	if err != nil {
+		// The messages of the drivers differ, only the failure is compared
+		r.lines = append(r.lines, call+": error")
+		return
+	}
+	switch value := result.(type) {
+	case *pgdb.Job:
+		if value != nil {
+			job := *value
+			job.StartTime, job.EndTime = utc(job.StartTime), utc(job.EndTime)
+			result = job
+		}
+	case []pgdb.Job:
+		jobs := append([]pgdb.Job(nil), value...)
+		for i := range jobs {
+			jobs[i].StartTime, jobs[i].EndTime = utc(jobs[i].StartTime), utc(jobs[i].EndTime)
+		}
+		result = jobs
+	case *pgdb.File:
+		if value != nil {
+			file := *value
+			file.ModTime = utc(file.ModTime)
+			result = file
+		}
+	case []pgdb.File:
+		files := append([]pgdb.File(nil), value...)
+		for i := range files {
+			files[i].ModTime = utc(files[i].ModTime)
+		}
+		result = files
+	case []pgdb.ListingEntry:
+		entries := append([]pgdb.ListingEntry(nil), value...)
+		for i := range entries {
+			entries[i].ModTime = entries[i].ModTime.UTC()
+		}
+		result = entries
+	case time.Time:
+		result = value.UTC()
+	}
+	r.lines = append(r.lines, fmt.Sprintf("%s: %+v", call, result))
+}
+
+// run runs the same backups, restores and tape changes as the backup program against the catalog, and
+// returns the results of every call
+func run(t *testing.T, catalog pgdb.Catalog, errorReason func(ID int) string) []string {
+	r := &recorder{}
+	full, incremental := pgdb.Levels.Full, pgdb.Levels.Incremental
+	firstRun := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	secondRun := firstRun.Add(24 * time.Hour)
+	modTime := firstRun.Add(-time.Hour)
+
+	// Path specs
+	r.record("AddPathSpec /prod", nil, catalog.AddPathSpec("/prod", "nightly"))
+	r.record("AddPathSpec /prod again", nil, catalog.AddPathSpec("/prod", "weekly"))
+	id, schedule, err := catalog.GetPathSpec("/prod")
+	r.record("GetPathSpec /prod", fmt.Sprint(id, schedule), err)
+	id, schedule, err = catalog.GetPathSpec("/missing")
+	r.record("GetPathSpec /missing", fmt.Sprint(id, schedule), err)
+	r.record("SetPathSpecRecursive", nil, catalog.SetPathSpecRecursive("/prod", true))
+	recursive, err := catalog.IsPathSpecRecursive(1)
+	r.record("IsPathSpecRecursive", recursive, err)
+
+	// Tapes and drives
+	r.record("AddTape STA001L7", nil, catalog.AddTape("STA001L7", 1, 1))
+	r.record("AddTape STA002L7", nil, catalog.AddTape("STA002L7", 1, 2))
+	r.record("AddTape STB001L7", nil, catalog.AddTape("STB001L7", 2, 3))
+	r.record("UpdateTapeTable STA001L7", nil, catalog.UpdateTapeTable(1, true, true, 1))
+	r.record("LoadTape STA001L7 for writing", nil, catalog.LoadTape("/dev/nst0", 1, true))
+	tapes, err := catalog.GetTapesFromPool("1")
+	r.record("GetTapesFromPool", tapes, err)
+	tape, err := catalog.GetTapeByName("STA002L7")
+	r.record("GetTapeByName STA002L7", tape, err)
+	tape, err = catalog.GetTapeByName("STA009L7")
+	r.record("GetTapeByName STA009L7", tape, err)
+	tapeID, tapeSlot, err := catalog.GetTapeInfo("/dev/nst0")
+	r.record("GetTapeInfo", fmt.Sprint(tapeID, tapeSlot), err)
+	tapeID, tapeSlot, err = catalog.GetTapeInfo("/dev/nst1")
+	r.record("GetTapeInfo of an empty drive", fmt.Sprint(tapeID, tapeSlot), err)
+	pair, err := catalog.GetPair("1")
+	r.record("GetPair", pair, err)
+	storagePath, err := catalog.GetStoragePath("2")
+	r.record("GetStoragePath", storagePath, err)
+	_, err = catalog.GetStoragePath("x")
+	r.record("GetStoragePath of an invalid pool", nil, err)
+
+	// A full backup
+	r.record("AddJob full", nil, catalog.AddJob("/prod", "1", 1, full))
+	exists, err := catalog.CheckJobExists("/prod", "1")
+	r.record("CheckJobExists", exists, err)
+	exists, err = catalog.CheckJobExists("/prod", "2")
+	r.record("CheckJobExists of the other pool", exists, err)
+	job, err := catalog.GetAJob("1", firstRun)
+	r.record("GetAJob", job, err)
+	if job == nil {
+		t.Fatal("no job to execute")
+	}
+	fullID := job.ID
+	jobs, err := catalog.GetJobsByState("1", pgdb.States.InProgress)
+	r.record("GetJobsByState In-Progress", jobs, err)
+	r.record("AddJobTapeMap", nil, catalog.AddJobTapeMap("/prod", fullID, 1))
+	a, err := catalog.AddFile("/prod/a", fullID, 1, 1, 0, "aa", 10, modTime)
+	r.record("AddFile /prod/a", a, err)
+	b, err := catalog.AddFile("/prod/b", fullID, 1, 1, 1024, "bb", 4096, modTime)
+	r.record("AddFile /prod/b", b, err)
+	r.record("AddFileSegment", nil, catalog.AddFileSegment(b, pgdb.FileSegment{TapeID: 2, FileMarkNum: 1, Offset: 0, FileOffset: 512}))
+	segments, err := catalog.GetFileSegments(b)
+	r.record("GetFileSegments", segments, err)
+	file, err := catalog.GetFileOnTape("/prod/b", 1, 1)
+	r.record("GetFileOnTape", file, err)
+	file, err = catalog.GetFileOnTape("/prod/b", 1, 2)
+	r.record("GetFileOnTape at another file mark", file, err)
+	entries := []pgdb.ListingEntry{{Name: "/prod/a", Size: 10, ModTime: modTime}, {Name: "/prod/b", Size: 4096, ModTime: modTime}}
+	r.record("SetJobListing", nil, catalog.SetJobListing(fullID, entries))
+	listing, listed, err := catalog.GetJobListing(fullID)
+	r.record("GetJobListing", listing, err)
+	r.record("GetJobListing listed", listed, nil)
+	listing, listed, err = catalog.GetJobListing(fullID + 100)
+	r.record("GetJobListing of an unknown job", listing, err)
+	r.record("GetJobListing of an unknown job listed", listed, nil)
+	r.record("UpdateJob full", nil, catalog.UpdateJob(fullID, "/prod", firstRun, 3*time.Minute, 2, pgdb.States.Complete, 1))
+	r.record("SetJobEndTime full", nil, catalog.SetJobEndTime(fullID, firstRun.Add(3*time.Minute)))
+	for _, level := range []string{full, pgdb.Levels.Differential, incremental} {
+		lastExec, err := catalog.GetLastExec("/prod", "1", level)
+		r.record("GetLastExec "+level, lastExec, err)
+	}
+
+	// An incremental backup that fails partway, then resumes
+	r.record("AddJob incremental", nil, catalog.AddJob("/prod", "1", 1, incremental))
+	job, err = catalog.GetAJob("1", secondRun)
+	r.record("GetAJob incremental", job, err)
+	if job == nil {
+		t.Fatal("no incremental job to execute")
+	}
+	incrementalID := job.ID
+	a2, err := catalog.AddFile("/prod/a", incrementalID, 1, 2, 0, "a2", 20, secondRun.Add(-time.Hour))
+	r.record("AddFile /prod/a again", a2, err)
+	r.record("UpdateJob incomplete", nil, catalog.UpdateJob(incrementalID, "/prod", secondRun, time.Minute, 1, pgdb.States.InComplete, 1))
+	file, err = catalog.GetLatestFile("/prod/a", "1")
+	r.record("GetLatestFile while the incremental is InComplete", file, err)
+	job, err = catalog.GetResumableJob("/prod", "1", incremental)
+	r.record("GetResumableJob", job, err)
+	job, err = catalog.GetResumableJob("/prod", "2", incremental)
+	r.record("GetResumableJob of the other pool", job, err)
+	job, err = catalog.GetResumableJob("/prod", "1", full)
+	r.record("GetResumableJob of another level", job, err)
+	r.record("ResumeJob", nil, catalog.ResumeJob(incrementalID))
+	job, err = catalog.GetAJob("1", secondRun.Add(time.Hour))
+	r.record("GetAJob resumed", job, err)
+	r.record("UpdateJob resumed", nil, catalog.UpdateJob(incrementalID, "/prod", secondRun, 2*time.Minute, 2, pgdb.States.Complete, 1))
+	r.record("SetJobEndTime resumed", nil, catalog.SetJobEndTime(incrementalID, secondRun.Add(time.Hour+time.Minute)))
+	for _, level := range []string{full, incremental} {
+		lastExec, err := catalog.GetLastExec("/prod", "1", level)
+		r.record("GetLastExec after the incremental "+level, lastExec, err)
+	}
+
+	// Restores. The incremental started at secondRun but was resumed and ended an hour later, so it is only
+	// restored from then on
+	file, err = catalog.GetLatestFile("/prod/a", "1")
+	r.record("GetLatestFile", file, err)
+	file, err = catalog.GetLatestFile("/prod/a", "")
+	r.record("GetLatestFile of any pool", file, err)
+	file, err = catalog.GetLatestFile("/prod/a", "2")
+	r.record("GetLatestFile of the other pool", file, err)
+	for _, asOf := range []time.Time{firstRun.Add(-time.Minute), firstRun.Add(time.Hour), secondRun.Add(time.Hour), secondRun.Add(2 * time.Hour)} {
+		files, err := catalog.GetFilesAsOf("/prod", "1", asOf)
+		r.record("GetFilesAsOf "+asOf.Format(time.RFC3339), files, err)
+	}
+	files, err := catalog.GetFilesOfJob(incrementalID)
+	r.record("GetFilesOfJob", files, err)
+	r.record("DeleteFile", nil, catalog.DeleteFile(a2))
+	file, err = catalog.GetLatestFile("/prod/a", "1")
+	r.record("GetLatestFile after DeleteFile", file, err)
+
+	// A job requeued when its tape filled up, then interrupted by a signal
+	r.record("AddJob requeued", nil, catalog.AddJob("/prod", "1", 1, incremental))
+	job, err = catalog.GetAJob("1", secondRun.Add(2*time.Hour))
+	r.record("GetAJob to requeue", job, err)
+	if job == nil {
+		t.Fatal("no job to requeue")
+	}
+	r.record("RequeueJob", nil, catalog.RequeueJob(job.ID))
+	jobs, err = catalog.GetJobsByState("1", pgdb.States.Initialized)
+	r.record("GetJobsByState Initialized", jobs, err)
+	job, err = catalog.GetAJob("1", secondRun.Add(3*time.Hour))
+	r.record("GetAJob requeued", job, err)
+	r.record("InterruptCloseJob", nil, catalog.InterruptCloseJob("1"))
+	jobs, err = catalog.GetJobsByState("1", pgdb.States.Interrupted)
+	r.record("GetJobsByState Interrupted", jobs, err)
+	job, err = catalog.GetResumableJob("/prod", "1", incremental)
+	r.record("GetResumableJob interrupted", job, err)
+
+	// A full that fails after the interrupted incremental, which is no longer resumed
+	r.record("AddJob full after the incremental", nil, catalog.AddJob("/prod", "1", 1, full))
+	job, err = catalog.GetAJob("1", secondRun.Add(4*time.Hour))
+	r.record("GetAJob full after the incremental", job, err)
+	if job == nil {
+		t.Fatal("no full job to execute")
+	}
+	r.record("UpdateJob full incomplete", nil, catalog.UpdateJob(job.ID, "/prod", secondRun.Add(4*time.Hour), time.Minute, 0, pgdb.States.InComplete, 1))
+	job, err = catalog.GetResumableJob("/prod", "1", incremental)
+	r.record("GetResumableJob incremental before the full", job, err)
+	job, err = catalog.GetResumableJob("/prod", "1", full)
+	r.record("GetResumableJob full", job, err)
+	scannedID, err := catalog.AddCompleteJob("/scanned", 2, -1, firstRun, incremental)
+	r.record("AddCompleteJob", scannedID, err)
+	jobs, err = catalog.GetJobsByState("2", pgdb.States.Complete)
+	r.record("GetJobsByState of the other pool", jobs, err)
+
+	// A tape change
+	r.record("UpdateErrorInTapeReason", nil, catalog.UpdateErrorInTapeReason("1", "write error"))
+	r.record("error reason", errorReason(1), nil)
+	r.record("UpdateErrorInTapeReason without a tape", nil, catalog.UpdateErrorInTapeReason("2", "write error"))
+	r.record("SetInvalidTail", nil, catalog.SetInvalidTail(1, 2, 20480))
+	r.record("UnloadTape", nil, catalog.UnloadTape("/dev/nst0", 1, 1, true))
+	r.record("LoadTape STA002L7 for writing", nil, catalog.LoadTape("/dev/nst0", 2, true))
+	r.record("UpdateStorage", nil, catalog.UpdateStorage(3, "/dev/nst1"))
+	storages, err := catalog.GetStorages()
+	r.record("GetStorages", storages, err)
+	r.record("UpdateTapeSlot", nil, catalog.UpdateTapeSlot(4, 3))
+	r.record("RelabelTape", nil, catalog.RelabelTape(1, 2, 5))
+	r.record("LoadTape STA001L7 for a restore", nil, catalog.LoadTape("/dev/nst1", 1, false))
+	tapes, err = catalog.GetTapes()
+	r.record("GetTapes", tapes, err)
+	tape, err = catalog.GetTape(9)
+	r.record("GetTape of an unknown tape", tape, err)
+	return r.lines
+}
+
+func TestSameResultsAsSQL(t *testing.T) {
+	sqlCatalog, sqlErrorReason, cleanup := openSQLite(t)
+	defer cleanup()
+	want := run(t, sqlCatalog, sqlErrorReason)
+
+	catalog, errorReason, cleanup := openMemdb(t)
+	defer cleanup()
+	got := run(t, catalog, errorReason)
+
+	if len(got) != len(want) {
+		t.Fatalf("%d calls on memdb, want %d", len(got), len(want))
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("memdb %s\n  want %s", got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,503 @@
+package pgdb
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// migration is one version of the schema. Migrations are applied in order, each in a transaction, and
+// recorded in the SchemaMigrations table
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	// SQLite is the sql of the migration for SQLite catalogs, when Up can't be run as is
+	SQLite string
+}
+
+// migrations are the versions of the schema this binary knows, oldest first. Applied migrations must
+// never be changed; a change to the schema is a new migration
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: `
+Create Table PathSpec (
+	ID Serial Primary Key,
+	Name varchar,
+	Schedule varchar,
+	Constraint pathspec_name_key Unique (Name)
+);
+
+Create Table Job (
+	ID Serial Primary Key,
+	Name varchar,
+	StartTime timestamp,
+	DurationInMinutes integer,
+	NumOfFiles integer,
+	State varchar,
+	PoolID integer,
+	PathSpecID integer
+);
+
+Create Table File (
+	ID Serial Primary Key,
+	Name varchar,
+	JobID integer,
+	FileMarkNum integer,
+	TapeID integer
+);
+
+Create Table Tape (
+	ID Serial Primary Key,
+	Name varchar,
+	PoolID integer,
+	SlotNumber integer,
+	IsFull boolean,
+	ErrorInTape boolean,
+	ErrorReason varchar
+);
+
+Create Table Pool (
+	ID Serial Primary Key,
+	Name varchar,
+	StorageID integer
+);
+
+Create Table Storage (
+	ID Serial Primary Key,
+	Name varchar,
+	TapeID integer,
+	DriveNumber integer
+);
+
+Create Table JobTapeMap (
+	ID Serial Primary Key,
+	Name varchar,
+	JobID integer,
+	TapeID integer
+);
+
+Alter Table Job Add Foreign Key (PoolID) references Pool(ID);
+Alter Table Job Add Foreign Key (PathSpecID) references PathSpec(ID);
+Alter Table File Add Foreign Key (JobID) references Job(ID);
+Alter Table File Add Foreign Key (TapeID) references Tape(ID);
+Alter Table Tape Add Foreign Key (PoolID) references Pool(ID);
+Alter Table Pool Add Foreign Key (StorageID) references Storage(ID);
+Alter Table Storage Add Foreign Key (TapeID) references Tape(ID);
+Alter Table JobTapeMap Add Foreign Key (JobID) references Job(ID);
+Alter Table JobTapeMap Add Foreign Key (TapeID) references Tape(ID);
+`,
+	},
+	{
+		Version: 2,
+		Name:    "job and file indexes",
+		Up: `
+Create Index job_name_poolid_state_idx On Job (Name, PoolID, State);
+Create Index file_name_idx On File (Name);
+`,
+	},
+	{
+		Version: 3,
+		Name:    "job levels",
+		// The jobs written before levels were incremental forever
+		Up: `
+Alter Table Job Add Column Level varchar Default 'incremental';
+`,
+	},
+	{
+		Version: 4,
+		Name:    "job listings",
+		// Listed is false for the jobs that ran before listings were recorded
+		Up: `
+Create Table JobListing (
+	ID Serial Primary Key,
+	JobID integer References Job(ID),
+	Name varchar,
+	Size bigint,
+	ModTime timestamp
+);
+Create Index joblisting_jobid_idx On JobListing (JobID);
+Alter Table Job Add Column Listed boolean Default false;
+`,
+		SQLite: `
+Create Table JobListing (
+	ID integer Primary Key Autoincrement,
+	JobID integer References Job(ID),
+	Name varchar,
+	Size bigint,
+	ModTime timestamp
+);
+Create Index joblisting_jobid_idx On JobListing (JobID);
+Alter Table Job Add Column Listed boolean Default false;
+`,
+	},
+	{
+		Version: 5,
+		Name:    "recursive path specs",
+		Up: `
+Alter Table PathSpec Add Column Recursive boolean Default false;
+`,
+	},
+	{
+		Version: 6,
+		Name:    "file tar offsets",
+		// The offset of the files cataloged before stays NULL, they are found by reading their archive
+		Up: `
+Alter Table File Add Column TarOffset bigint;
+`,
+	},
+	{
+		Version: 7,
+		Name:    "file segments",
+		// The File row is the first segment of a file, the rows of FileSegment are its continuations
+		Up: `
+Create Table FileSegment (
+	ID Serial Primary Key,
+	FileID integer References File(ID),
+	TapeID integer References Tape(ID),
+	FileMarkNum integer,
+	TarOffset bigint,
+	FileOffset bigint
+);
+Create Index filesegment_fileid_idx On FileSegment (FileID);
+Alter Table File Add Column Segments integer Default 0;
+`,
+		SQLite: `
+Create Table FileSegment (
+	ID integer Primary Key Autoincrement,
+	FileID integer References File(ID),
+	TapeID integer References Tape(ID),
+	FileMarkNum integer,
+	TarOffset bigint,
+	FileOffset bigint
+);
+Create Index filesegment_fileid_idx On FileSegment (FileID);
+Alter Table File Add Column Segments integer Default 0;
+`,
+	},
+	{
+		Version: 8,
+		Name:    "invalid tape tails",
+		// The end of a tape that was cut off by the end of the medium, where nothing can be restored from
+		Up: `
+Alter Table Tape Add Column InvalidFileMark integer;
+Alter Table Tape Add Column InvalidOffset bigint;
+`,
+	},
+	{
+		Version: 9,
+		Name:    "file checksums",
+		// The SHA-256 of the content of a file, with the size and modification time it had when backed up
+		Up: `
+Alter Table File Add Column Checksum varchar;
+Alter Table File Add Column Size bigint;
+Alter Table File Add Column ModTime timestamp;
+`,
+	},
+	{
+		Version: 10,
+		Name:    "job end times",
+		// When a job became Complete; the jobs completed before are taken to have ended after their duration
+		Up: `
+Alter Table Job Add Column EndTime timestamp;
+Update Job Set EndTime = StartTime + Coalesce(DurationInMinutes, 0) * Interval '1 minute' Where State = 'Complete';
+`,
+		SQLite: `
+Alter Table Job Add Column EndTime timestamp;
+Update Job Set EndTime = datetime(StartTime, '+' || Coalesce(DurationInMinutes, 0) || ' minutes') Where State = 'Complete';
+`,
+	},
+}
+
+// adoptBaseline brings a schema created by hand from the README, before migrations existed, to the
+// baseline: it adds what the code already relied on but the README never created
+const adoptBaseline = `
+Alter Table Tape Add Column If Not Exists ErrorReason varchar;
+Create Unique Index If Not Exists pathspec_name_key On PathSpec (Name);
+`
+
+// sqliteBaseline is the baseline of SQLite catalogs, which are created by migrate and never adopted.
+// SQLite can't add foreign keys to existing tables, and has no Serial type
+const sqliteBaseline = `
+Create Table PathSpec (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	Schedule varchar,
+	Constraint pathspec_name_key Unique (Name)
+);
+
+Create Table Job (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	StartTime timestamp,
+	DurationInMinutes integer,
+	NumOfFiles integer,
+	State varchar,
+	PoolID integer References Pool(ID),
+	PathSpecID integer References PathSpec(ID)
+);
+
+Create Table File (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	JobID integer References Job(ID),
+	FileMarkNum integer,
+	TapeID integer References Tape(ID)
+);
+
+Create Table Tape (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	PoolID integer References Pool(ID),
+	SlotNumber integer,
+	IsFull boolean,
+	ErrorInTape boolean,
+	ErrorReason varchar
+);
+
+Create Table Pool (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	StorageID integer References Storage(ID)
+);
+
+Create Table Storage (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	TapeID integer References Tape(ID),
+	DriveNumber integer
+);
+
+Create Table JobTapeMap (
+	ID integer Primary Key Autoincrement,
+	Name varchar,
+	JobID integer References Job(ID),
+	TapeID integer References Tape(ID)
+);
+`
+
+const createMigrationsTable = `
+Create Table If Not Exists SchemaMigrations (
+	Version integer Primary Key,
+	Name varchar,
+	AppliedAt timestamp
+)`
+
+// statementsFor returns the sql of the migration for a catalog kept with driver
+func (m migration) statementsFor(driver string) string {
+	if driver != DriverSQLite {
+		return m.Up
+	}
+	if m.Version == 1 {
+		return sqliteBaseline
+	}
+	if m.SQLite != "" {
+		return m.SQLite
+	}
+	return m.Up
+}
+
+// MigrationStatus is a migration of the binary, and when it was applied to the DB
+type MigrationStatus struct {
+	Version int
+	Name    string
+	// Applied is false when the migration is pending
+	Applied   bool
+	AppliedAt time.Time
+}
+
+/**
+Description:
+	This function returns the schema version the binary needs
+*/
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+/**
+Description:
+	This method is used to check whether a table exists in the DB
+Parameter:
+	table: The name of the table, in lower case
+Return:
+	bool: true if the table exists
+	error if any
+*/
+func (db *DBConn) tableExists(table string) (bool, error) {
+	query := "SELECT to_regclass($1) IS NOT NULL"
+	if db.driver == DriverSQLite {
+		query = "SELECT count(*) > 0 FROM sqlite_master WHERE type='table' AND lower(name)=$1"
+	}
+	var exists bool
+	if err := db.queryRow(query, table).Scan(&exists); err != nil {
+		return false, errors.New(err.Error() + "; couldn't check whether table " + table + " exists")
+	}
+	return exists, nil
+}
+
+/**
+Description:
+	This method returns the versions recorded in the SchemaMigrations table, with the time they were
+	applied. A DB without the table has no version applied
+Return:
+	map[int]time.Time: The applied versions
+	error if any
+*/
+func (db *DBConn) appliedMigrations() (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+	exists, err := db.tableExists("schemamigrations")
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	rows, err := db.query("SELECT version, appliedat FROM SchemaMigrations")
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't read the schema migrations")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, errors.New(err.Error() + "; error while scanning the result set")
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.New(err.Error() + "; error while iterating the result set")
+	}
+	return applied, nil
+}
+
+/**
+Description:
+	This method returns every migration of the binary, and whether it was applied
+Return:
+	[]MigrationStatus: The migrations, oldest first
+	error if any
+*/
+func (db *DBConn) MigrationStatus() ([]MigrationStatus, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	for _, m := range migrations {
+		appliedAt, found := applied[m.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   m.Version,
+			Name:      m.Name,
+			Applied:   found,
+			AppliedAt: appliedAt,
+		})
+	}
+	return statuses, nil
+}
+
+/**
+Description:
+	This method applies the pending migrations. A schema that was created by hand from the README is
+	adopted as the baseline instead of being created again
+Return:
+	[]string: The names of the migrations applied
+	error if any; the migrations applied before the error stay applied
+*/
+func (db *DBConn) MigrateUp() ([]string, error) {
+	applied, err := db.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite catalogs were always created by migrate
+	if len(applied) == 0 && db.driver != DriverSQLite {
+		existing, err := db.tableExists("job")
+		if err != nil {
+			return nil, err
+		}
+		if existing {
+			if err := db.applyMigration(migrations[0].Version, migrations[0].Name, adoptBaseline); err != nil {
+				return nil, err
+			}
+			applied[migrations[0].Version] = time.Now()
+		}
+	}
+
+	var names []string
+	for _, m := range migrations {
+		if _, found := applied[m.Version]; found {
+			continue
+		}
+		if err := db.applyMigration(m.Version, m.Name, m.statementsFor(db.driver)); err != nil {
+			return names, err
+		}
+		names = append(names, strconv.Itoa(m.Version)+" "+m.Name)
+	}
+	return names, nil
+}
+
+/**
+Description:
+	This method runs the statements of a migration and records its version, in one transaction
+Parameter:
+	version: The version of the migration
+	name: The name of the migration
+	statements: The sql of the migration
+Return:
+	error if any
+*/
+func (db *DBConn) applyMigration(version int, name string, statements string) error {
+	tx, err := db.DBSql.Begin()
+	if err != nil {
+		return errors.New(err.Error() + "; couldn't start the migration transaction")
+	}
+	fail := func(err error, context string) error {
+		tx.Rollback()
+		return errors.New(err.Error() + "; " + context + " (migration " + strconv.Itoa(version) + " " + name + ")")
+	}
+
+	if _, err := tx.Exec(createMigrationsTable); err != nil {
+		return fail(err, "couldn't create the SchemaMigrations table")
+	}
+	if _, err := tx.Exec(statements); err != nil {
+		return fail(err, "error while applying")
+	}
+	query := "INSERT INTO SchemaMigrations VALUES ($1, $2, $3)"
+	if _, err := tx.Exec(db.rebind(query), version, name, time.Now().In(time.UTC)); err != nil {
+		return fail(err, "couldn't record")
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err, "couldn't commit")
+	}
+	return nil
+}
+
+/**
+Description:
+	This method checks that every migration of the binary was applied to the DB, so that the code never
+	runs against an out-of-date schema
+Return:
+	error describing the pending migrations, or nil
+*/
+func (db *DBConn) CheckSchema() error {
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	pending := 0
+	current := 0
+	for _, status := range statuses {
+		if !status.Applied {
+			pending++
+		} else if status.Version > current {
+			current = status.Version
+		}
+	}
+	if pending == 0 {
+		return nil
+	}
+	return errors.New("The database schema is at version " + strconv.Itoa(current) + " but version " +
+		strconv.Itoa(LatestSchemaVersion()) + " is needed (" + strconv.Itoa(pending) +
+		" pending migration(s)), please run: BackUpTest migrate up")
+}
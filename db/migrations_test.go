@@ -0,0 +1,207 @@
+package pgdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openSQLiteCatalog opens an empty SQLite catalog in a temporary directory, and returns it with the
+// function that removes it
+func openSQLiteCatalog(t *testing.T) (*DBConn, func()) {
+	dir, err := ioutil.TempDir("", "pgdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := ConnectWith(Options{Driver: DriverSQLite, Path: filepath.Join(dir, "catalog.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMigrationVersions(t *testing.T) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Name == "" || m.Up == "" {
+			t.Errorf("migration %d has no name or no sql", m.Version)
+		}
+	}
+	if LatestSchemaVersion() != len(migrations) {
+		t.Errorf("LatestSchemaVersion() = %d, want %d", LatestSchemaVersion(), len(migrations))
+	}
+}
+
+func TestMigrateUp(t *testing.T) {
+	db, cleanup := openSQLiteCatalog(t)
+	defer cleanup()
+
+	// A new catalog has every migration pending
+	if err := db.CheckSchema(); err == nil || !strings.Contains(err.Error(), "migrate up") {
+		t.Fatalf("CheckSchema() = %v, want the pending migrations", err)
+	}
+
+	names, err := db.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(migrations) {
+		t.Fatalf("applied %q, want %d migrations", names, len(migrations))
+	}
+	for i, name := range names {
+		if want := strconv.Itoa(migrations[i].Version) + " " + migrations[i].Name; name != want {
+			t.Errorf("migration %d applied is %q, want %q", i, name, want)
+		}
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := db.MigrationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, status := range statuses {
+		if !status.Applied || status.AppliedAt.IsZero() {
+			t.Errorf("migration %d %s is not recorded as applied", status.Version, status.Name)
+		}
+	}
+
+	// Nothing is left to apply the second time
+	if names, err := db.MigrateUp(); err != nil || len(names) != 0 {
+		t.Errorf("MigrateUp() = %q, %v the second time, want nothing applied", names, err)
+	}
+}
+
+func TestMigrateUpFromOldVersion(t *testing.T) {
+	db, cleanup := openSQLiteCatalog(t)
+	defer cleanup()
+
+	// A catalog created by an older binary, which only knew the first migrations
+	const known = 3
+	for _, m := range migrations[:known] {
+		if err := db.applyMigration(m.Version, m.Name, m.statementsFor(DriverSQLite)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := db.CheckSchema()
+	if err == nil || !strings.Contains(err.Error(), "at version 3") {
+		t.Fatalf("CheckSchema() = %v, want the catalog at version 3", err)
+	}
+
+	names, err := db.MigrateUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != len(migrations)-known {
+		t.Fatalf("applied %q, want the %d migrations after version %d", names, len(migrations)-known, known)
+	}
+	if err := db.CheckSchema(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratedSchema(t *testing.T) {
+	db, cleanup := openSQLiteCatalog(t)
+	defer cleanup()
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog is usable once migrated, up to the columns of the last migrations
+	if _, err := db.exec("INSERT INTO Storage (name, drivenumber) VALUES ('/dev/nst0', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.exec("INSERT INTO Pool (name, storageid) VALUES ('onsite', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddTape("STA000L7", 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetInvalidTail(1, 3, 20480); err != nil {
+		t.Fatal(err)
+	}
+	tape, err := db.GetTape(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tape.InvalidFileMark != 3 || tape.InvalidOffset != 20480 {
+		t.Errorf("invalid tail = %d, %d, want 3, 20480", tape.InvalidFileMark, tape.InvalidOffset)
+	}
+
+	jobID, err := db.AddCompleteJob("/prod", 1, -1, time.Now(), "full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	fileID, err := db.AddFile("/prod/a", jobID, 1, 2, 512, "9f86d081", 42, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := db.GetFilesOfJob(jobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].ID != fileID {
+		t.Fatalf("files of the job = %+v, want file %d", files, fileID)
+	}
+	if files[0].Checksum != "9f86d081" || files[0].Size != 42 || !files[0].ModTime.Time.Equal(modTime) {
+		t.Errorf("file = %+v, want its checksum, size and modification time", files[0])
+	}
+}
+
+func TestMigrateJobEndTimes(t *testing.T) {
+	db, cleanup := openSQLiteCatalog(t)
+	defer cleanup()
+
+	// Jobs of a catalog from before end times were recorded
+	for _, m := range migrations[:9] {
+		if err := db.applyMigration(m.Version, m.Name, m.statementsFor(DriverSQLite)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.exec("INSERT INTO Storage (name, drivenumber) VALUES ('/dev/nst0', 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.exec("INSERT INTO Pool (name, storageid) VALUES ('onsite', 1)"); err != nil {
+		t.Fatal(err)
+	}
+	startTime := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	if _, err := db.exec("INSERT INTO Job (name, starttime, durationinminutes, state, poolid) VALUES ('/prod', $1, 90, $2, 1)",
+		startTime, States.Complete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.exec("INSERT INTO Job (name, starttime, durationinminutes, state, poolid) VALUES ('/prod', $1, 5, $2, 1)",
+		startTime, States.InComplete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.MigrateUp(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A Complete job ended after its duration, the others haven't ended
+	complete, err := db.GetJobsByState("1", States.Complete)
+	if err != nil || len(complete) != 1 {
+		t.Fatalf("complete jobs %+v, %v, want one", complete, err)
+	}
+	if want := startTime.Add(90 * time.Minute); !complete[0].EndTime.Valid || !complete[0].EndTime.Time.Equal(want) {
+		t.Errorf("end time of the complete job = %+v, want %v", complete[0].EndTime, want)
+	}
+	incomplete, err := db.GetJobsByState("1", States.InComplete)
+	if err != nil || len(incomplete) != 1 {
+		t.Fatalf("incomplete jobs %+v, %v, want one", incomplete, err)
+	}
+	if incomplete[0].EndTime.Valid {
+		t.Errorf("end time of the incomplete job = %v, want NULL", incomplete[0].EndTime.Time)
+	}
+}
@@ -0,0 +1,122 @@
+package pgdb
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"regexp"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The drivers the catalog can be kept with
+const (
+	// DriverPostgres keeps the catalog on a pg server
+	DriverPostgres = "postgres"
+	// DriverSQLite keeps the catalog in an embedded SQLite file, for small sites without a DBA
+	DriverSQLite = "sqlite"
+)
+
+var paramReg = regexp.MustCompile(`\$(\d+)`)
+
+/**
+Description:
+	This function builds the data source name of a SQLite catalog file. Foreign keys are enforced like on
+	the pg server, and a connection waits for the others instead of failing with "database is locked"
+Parameter:
+	path: The path of the catalog file
+	readOnly: true to open an existing file without writing to it
+Return:
+	string: The data source name given to go-sqlite3
+*/
+func sqliteDSN(path string, readOnly bool) string {
+	params := url.Values{}
+	params.Set("_foreign_keys", "on")
+	params.Set("_busy_timeout", "10000")
+	params.Set("_txlock", "immediate")
+	params.Set("_loc", "auto")
+	if readOnly {
+		params.Set("mode", "ro")
+	} else {
+		params.Set("_journal_mode", "WAL")
+	}
+	return "file:" + path + "?" + params.Encode()
+}
+
+/**
+Description:
+	This function opens a SQLite catalog file, which is created when it doesn't exist yet
+Parameter:
+	options: The connection options, of which Path is used
+Return:
+	*sql.DB: The opened DB
+	error if any
+*/
+func openSQLite(options Options) (*sql.DB, error) {
+	if options.Path == "" {
+		return nil, errors.New("The path of the SQLite catalog is needed")
+	}
+	db, err := sql.Open("sqlite3", sqliteDSN(options.Path, options.ReadOnly))
+	if err != nil {
+		return nil, errors.New(err.Error() + "; couldn't open the SQLite catalog " + options.Path)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.New(err.Error() + "; couldn't open the SQLite catalog " + options.Path)
+	}
+	return db, nil
+}
+
+/**
+Description:
+	This method rewrites a query written for the pg server for the driver of the DB. SQLite numbers its
+	parameters ?1, ?2... where pg uses $1, $2...
+Parameter:
+	query: The query, with $1 style parameters
+Return:
+	string: The query the driver understands
+*/
+func (db *DBConn) rebind(query string) string {
+	if db.driver != DriverSQLite {
+		return query
+	}
+	return paramReg.ReplaceAllString(query, "?$1")
+}
+
+/**
+Description:
+	This method converts the arguments of a query for the driver of the DB. SQLite keeps times as text,
+	so they are all written in UTC for the comparisons and the ORDER BYs to hold
+Parameter:
+	args: The arguments of the query
+Return:
+	[]interface{}: The arguments the driver is given
+*/
+func (db *DBConn) bindArgs(args []interface{}) []interface{} {
+	if db.driver != DriverSQLite {
+		return args
+	}
+	bound := make([]interface{}, len(args))
+	for i, arg := range args {
+		if t, ok := arg.(time.Time); ok {
+			arg = t.UTC()
+		}
+		bound[i] = arg
+	}
+	return bound
+}
+
+// exec, query and queryRow run a query written with $1 style parameters, whatever the driver of the DB
+
+func (db *DBConn) exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.DBSql.Exec(db.rebind(query), db.bindArgs(args)...)
+}
+
+func (db *DBConn) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.DBSql.Query(db.rebind(query), db.bindArgs(args)...)
+}
+
+func (db *DBConn) queryRow(query string, args ...interface{}) *sql.Row {
+	return db.DBSql.QueryRow(db.rebind(query), db.bindArgs(args)...)
+}
@@ -0,0 +1,49 @@
+package pgdb
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// txConn runs the queries of a transaction, written with $1 style parameters like the queries of DBConn
+type txConn struct {
+	tx *sql.Tx
+	db *DBConn
+}
+
+func (tx *txConn) exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.tx.Exec(tx.db.rebind(query), tx.db.bindArgs(args)...)
+}
+
+func (tx *txConn) queryRow(query string, args ...interface{}) *sql.Row {
+	return tx.tx.QueryRow(tx.db.rebind(query), tx.db.bindArgs(args)...)
+}
+
+func (tx *txConn) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return tx.tx.Query(tx.db.rebind(query), tx.db.bindArgs(args)...)
+}
+
+/**
+Description:
+	This method runs a function in a transaction, which is committed if the function returns nil and
+	rolled back otherwise. SQLite transactions take the write lock when they begin (see sqliteDSN), so two
+	processes can't interleave their updates
+Parameter:
+	fn: The function issuing the queries of the transaction
+Return:
+	error: The error of fn, or of the commit
+*/
+func (db *DBConn) inTransaction(fn func(tx *txConn) error) error {
+	sqlTx, err := db.DBSql.Begin()
+	if err != nil {
+		return errors.New(err.Error() + "; couldn't start a transaction")
+	}
+	if err := fn(&txConn{tx: sqlTx, db: db}); err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return errors.New(err.Error() + "; couldn't commit the transaction")
+	}
+	return nil
+}
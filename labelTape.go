@@ -0,0 +1,238 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+/**
+Description:
+	This function is the entry point of the label command, which prepares a new tape for a pool
+		label [-force] [-name tapeName] <slot|barcode> <poolID>
+	The tape is loaded into the drive of the pool, erased and labeled, added to (or updated in) the Tape
+	table, and put back into its slot. A tape that already has data is only erased with -force
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func labelCommand(args []string) error {
+	flags := flag.NewFlagSet("label", flag.ContinueOnError)
+	force := flags.Bool("force", false, "erase the tape even if it already has data")
+	name := flags.String("name", "", "the name of the tape, needed when the tape has no barcode")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New("usage: label [-force] [-name tapeName] <slot|barcode> <poolID>")
+	}
+	poolID, err := strconv.Atoi(flags.Arg(1))
+	if err != nil {
+		return errors.New(flags.Arg(1) + " is not a valid poolID")
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	changer, err := tape.NewChanger(appSettings.Changer.Device)
+	if err != nil {
+		return err
+	}
+	inventory, err := tape.GetInventory(changer)
+	if err != nil {
+		return err
+	}
+
+	slot, err := findTapeToLabel(inventory, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	tapeName := slot.Barcode
+	if *name != "" {
+		tapeName = *name
+	}
+	if tapeName == "" {
+		return errors.New("The tape in slot " + strconv.Itoa(slot.Number) + " has no barcode, please give its name with -name")
+	}
+
+	return labelTape(catalog, changer, inventory, slot.Number, tapeName, poolID, *force)
+}
+
+/**
+Description:
+	This function finds the slot of the tape to label, given either its slot number or its barcode
+Parameter:
+	inventory: The current inventory of the library
+	tapeArg: The slot number or the barcode
+Return:
+	*tape.SlotElement: The slot holding the tape
+	error if the tape isn't in a slot
+*/
+func findTapeToLabel(inventory *tape.Inventory, tapeArg string) (*tape.SlotElement, error) {
+	if slotNum, err := strconv.Atoi(tapeArg); err == nil {
+		for i := range inventory.Slots {
+			if inventory.Slots[i].Number == slotNum {
+				if !inventory.Slots[i].Full {
+					return nil, errors.New("Slot " + tapeArg + " is empty")
+				}
+				return &inventory.Slots[i], nil
+			}
+		}
+		return nil, errors.New("The tape library has no slot " + tapeArg)
+	}
+
+	if drive := inventory.FindDrive(tapeArg); drive != nil {
+		return nil, errors.New("Tape " + tapeArg + " is loaded in drive " + strconv.Itoa(drive.Number) +
+			", please unload it first")
+	}
+	slot := inventory.FindSlot(tapeArg)
+	if slot == nil {
+		return nil, errors.New("Tape " + tapeArg + " is not in the tape library")
+	}
+	return slot, nil
+}
+
+/**
+Description:
+	This function labels the tape in slot "slotNum" using the drive of the pool. The tape in that drive, if
+	any, is moved to an empty slot first. The drive is left empty afterwards
+Parameter:
+	catalog: The DB connection
+	changer: The changer of the library
+	inventory: The inventory of the library before the tape is loaded
+	slotNum: The slot of the tape to label
+	tapeName: The name written in the label and used in the Tape table
+	poolID: The pool the tape is labeled for
+	force: Whether a tape that already has data is erased
+Return:
+	error if any
+*/
+func labelTape(catalog pgdb.Catalog, changer tape.Changer, inventory *tape.Inventory, slotNum int, tapeName string, poolID int, force bool) error {
+	tapePath, err := poolDrivePath(catalog, strconv.Itoa(poolID))
+	if err != nil {
+		return err
+	}
+	storages, err := catalog.GetStorages()
+	if err != nil {
+		return err
+	}
+	var storage *pgdb.Storage
+	for i := range storages {
+		if storages[i].Name == tapePath {
+			storage = &storages[i]
+		}
+	}
+	if storage == nil {
+		return errors.New("Drive " + tapePath + " of pool " + strconv.Itoa(poolID) + " is not in the Storage table")
+	}
+
+	// Free the drive of the pool
+	for _, drive := range inventory.Drives {
+		if drive.Number != storage.DriveNumber || !drive.Loaded {
+			continue
+		}
+		unloadTo, err := inventory.EmptySlot()
+		if err != nil {
+			return err
+		}
+		if err := changer.Unload(storage.DriveNumber, unloadTo); err != nil {
+			return err
+		}
+		fmt.Println("Unloaded " + volumeTag(drive.Barcode) + " from drive " + strconv.Itoa(drive.Number) +
+			" to slot " + strconv.Itoa(unloadTo))
+		if err := catalog.UnloadTape(tapePath, storage.TapeID, unloadTo, false); err != nil {
+			return err
+		}
+	}
+
+	if err := changer.Load(storage.DriveNumber, slotNum); err != nil {
+		return err
+	}
+	labelErr := writeNewLabel(tapePath, tapeName, poolID, force)
+
+	// The tape goes back to its slot even if labeling failed
+	if err := changer.Unload(storage.DriveNumber, slotNum); err != nil {
+		return err
+	}
+	if labelErr != nil {
+		return labelErr
+	}
+
+	existing, err := catalog.GetTapeByName(tapeName)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		err = catalog.AddTape(tapeName, poolID, slotNum)
+	} else {
+		err = catalog.RelabelTape(existing.ID, poolID, slotNum)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Labeled " + tapeName + " for pool " + strconv.Itoa(poolID) + " in slot " + strconv.Itoa(slotNum))
+	return nil
+}
+
+/**
+Description:
+	This function erases the tape loaded in the drive and writes its volume label
+Parameter:
+	tapePath: The drive the tape is loaded in
+	tapeName: The name written in the label
+	poolID: The pool written in the label
+	force: Whether a tape that already has data is erased
+Return:
+	error if any
+*/
+func writeNewLabel(tapePath string, tapeName string, poolID int, force bool) error {
+	tapeConfig, err := tape.New(tapePath, appSettings.Limits.RecordSize)
+	if err != nil {
+		return err
+	}
+	defer tapeConfig.CloseTape()
+
+	// A tape whose first file isn't a tar archive has foreign data, which is erased with force like a tape
+	// without a label. So is a tape that can't be read, eg written with larger records (ENOMEM) or cut
+	// short (io.ErrUnexpectedEOF), since force means its content doesn't matter
+	label, err := tapeConfig.ReadLabel()
+	if !force {
+		if err == tape.ErrNoLabel {
+			return errors.New("The tape has data but no volume label, use -force to erase it")
+		}
+		if err == tar.ErrHeader {
+			return errors.New("The tape has data that isn't a tar archive, use -force to erase it")
+		}
+		if err != nil {
+			return errors.New(err.Error() + "; the tape can't be read, use -force to erase it")
+		}
+		if label != nil {
+			return errors.New("The tape is already labeled " + label.TapeName + " for pool " +
+				strconv.Itoa(label.PoolID) + " since " + label.LabelTime.Format(time.RFC3339) +
+				", use -force to erase it")
+		}
+	} else if err != nil && err != tape.ErrNoLabel && err != tar.ErrHeader {
+		fmt.Println("The tape can't be read (" + err.Error() + "), erasing it")
+	}
+
+	if err := tapeConfig.Erase(); err != nil {
+		return err
+	}
+	return tapeConfig.WriteLabel(&tape.Label{
+		TapeName:      tapeName,
+		PoolID:        poolID,
+		LabelTime:     time.Now().In(time.UTC),
+		FormatVersion: tape.FormatVersion,
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/testusr/BackUpTest/tape"
+)
+
+func TestForceLabelUnreadableTape(t *testing.T) {
+	dir, err := ioutil.TempDir("", "label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tapePath := filepath.Join(dir, "tape0")
+	if err := tape.CreateVirtual(tapePath, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record larger than the record size fails to be read with ENOMEM
+	drive, err := tape.OpenVirtual(tapePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := drive.Write(make([]byte, 4*appSettings.Limits.RecordSize)); err != nil {
+		t.Fatal(err)
+	}
+	drive.Close()
+
+	if err := writeNewLabel(tapePath, "T00001", 1, false); err == nil {
+		t.Fatal("an unreadable tape was labeled without -force")
+	}
+	if err := writeNewLabel(tapePath, "T00001", 1, true); err != nil {
+		t.Fatalf("writeNewLabel() with -force = %v", err)
+	}
+	tapeConfig, err := tape.New(tapePath, appSettings.Limits.RecordSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tapeConfig.CloseTape()
+	label, err := tapeConfig.ReadLabel()
+	if err != nil || label == nil || label.TapeName != "T00001" {
+		t.Errorf("ReadLabel() = %+v, %v, want the label of T00001", label, err)
+	}
+}
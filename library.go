@@ -0,0 +1,262 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+// discrepancy is a difference between the tape library and the DB, together with the DB update that fixes it
+type discrepancy struct {
+	description string
+	// fix is nil when the DB can't be fixed, eg when a tape is missing from the library
+	fix func() error
+}
+
+/**
+Description:
+	This function is the entry point of the inventory command, which prints what the tape library has in
+	its drives and slots
+		inventory
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func inventoryCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: inventory")
+	}
+
+	changer, err := tape.NewChanger(appSettings.Changer.Device)
+	if err != nil {
+		return err
+	}
+	inventory, err := tape.GetInventory(changer)
+	if err != nil {
+		return err
+	}
+
+	for _, drive := range inventory.Drives {
+		if !drive.Loaded {
+			fmt.Printf("Drive %d: Empty\n", drive.Number)
+			continue
+		}
+		fmt.Printf("Drive %d: %s (from slot %d)\n", drive.Number, volumeTag(drive.Barcode), drive.SourceSlot)
+	}
+	for _, slot := range inventory.Slots {
+		kind := ""
+		if slot.ImportExport {
+			kind = " (import/export)"
+		}
+		if !slot.Full {
+			fmt.Printf("Slot %d%s: Empty\n", slot.Number, kind)
+			continue
+		}
+		fmt.Printf("Slot %d%s: %s\n", slot.Number, kind, volumeTag(slot.Barcode))
+	}
+	return nil
+}
+
+/**
+Description:
+	This function returns the barcode to print for a tape, which can be missing
+*/
+func volumeTag(barcode string) string {
+	if barcode == "" {
+		return "(no barcode)"
+	}
+	return barcode
+}
+
+/**
+Description:
+	This function is the entry point of the reconcile command, which compares the tape library with the
+	Tape and Storage tables and reports the differences
+		reconcile [-fix]
+	With -fix the DB is updated to match the library
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func reconcileCommand(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "update the DB to match the tape library")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		return errors.New("usage: reconcile [-fix]")
+	}
+	return reconcileLibrary(*fix)
+}
+
+/**
+Description:
+	This function compares the tape library with the Tape and Storage tables by barcode, prints every
+	discrepancy and optionally fixes the DB. It runs at startup, before the drives are opened, so that
+	manual tape moves or a crash in the middle of a tape change don't leave the catalog wrong
+Parameter:
+	fix: Whether the DB is updated to match the library
+Return:
+	error if any
+*/
+func reconcileLibrary(fix bool) error {
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	changer, err := tape.NewChanger(appSettings.Changer.Device)
+	if err != nil {
+		return err
+	}
+	inventory, err := tape.GetInventory(changer)
+	if err != nil {
+		return err
+	}
+
+	discrepancies, err := findDiscrepancies(catalog, inventory)
+	if err != nil {
+		return err
+	}
+
+	for _, found := range discrepancies {
+		if !fix || found.fix == nil {
+			fmt.Println(found.description)
+			continue
+		}
+		if err := found.fix(); err != nil {
+			return err
+		}
+		fmt.Println(found.description + " (fixed)")
+	}
+	return nil
+}
+
+/**
+Description:
+	This function finds the differences between the library inventory and the Tape and Storage tables. Tape
+	names in the DB are the barcodes of the tapes, and a tape in a drive has slot number 0
+Parameter:
+	catalog: The DB connection
+	inventory: The current inventory of the library
+Return:
+	[]discrepancy: The differences found
+	error if any
+*/
+func findDiscrepancies(catalog pgdb.Catalog, inventory *tape.Inventory) ([]discrepancy, error) {
+	tapes, err := catalog.GetTapes()
+	if err != nil {
+		return nil, err
+	}
+	storages, err := catalog.GetStorages()
+	if err != nil {
+		return nil, err
+	}
+
+	var discrepancies []discrepancy
+	tapeIDs := make(map[string]int)
+
+	for _, known := range tapes {
+		known := known
+		tapeIDs[known.Name] = known.ID
+
+		if drive := inventory.FindDrive(known.Name); drive != nil {
+			if known.SlotNumber != 0 {
+				discrepancies = append(discrepancies, discrepancy{
+					description: "Tape " + known.Name + " is in drive " + strconv.Itoa(drive.Number) +
+						", but the DB has it in slot " + strconv.Itoa(known.SlotNumber),
+					fix: func() error { return catalog.UpdateTapeSlot(0, known.ID) },
+				})
+			}
+			continue
+		}
+
+		slot := inventory.FindSlot(known.Name)
+		if slot == nil {
+			discrepancies = append(discrepancies, discrepancy{
+				description: "Tape " + known.Name + " is not in the tape library",
+			})
+			continue
+		}
+		if known.SlotNumber != slot.Number {
+			discrepancies = append(discrepancies, discrepancy{
+				description: "Tape " + known.Name + " is in slot " + strconv.Itoa(slot.Number) +
+					", but the DB has it in " + slotDescription(known.SlotNumber),
+				fix: func() error { return catalog.UpdateTapeSlot(slot.Number, known.ID) },
+			})
+		}
+	}
+
+	for _, storage := range storages {
+		storage := storage
+		var drive *tape.DriveElement
+		for i := range inventory.Drives {
+			if inventory.Drives[i].Number == storage.DriveNumber {
+				drive = &inventory.Drives[i]
+			}
+		}
+		if drive == nil {
+			discrepancies = append(discrepancies, discrepancy{
+				description: "Drive " + strconv.Itoa(storage.DriveNumber) + " (" + storage.Name + ") is not in the tape library",
+			})
+			continue
+		}
+
+		// -1 represents the NULL value of an empty drive in the DB
+		want := -1
+		if drive.Loaded {
+			tapeID, found := tapeIDs[drive.Barcode]
+			if !found {
+				// The drive isn't empty, so the tape the DB has in it can't be cleared; the tape needs adding
+				// to the DB first
+				discrepancies = append(discrepancies, discrepancy{
+					description: "Drive " + strconv.Itoa(drive.Number) + " has tape " + volumeTag(drive.Barcode) +
+						", which is not in the DB",
+				})
+				continue
+			}
+			want = tapeID
+		}
+		if storage.TapeID != want {
+			description := "Drive " + strconv.Itoa(drive.Number) + " is empty, but the DB has a tape in it"
+			if want >= 0 {
+				description = "Drive " + strconv.Itoa(drive.Number) + " has tape " + drive.Barcode +
+					", but the DB has a different tape in it"
+			}
+			discrepancies = append(discrepancies, discrepancy{
+				description: description,
+				fix:         func() error { return catalog.UpdateStorage(want, storage.Name) },
+			})
+		}
+	}
+
+	for _, slot := range inventory.Slots {
+		if _, found := tapeIDs[slot.Barcode]; slot.Full && !found {
+			discrepancies = append(discrepancies, discrepancy{
+				description: "Slot " + strconv.Itoa(slot.Number) + " has tape " + volumeTag(slot.Barcode) +
+					", which is not in the DB",
+			})
+		}
+	}
+
+	return discrepancies, nil
+}
+
+/**
+Description:
+	This function describes a slot number of the Tape table, where 0 means the tape is in a drive
+*/
+func slotDescription(slotNum int) string {
+	if slotNum == 0 {
+		return "a drive"
+	}
+	return "slot " + strconv.Itoa(slotNum)
+}
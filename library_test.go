@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/testusr/BackUpTest/db/memdb"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+func TestFindDiscrepanciesUnknownTapeInDrive(t *testing.T) {
+	catalog := memdb.New()
+	catalog.AddPool("pool1", catalog.AddStorage("/dev/nst0", 0))
+	if err := catalog.AddTape("T00001", 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.LoadTape("/dev/nst0", 1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tape of the DB was put back in its slot by hand, and a tape the DB doesn't know loaded instead
+	inventory := &tape.Inventory{
+		Drives: []tape.DriveElement{{Number: 0, Loaded: true, SourceSlot: 2, Barcode: "X00009"}},
+		Slots:  []tape.SlotElement{{Number: 1, Full: true, Barcode: "T00001"}, {Number: 2}},
+	}
+	discrepancies, err := findDiscrepancies(catalog, inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var descriptions []string
+	for _, found := range discrepancies {
+		descriptions = append(descriptions, found.description)
+		if found.fix == nil {
+			continue
+		}
+		if err := found.fix(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"Tape T00001 is in slot 1, but the DB has it in a drive",
+		"Drive 0 has tape X00009, which is not in the DB",
+	}
+	if !equalStrings(descriptions, want) {
+		t.Errorf("discrepancies %q, want %q", descriptions, want)
+	}
+
+	// The drive isn't recorded as empty
+	storages, err := catalog.GetStorages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storages[0].TapeID != 1 {
+		t.Errorf("tape of drive 0 is %d after the fixes, want 1", storages[0].TapeID)
+	}
+}
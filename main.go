@@ -1,31 +1,65 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/colinmarc/hdfs"
 	"github.com/robfig/cron"
 	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/settings"
+	"github.com/testusr/BackUpTest/tape"
 )
 
 var activeThreads int
 
-var schedules = map[string]string{
-	"2Mins": "00 */05 * * * *", // For testing purpose
-	//"Hourly":  "00 00 * * * *",
-	//"Daily":   "00 00 23 * * *",
-	//"Monthly": "00 00 23 1 * *",
-	//"Yearly":  "00 00 23 1 1 *",
+// The settings read from the configuration file, see the settings package
+var appSettings = settings.Default()
+
+// Commands that can be given instead of a poolID as the first command line argument
+var commands = map[string]func(args []string) error{
+	"restore":   restoreCommand,
+	"vtape":     virtualTapeCommand,
+	"simlib":    simulatedLibraryCommand,
+	"inventory": inventoryCommand,
+	"reconcile": reconcileCommand,
+	"scan":      scanCommand,
+	"label":     labelCommand,
+	"config":    configCommand,
+	"migrate":   migrateCommand,
+	"pathspec":  pathSpecCommand,
 }
 
 func main() {
 
+	// The config command reports the problems of the configuration file itself
+	if len(os.Args) < 2 || os.Args[1] != "config" {
+		var err error
+		appSettings, err = settings.Load()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		pgdb.ConnOptions = databaseOptions(appSettings.Database)
+	}
+
+	if len(os.Args) > 1 {
+		if command, found := commands[os.Args[1]]; found {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	backUpA := new(backUpconfig)
 	backUpB := new(backUpconfig)
 
@@ -33,7 +67,8 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Fprintln(os.Stderr, `Command Line Argument Expected!
-		The Command Line Arguments represents the pool pair in which we'll be adding data`)
+		The Command Line Arguments represents the pool pair in which we'll be adding data,
+		or one of the commands: restore, vtape, simlib, inventory, reconcile, scan, label, config, migrate, pathspec`)
 		return
 	}
 
@@ -44,6 +79,14 @@ func main() {
 		return
 	}
 
+	// Make sure the DB knows where the tapes are before the drives are opened; the DB is only updated when
+	// the settings ask for it
+	err = reconcileLibrary(appSettings.Changer.FixAtStartup)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
 	err = setupBackupConfig(backUpA, poolID)
 	if err != nil {
 		fmt.Println(err)
@@ -52,10 +95,16 @@ func main() {
 	}
 	defer backUpA.closeAll()
 
-	// Getting the pair's poolID, eg STA000L7 pair is STAB000L7
-	pairPoolID, err := backUpA.DB.GetPair(poolID)
-	if err != nil {
-		return
+	// Getting the pair's poolID from the configuration file, or else from the tape names,
+	// eg STA000L7 pair is STAB000L7
+	pairPoolID := ""
+	if id, _ := strconv.Atoi(poolID); appSettings.PairOf(id) >= 0 {
+		pairPoolID = strconv.Itoa(appSettings.PairOf(id))
+	} else {
+		pairPoolID, err = backUpA.DB.GetPair(poolID)
+		if err != nil {
+			return
+		}
 	}
 
 	err = setupBackupConfig(backUpB, pairPoolID)
@@ -83,13 +132,14 @@ func main() {
 		os.Exit(1)
 	}()
 
-	// For testing purpose-- will be replaced with "/" directory
-	arr := []string{"/ccr", "/prod"}
+	arr := appSettings.Roots
 	i := -1
 	j := -1
-	// For testing purpose
 
-	for scheduleType, scheduleInCronFormat := range schedules {
+	for _, schedule := range appSettings.Schedules {
+		scheduleType := schedule.Name
+		scheduleLevel := schedule.Level
+		scheduleInCronFormat := schedule.Cron
 		cron.AddFunc(scheduleInCronFormat, func() {
 			activeThreads = activeThreads + 1
 			defer func() {
@@ -97,7 +147,7 @@ func main() {
 			}()
 
 			i = (i + 1) % len(arr)
-			cronJob(backUpA, arr[i], poolID, scheduleType)
+			cronJob(backUpA, arr[i], poolID, scheduleType, scheduleLevel)
 
 		})
 		cron.AddFunc(scheduleInCronFormat, func() {
@@ -107,7 +157,7 @@ func main() {
 			}()
 
 			j = (j + 1) % len(arr)
-			cronJob(backUpB, arr[j], pairPoolID, scheduleType)
+			cronJob(backUpB, arr[j], pairPoolID, scheduleType, scheduleLevel)
 		})
 	}
 
@@ -135,9 +185,10 @@ Parameters:
 	root: represents the root path which is walked by hdfs filepath.walk method
 	poolID: represents the type of backup (with respect to the tapes) being done
 	jobType: reprents the type of backup that is ran from the cronJob schedular
+	level: The backup level of the jobs created: full, differential or incremental
 	makeJobCompleted: represents the channel that is used for communcation betweeen the makeJob and execJob go routines
 */
-func cronJob(backUp *backUpconfig, root string, poolID string, jobType string) error {
+func cronJob(backUp *backUpconfig, root string, poolID string, jobType string, level string) error {
 
 	// Run only one cron Job of one pool type at a time
 	// Discreprancy when both cron thread are running and both try to write to
@@ -156,11 +207,14 @@ func cronJob(backUp *backUpconfig, root string, poolID string, jobType string) e
 	// channel used to signal the error encountered in execJob to makeJob
 	errorWhileExecuting := make(chan error)
 
-	go backUp.makeJobs(poolID, jobType, makeJobCompleted, root, errorWhileExecuting)
+	go backUp.makeJobs(poolID, jobType, level, makeJobCompleted, root, errorWhileExecuting)
 
 	if err := backUp.execJobs(poolID, makeJobCompleted, errorWhileExecuting); err != nil {
 		fmt.Println(poolID, err)
-		backUp.DB.UpdateErrorInTapeReason(poolID, err.Error())
+		// A drive without a loaded tape isn't a problem of the tape
+		if !tape.IsNotReady(err) {
+			backUp.DB.UpdateErrorInTapeReason(poolID, err.Error())
+		}
 		backUp.errorEncountered = true
 		// If there is an error, sleep until the user sends a signal interrupt
 		backUp.execJobClosed <- 1
@@ -171,6 +225,338 @@ func cronJob(backUp *backUpconfig, root string, poolID string, jobType string) e
 
 }
 
+/**
+Description:
+	This function is the entry point of the vtape command, which creates a blank virtual tape file
+		vtape <path> <capacityInBytes>
+	The path can then be used wherever a tape drive path is expected, eg as the Storage name
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func virtualTapeCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: vtape <path> <capacityInBytes>")
+	}
+	capacity, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || capacity <= 0 {
+		return errors.New("Invalid capacity " + args[1])
+	}
+	return tape.CreateVirtual(args[0], capacity)
+}
+
+/**
+Description:
+	This function is the entry point of the simlib command, which creates the state file of a simulated
+	tape library
+		simlib [-slots n] [-ie n] [-capacity bytes] [-tapes barcode,...] <stateFile> <tapeDir> <drivePath>...
+	The state file can then be used instead of the changer device, and the drive paths as the Storage names
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func simulatedLibraryCommand(args []string) error {
+	flags := flag.NewFlagSet("simlib", flag.ContinueOnError)
+	slots := flags.Int("slots", 10, "number of storage slots")
+	importExport := flags.Int("ie", 1, "number of import/export slots")
+	capacity := flags.Int64("capacity", tape.DefaultVirtualCapacity, "capacity of the virtual tapes in bytes")
+	barcodes := flags.String("tapes", "", "comma separated barcodes of the tapes placed in the first slots")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 3 {
+		return errors.New("usage: simlib [-slots n] [-ie n] [-capacity bytes] [-tapes barcode,...] <stateFile> <tapeDir> <drivePath>...")
+	}
+
+	library := &tape.SimulatedLibrary{
+		TapeDir:  flags.Arg(1),
+		Capacity: *capacity,
+	}
+	for _, drivePath := range flags.Args()[2:] {
+		library.Drives = append(library.Drives, tape.SimulatedDrive{Path: drivePath})
+	}
+	var tapes []string
+	if *barcodes != "" {
+		tapes = strings.Split(*barcodes, ",")
+	}
+	return tape.CreateSimulatedLibrary(flags.Arg(0), library, *slots, *importExport, tapes)
+}
+
+/**
+Description:
+	This function opens the catalog used by the backup and the commands. It is a variable so that another
+	implementation, eg memdb, can be put in its place
+*/
+var openCatalog = func() (pgdb.Catalog, error) {
+	catalog, err := pgdb.New()
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+/**
+Description:
+	This function converts the database section of the configuration file to the options pgdb.New uses
+*/
+func databaseOptions(database settings.Database) pgdb.Options {
+	return pgdb.Options{
+		Driver:          database.Driver,
+		Path:            database.Path,
+		DSN:             database.DSN,
+		CredentialsFile: database.CredentialsFile,
+		Host:            database.Host,
+		Port:            database.Port,
+		User:            database.User,
+		DBName:          database.DBName,
+		SSLMode:         database.SSLMode,
+		SSLRootCert:     database.SSLRootCert,
+		SSLCert:         database.SSLCert,
+		SSLKey:          database.SSLKey,
+		MaxOpenConns:    database.MaxOpenConns,
+		MaxIdleConns:    database.MaxIdleConns,
+		ConnMaxLifetime: database.ConnMaxLifetime,
+		ConnectTimeout:  database.ConnectTimeout,
+	}
+}
+
+/**
+Description:
+	This function is the entry point of the config command, which validates a configuration file
+		config check [-db] [path]
+	The path defaults to $BACKUPTEST_CONFIG, or backuptest.yaml. With -db the drives are also compared with
+	the Storage table
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func configCommand(args []string) error {
+	usage := errors.New("usage: config check [-db] [path]")
+	if len(args) == 0 || args[0] != "check" {
+		return usage
+	}
+	flags := flag.NewFlagSet("config check", flag.ContinueOnError)
+	checkDB := flags.Bool("db", false, "compare the drives with the Storage table")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return usage
+	}
+
+	configPath, explicit := settings.Path()
+	if flags.NArg() == 1 {
+		configPath, explicit = flags.Arg(0), true
+	}
+	loaded := settings.Default()
+	if _, err := os.Stat(configPath); os.IsNotExist(err) && !explicit {
+		fmt.Println(configPath + " doesn't exist, the defaults are used")
+	} else {
+		var err error
+		loaded, err = settings.LoadFile(configPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *checkDB {
+		catalog, err := openCatalog()
+		if err != nil {
+			return err
+		}
+		defer catalog.Close()
+		storages, err := catalog.GetStorages()
+		if err != nil {
+			return err
+		}
+
+		var problems []string
+		for i, drive := range loaded.Drives {
+			found := false
+			for _, storage := range storages {
+				if storage.Name != drive.Path {
+					continue
+				}
+				found = true
+				if storage.DriveNumber != drive.Number {
+					problems = append(problems, fmt.Sprintf("%s: drives[%d].number: %d but the Storage table has %d",
+						configPath, i, drive.Number, storage.DriveNumber))
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: drives[%d].path: %q is not in the Storage table",
+					configPath, i, drive.Path))
+			}
+		}
+		if len(problems) != 0 {
+			return errors.New(strings.Join(problems, "\n"))
+		}
+	}
+
+	fmt.Printf("%s: OK, %d drive(s), %d pool(s), %d pair(s), %d root(s), %d schedule(s)\n", configPath,
+		len(loaded.Drives), len(loaded.Pools), len(loaded.Pairs), len(loaded.Roots), len(loaded.Schedules))
+	return nil
+}
+
+/**
+Description:
+	This function is the entry point of the migrate command, which brings the DB schema up to date, or
+	copies a SQLite catalog to the configured pg server
+		migrate up
+		migrate status
+		migrate import <sqlite file>
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func migrateCommand(args []string) error {
+	if len(args) == 2 && args[0] == "import" {
+		return importSQLiteCatalog(args[1])
+	}
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		return errors.New("usage: migrate up|status|import <sqlite file>")
+	}
+
+	catalog, err := pgdb.Connect()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	if args[0] == "up" {
+		applied, err := catalog.MigrateUp()
+		for _, name := range applied {
+			fmt.Println("Applied migration " + name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Println("The schema is up to date")
+		}
+		return nil
+	}
+
+	statuses, err := catalog.MigrationStatus()
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		applied := "pending"
+		if status.Applied {
+			applied = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, applied)
+	}
+	return nil
+}
+
+/**
+Description:
+	This function is the entry point of the pathspec command, which sets the options of the PathSpec of a
+	directory
+		pathspec [-schedule name] -recursive=true|false <hdfsPath>
+	The job of a recursive directory covers its whole subtree, instead of there being a job for every
+	directory of the subtree. A directory the backup hasn't walked yet has no PathSpec, which is then added
+	with the given schedule
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func pathSpecCommand(args []string) error {
+	flags := flag.NewFlagSet("pathspec", flag.ContinueOnError)
+	schedule := flags.String("schedule", "", "the schedule of a directory that has no PathSpec yet")
+	recursive := flags.Bool("recursive", false, "back up the subtree of the directory as one job")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: pathspec [-schedule name] -recursive=true|false <hdfsPath>")
+	}
+	path := flags.Arg(0)
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	_, current, err := catalog.GetPathSpec(path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case current == "" && *schedule == "":
+		return errors.New(path + " has no PathSpec yet, please give its schedule with -schedule")
+	case current == "":
+		if !appSettings.HasSchedule(*schedule) {
+			return errors.New(*schedule + " is not one of the schedules of the configuration file")
+		}
+		if err := catalog.AddPathSpec(path, *schedule); err != nil {
+			return err
+		}
+		current = *schedule
+	case *schedule != "" && *schedule != current:
+		return errors.New(path + " already has the schedule " + current)
+	}
+
+	if err := catalog.SetPathSpecRecursive(path, *recursive); err != nil {
+		return err
+	}
+	fmt.Println(path, "schedule:", current, "recursive:", *recursive)
+	return nil
+}
+
+/**
+Description:
+	This function copies a SQLite catalog to the pg server of the configuration file, for a site that
+	outgrew SQLite. The pg server must be migrated up and empty; afterwards the configuration file is
+	switched to the postgres driver
+Parameters:
+	sqlitePath: The SQLite catalog file
+Return:
+	error: any error occured while execution, or nil
+*/
+func importSQLiteCatalog(sqlitePath string) error {
+	if pgdb.ConnOptions.Driver == pgdb.DriverSQLite {
+		return errors.New("The configured catalog is SQLite; set database.driver to postgres, and the " +
+			"connection settings of the pg server, before importing")
+	}
+	if _, err := os.Stat(sqlitePath); err != nil {
+		return err
+	}
+
+	source, err := pgdb.ConnectWith(pgdb.Options{Driver: pgdb.DriverSQLite, Path: sqlitePath, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	if err := source.CheckSchema(); err != nil {
+		return errors.New(err.Error() + "; the SQLite catalog " + sqlitePath + " must be migrated up first")
+	}
+
+	target, err := pgdb.New()
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	counts, err := source.CopyTo(target)
+	if err != nil {
+		return err
+	}
+	for _, count := range counts {
+		fmt.Printf("%-12s %d row(s)\n", count.Table, count.Rows)
+	}
+	fmt.Println("Imported " + sqlitePath)
+	return nil
+}
+
 /**
 Description:
 	This function is used to set the member variable of the bakup config struct
@@ -182,15 +568,35 @@ Retur:
 */
 func setupBackupConfig(config *backUpconfig, poolID string) error {
 	var err error
-	config.DB, err = pgdb.New()
+	config.DB, err = openCatalog()
 	if err != nil {
 		return err
 	}
-	config.Client, err = hdfs.New("us-lax-9a-ym-00:8020")
+	config.Client, err = openSource()
+	if err != nil {
+		return err
+	}
+	config.Changer, err = tape.NewChanger(appSettings.Changer.Device)
+	if err != nil {
+		return err
+	}
+	err = config.setUpTape(poolID, false)
+	if err != nil {
+		return err
+	}
+	_, tapeID, err := config.DB.GetTapeInfo(config.TapeConfig.TapePath)
+	if err != nil {
+		return err
+	}
+	if tapeID < 0 {
+		return errors.New("No tape of the DB is in drive " + config.TapeConfig.TapePath + ", please load a tape of pool " + poolID)
+	}
+	err = config.prepareTape(tapeID)
 	if err != nil {
 		return err
 	}
-	err = config.setUpTape(poolID)
+	// Jobs left In-Progress by a backup that died are recovered before new ones run
+	err = config.recoverOrphanedJobs(poolID)
 	if err != nil {
 		return err
 	}
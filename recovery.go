@@ -0,0 +1,162 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/testusr/BackUpTest/db"
+)
+
+/**
+Description:
+	This function recovers the jobs of a pool that were left In-Progress by a backup that died without
+	closing them, eg killed with -9 or by a power loss. A backup holds the drive of its pool open while it
+	runs, and the drive can't be opened twice: the st driver refuses the second open with EBUSY, and a
+	virtual tape is locked the same way. So the backup calling this is the only one of the pool, and every
+	In-Progress job of the pool is orphaned. What made it to the tape in the drive is checked:
+		- a file whose file mark was written is on tape
+		- a file after the last file mark is kept only if it can be read completely
+	Entries of files that aren't on tape are removed. A job with files left becomes Interrupted, and one
+	with nothing on tape is put back in the queue to run again.
+	Data after the last file mark is closed with a file mark so that the next file doesn't run into it,
+	whether or not a job was left In-Progress: a backup stopped by a signal closes its jobs as Interrupted,
+	but not the archive it was writing
+Parameter:
+	poolID: The pool whose jobs are recovered
+Return:
+	error: any error occured while execution, or nil
+*/
+func (config *backUpconfig) recoverOrphanedJobs(poolID string) error {
+	lastFileMark, danglingData, err := config.inspectEndOfData()
+	if err != nil {
+		return err
+	}
+	jobs, err := config.DB.GetJobsByState(poolID, pgdb.States.InProgress)
+	if err != nil {
+		return err
+	}
+	tapeID := -1
+	if len(jobs) > 0 {
+		_, tapeID, err = config.DB.GetTapeInfo(config.TapeConfig.TapePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, job := range jobs {
+		files, err := config.DB.GetFilesOfJob(job.ID)
+		if err != nil {
+			return err
+		}
+
+		kept := 0
+		for _, file := range files {
+			onTape := file.TapeID != tapeID || file.FileMarkNum < lastFileMark
+			if !onTape && file.FileMarkNum == lastFileMark && danglingData {
+				onTape, err = config.fileIsComplete(file)
+				if err != nil {
+					return err
+				}
+			}
+			if onTape {
+				kept++
+				continue
+			}
+			fmt.Println(poolID, file.Name, "didn't make it to tape, removing it from the catalog")
+			if err := config.DB.DeleteFile(file.ID); err != nil {
+				return err
+			}
+		}
+
+		if kept == 0 {
+			fmt.Println(poolID, job.Name, "was interrupted before writing to tape, requeuing it")
+			if err := config.DB.RequeueJob(job.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		fmt.Println(poolID, job.Name, "was interrupted after writing "+strconv.Itoa(kept)+" file(s)")
+		var duration time.Duration
+		if job.DurationInMinutes.Valid {
+			duration = time.Duration(job.DurationInMinutes.Int64) * time.Minute
+		}
+		err = config.DB.UpdateJob(job.ID, job.Name, job.StartTime.Time, duration, kept, pgdb.States.Interrupted, job.PoolID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The partial file is closed, so that the next file starts after a file mark
+	if danglingData {
+		if err := config.TapeConfig.JumpToEOM(); err != nil {
+			return err
+		}
+		if err := config.TapeConfig.WriteEOF(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Description:
+	This function finds the end of the data on the tape in the drive
+Return:
+	int: The number of file marks on the tape; a file written after the last one has this file mark number
+	bool: Whether there is data after the last file mark, which is a file whose file mark was never written
+	error if any
+*/
+func (config *backUpconfig) inspectEndOfData() (int, bool, error) {
+	if err := config.TapeConfig.JumpToEOM(); err != nil {
+		return -1, false, err
+	}
+	lastFileMark := config.TapeConfig.GetFileMarkNum()
+	if err := config.TapeConfig.SpaceToFileMark(lastFileMark); err != nil {
+		return -1, false, err
+	}
+	// Drives report the end of data as an error or as an empty read; either way nothing was read
+	n, _ := config.TapeConfig.NewReader().Read(make([]byte, 1))
+	return lastFileMark, n > 0, nil
+}
+
+/**
+Description:
+	This function checks that a file after the last file mark of the tape was written completely
+Parameter:
+	file: The catalog entry of the file
+Return:
+	bool: Whether the file can be read to its end from its tar archive
+	error if the tape can't be positioned
+*/
+func (config *backUpconfig) fileIsComplete(file pgdb.File) (bool, error) {
+	reader, err := config.TapeConfig.NewArchiveReader(file.FileMarkNum)
+	if err != nil {
+		return false, err
+	}
+	// The archive has many members; the file is at its offset, or is looked up by name when the offset
+	// isn't known
+	if file.Offset > 0 {
+		if err := reader.SkipTo(file.Offset); err != nil {
+			return false, nil
+		}
+	}
+	tr := tar.NewReader(reader)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			return false, nil
+		}
+		if header.Name != file.Name {
+			continue
+		}
+		if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+			return false, nil
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,711 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/colinmarc/hdfs"
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+// Layouts accepted by the -at option of the restore command, interpreted in UTC
+var restoreTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// restoreArchive represents one tar archive on tape, together with the entries that need to be
+// extracted from it
+type restoreArchive struct {
+	Tape        *pgdb.Tape
+	FileMarkNum int
+	Files       map[string]pgdb.File
+}
+
+// restoreSpan is a file continued on other tapes, restored by reading its segments in order, one tape
+// after the other
+type restoreSpan struct {
+	File     pgdb.File
+	Segments []pgdb.FileSegment
+	// Tapes are the tapes of the segments
+	Tapes []*pgdb.Tape
+}
+
+// spanReader reads the content of a restoreSpan, moving on to the next segment at the end of each one
+type spanReader struct {
+	session *restoreSession
+	span    *restoreSpan
+	// segment is the segment being read, content its content left to read
+	segment int
+	content io.Reader
+}
+
+// restoreSession holds the drives opened while restoring; a drive is opened for every pool whose tapes
+// are read
+type restoreSession struct {
+	DB       pgdb.Catalog
+	conflict string
+	drives   map[int]*backUpconfig
+}
+
+/**
+Description:
+	This function is the entry point of the restore command
+		restore [options] <hdfsPath> [destination]
+			restores the latest copy of a single file; the destination defaults to "-", which streams
+			the file to stdout
+		restore -dir [options] [-at time] <hdfsPath> <localDirectory>
+			restores every file of the directory (Job) as it was at the given time, which defaults to now,
+			below the local directory
+	With -hdfs the files are restored back into hdfs instead, at their original path or below the prefix
+	given by -relocate
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	poolID := flags.String("pool", "", "restore the copies written to this pool instead of the latest copies")
+	dir := flags.Bool("dir", false, "restore every file of the directory")
+	at := flags.String("at", "", "restore the directory as it was at this time (UTC)")
+	toHDFS := flags.Bool("hdfs", false, "restore back into hdfs")
+	relocate := flags.String("relocate", "", "hdfs directory the restored paths are placed below")
+	conflict := flags.String("conflict", conflictPolicies.Rename,
+		"what to do with files that already exist: overwrite, skip or rename")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || (*dir && !*toHDFS && flags.NArg() < 2) || !validConflictPolicy(*conflict) {
+		return errors.New(`usage: restore [-pool poolID] [-conflict overwrite|skip|rename] <hdfsPath> [destination]
+	restore -dir [-pool poolID] [-conflict overwrite|skip|rename] [-at time] <hdfsPath> <localDirectory>
+	restore [-dir] [-pool poolID] [-conflict overwrite|skip|rename] [-at time] -hdfs [-relocate prefix] <hdfsPath>`)
+	}
+	name := flags.Arg(0)
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	session := &restoreSession{
+		DB:       catalog,
+		conflict: *conflict,
+		drives:   make(map[int]*backUpconfig),
+	}
+	defer session.closeAll()
+
+	var files []pgdb.File
+	if *dir {
+		asOf, err := parseRestoreTime(*at)
+		if err != nil {
+			return err
+		}
+		files, err = directoryFilesAsOf(catalog, name, *poolID, asOf)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.New(name + " has no complete backup at or before " + asOf.String())
+		}
+	} else {
+		file, err := catalog.GetLatestFile(name, *poolID)
+		if err != nil {
+			return err
+		}
+		if file == nil {
+			return errors.New(name + " has not been backed up")
+		}
+		files = []pgdb.File{*file}
+	}
+
+	var target restoreTarget
+	switch {
+	case *toHDFS:
+		client, err := hdfs.New(appSettings.HDFSAddress())
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		target = &hdfsTarget{client: client, prefix: *relocate}
+	case *dir:
+		target = &localTarget{root: flags.Arg(1)}
+	default:
+		dest := "-"
+		if flags.NArg() > 1 {
+			dest = flags.Arg(1)
+		}
+		target = &fileTarget{dest: dest}
+	}
+
+	return session.restore(files, target)
+}
+
+/**
+Description:
+	This function parses the value of the -at option
+Parameter:
+	value: The option value, "" meaning now
+Return:
+	time.Time: The point in time in UTC
+	error if the value is not in one of the restoreTimeLayouts
+*/
+func parseRestoreTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Now().In(time.UTC), nil
+	}
+	for _, layout := range restoreTimeLayouts {
+		asOf, err := time.ParseInLocation(layout, value, time.UTC)
+		if err == nil {
+			return asOf.In(time.UTC), nil
+		}
+	}
+	return time.Time{}, errors.New("Invalid time " + value + ", expected format like 2006-01-02 15:04:05")
+}
+
+/**
+Description:
+	This function finds the files of a directory as it was at a point in time. A directory inside the subtree
+	of a recursive job has no job of its own, so its files are then taken from the job of the nearest
+	directory above it that has one
+Parameter:
+	catalog: The catalog the files are looked up in
+	name: The hdfs path of the directory
+	poolID: The pool whose copies are restored, "" for any pool
+	asOf: The point in time
+Return:
+	[]pgdb.File: The files of the directory, none if it had no complete backup at that time
+	error if any
+*/
+func directoryFilesAsOf(catalog pgdb.Catalog, name string, poolID string, asOf time.Time) ([]pgdb.File, error) {
+	name = path.Clean(name)
+	for dir := name; ; dir = path.Dir(dir) {
+		files, err := catalog.GetFilesAsOf(dir, poolID, asOf)
+		if err != nil {
+			return nil, err
+		}
+		var found []pgdb.File
+		for _, file := range files {
+			if dir == name || strings.HasPrefix(file.Name, name+"/") {
+				found = append(found, file)
+			}
+		}
+		if len(found) > 0 || dir == "/" || dir == "." {
+			return found, nil
+		}
+	}
+}
+
+/**
+Description:
+	This function restores the files sent as parameter. The files are grouped by the tape archive that has
+	them, and the archives are read tape by tape in file mark order, so that every tape is loaded once
+	and never read backwards. The files continued on other tapes are restored after them, each reading its
+	tapes in turn
+Parameter:
+	files: The catalog entries of the files being restored
+	target: Where the restored files are written
+Return:
+	error if any
+*/
+func (session *restoreSession) restore(files []pgdb.File, target restoreTarget) error {
+	archives, spans, err := session.planRestore(files)
+	if err != nil {
+		return err
+	}
+
+	for _, archive := range archives {
+		drive, err := session.drive(archive.Tape.PoolID)
+		if err != nil {
+			return err
+		}
+		if err := drive.restoreArchive(archive, target, session.conflict); err != nil {
+			return err
+		}
+	}
+
+	for _, span := range spans {
+		if err := session.restoreSpan(span, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Description:
+	This function works out which tapes and archives are needed to restore the files, and in which order
+	they need to be read. Tapes that are already in a drive come first, so the minimal number of tape
+	changes is done
+Parameter:
+	files: The catalog entries of the files being restored
+Return:
+	[]*restoreArchive: The archives in the order they need to be read
+	[]*restoreSpan: The files continued on other tapes
+	error if any
+*/
+func (session *restoreSession) planRestore(files []pgdb.File) ([]*restoreArchive, []*restoreSpan, error) {
+	tapes := make(map[int]*pgdb.Tape)
+	getTape := func(tapeID int) (*pgdb.Tape, error) {
+		tapeInfo, found := tapes[tapeID]
+		if !found {
+			var err error
+			tapeInfo, err = session.DB.GetTape(tapeID)
+			if err != nil {
+				return nil, err
+			}
+			tapes[tapeID] = tapeInfo
+		}
+		return tapeInfo, nil
+	}
+	archives := make(map[string]*restoreArchive)
+	var ordered []*restoreArchive
+	var spans []*restoreSpan
+
+	for _, file := range files {
+		tapeInfo, err := getTape(file.TapeID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := checkNotInvalid(file.Name, tapeInfo, file.FileMarkNum, file.Offset); err != nil {
+			return nil, nil, err
+		}
+
+		if file.Segments > 0 {
+			continued, err := session.DB.GetFileSegments(file.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+			span := &restoreSpan{
+				File:     file,
+				Segments: []pgdb.FileSegment{{TapeID: file.TapeID, FileMarkNum: file.FileMarkNum, Offset: file.Offset}},
+				Tapes:    []*pgdb.Tape{tapeInfo},
+			}
+			for _, segment := range continued {
+				segmentTape, err := getTape(segment.TapeID)
+				if err != nil {
+					return nil, nil, err
+				}
+				if err := checkNotInvalid(file.Name, segmentTape, segment.FileMarkNum, segment.Offset); err != nil {
+					return nil, nil, err
+				}
+				span.Segments = append(span.Segments, segment)
+				span.Tapes = append(span.Tapes, segmentTape)
+			}
+			spans = append(spans, span)
+			continue
+		}
+
+		key := strconv.Itoa(file.TapeID) + ":" + strconv.Itoa(file.FileMarkNum)
+		archive, found := archives[key]
+		if !found {
+			archive = &restoreArchive{
+				Tape:        tapeInfo,
+				FileMarkNum: file.FileMarkNum,
+				Files:       make(map[string]pgdb.File),
+			}
+			archives[key] = archive
+			ordered = append(ordered, archive)
+		}
+		archive.Files[file.Name] = file
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.Tape.ID != b.Tape.ID {
+			if (a.Tape.SlotNumber == 0) != (b.Tape.SlotNumber == 0) {
+				return a.Tape.SlotNumber == 0
+			}
+			return a.Tape.Name < b.Tape.Name
+		}
+		return a.FileMarkNum < b.FileMarkNum
+	})
+
+	fmt.Fprintln(os.Stderr, "Tapes needed for the restore:")
+	listed := make(map[int]bool)
+	list := func(tapeInfo *pgdb.Tape) {
+		if !listed[tapeInfo.ID] {
+			listed[tapeInfo.ID] = true
+			fmt.Fprintln(os.Stderr, "\t"+tapeInfo.Name)
+		}
+	}
+	for _, archive := range ordered {
+		list(archive.Tape)
+	}
+	for _, span := range spans {
+		for _, tapeInfo := range span.Tapes {
+			list(tapeInfo)
+		}
+	}
+
+	return ordered, spans, nil
+}
+
+/**
+Description:
+	This function checks that a file doesn't start in the invalid tail of a tape, the data that was being
+	written when the tape filled up and was written again on the next tape
+Parameter:
+	name: The name of the file
+	tapeInfo: The tape the file is on
+	fileMarkNum, offset: Where the tar header of the file is on the tape
+Return:
+	error if the file is in the invalid tail
+*/
+func checkNotInvalid(name string, tapeInfo *pgdb.Tape, fileMarkNum int, offset int64) error {
+	if !inInvalidTail(tapeInfo, fileMarkNum, offset) {
+		return nil
+	}
+	return errors.New(name + " is at offset " + strconv.FormatInt(offset, 10) + " of file mark " +
+		strconv.Itoa(fileMarkNum) + " of tape " + tapeInfo.Name + ", in what was cut off by the end of the tape")
+}
+
+// inInvalidTail reports whether a tar header at offset of the archive at fileMarkNum is in the invalid tail of
+// the tape. The archive that was cut is closed by a file mark, so what follows it was written on purpose
+func inInvalidTail(tapeInfo *pgdb.Tape, fileMarkNum int, offset int64) bool {
+	return tapeInfo.InvalidFileMark >= 0 && fileMarkNum == tapeInfo.InvalidFileMark && offset >= tapeInfo.InvalidOffset
+}
+
+/**
+Description:
+	This function returns the drive used to read the tapes of a pool, opening it on first use
+Parameter:
+	poolID: The pool whose drive is needed
+Return:
+	*backUpconfig: The config of the pool's drive
+	error if any
+*/
+func (session *restoreSession) drive(poolID int) (*backUpconfig, error) {
+	if drive, found := session.drives[poolID]; found {
+		return drive, nil
+	}
+	drive := new(backUpconfig)
+	if err := setupRestoreConfig(drive, strconv.Itoa(poolID)); err != nil {
+		drive.closeAll()
+		return nil, err
+	}
+	session.drives[poolID] = drive
+	return drive, nil
+}
+
+/**
+Description:
+	This function is used to close the drives opened by the session
+*/
+func (session *restoreSession) closeAll() {
+	for _, drive := range session.drives {
+		drive.closeAll()
+	}
+}
+
+/**
+Description:
+	This function is used to set up the resources a restore needs; unlike setupBackupConfig it doesn't
+	connect to hdfs, so that restores are possible while hdfs is unavailable
+Parameter:
+	config: The backup config struct whose member that needs set up
+	poolID: PoolID whose drive will be used to read the tapes
+Return:
+	Error if any
+*/
+func setupRestoreConfig(config *backUpconfig, poolID string) error {
+	var err error
+	config.DB, err = openCatalog()
+	if err != nil {
+		return err
+	}
+	config.Changer, err = tape.NewChanger(appSettings.Changer.Device)
+	if err != nil {
+		return err
+	}
+	// Restores and scans only read, which is also what a write protected tape allows
+	err = config.setUpTape(poolID, true)
+	if err != nil {
+		return err
+	}
+	config.syncTapeChange = &sync.Mutex{}
+
+	return nil
+}
+
+/**
+Description:
+	This function reads one tar archive back from tape: it loads the tape the archive was written to, spaces
+	forward to the recorded file mark and extracts the wanted entries of the archive. The entries are read
+	in the order of their offsets in the archive, skipping the records in between; files cataloged before
+	offsets were recorded are looked up by reading the archive from its start instead
+Parameter:
+	archive: The archive and the entries that need to be extracted from it
+	target: Where the entries are written
+	conflict: What to do when a restored file already exists, one of conflictPolicies
+Return:
+	error if any
+*/
+func (config *backUpconfig) restoreArchive(archive *restoreArchive, target restoreTarget, conflict string) error {
+	if err := config.mountTape(archive.Tape); err != nil {
+		return err
+	}
+
+	reader, err := config.TapeConfig.NewArchiveReader(archive.FileMarkNum)
+	if err != nil {
+		return err
+	}
+
+	var files []pgdb.File
+	for _, file := range archive.Files {
+		if file.Offset < 0 {
+			return config.scanArchive(archive, reader, target, conflict)
+		}
+		files = append(files, file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Offset < files[j].Offset })
+
+	for _, file := range files {
+		if err := reader.SkipTo(file.Offset); err != nil {
+			return errors.New(err.Error() + "; couldn't reach " + file.Name + " at file mark " +
+				strconv.Itoa(archive.FileMarkNum) + " of tape " + archive.Tape.Name)
+		}
+		tr := tar.NewReader(reader)
+		header, err := tr.Next()
+		if err != nil || header.Name != file.Name {
+			return errors.New(file.Name + " was not found at offset " + strconv.FormatInt(file.Offset, 10) +
+				" of file mark " + strconv.Itoa(archive.FileMarkNum) + " of tape " + archive.Tape.Name)
+		}
+		if err := restoreEntry(target, conflict, header, tr, file.Checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Description:
+	This function restores a file continued on other tapes. Its content is read segment by segment,
+	loading the tape of each segment in turn
+Parameter:
+	span: The file and its segments
+	target: Where the file is written
+Return:
+	error if any
+*/
+func (session *restoreSession) restoreSpan(span *restoreSpan, target restoreTarget) error {
+	reader := &spanReader{session: session, span: span}
+	// The header of the first segment has the size of the whole file
+	header, err := reader.open(0)
+	if err != nil {
+		return err
+	}
+	return restoreEntry(target, session.conflict, header, reader, span.File.Checksum)
+}
+
+/**
+Description:
+	This method positions the tape at the tar entry of a segment of the file
+Parameter:
+	segment: The index of the segment
+Return:
+	*tar.Header: The tar header of the segment
+	error if the entry isn't the expected segment of the file
+*/
+func (reader *spanReader) open(segment int) (*tar.Header, error) {
+	span := reader.span
+	position := span.Segments[segment]
+	tapeInfo := span.Tapes[segment]
+	where := " at offset " + strconv.FormatInt(position.Offset, 10) + " of file mark " +
+		strconv.Itoa(position.FileMarkNum) + " of tape " + tapeInfo.Name
+
+	config, err := reader.session.drive(tapeInfo.PoolID)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.mountTape(tapeInfo); err != nil {
+		return nil, err
+	}
+	archive, err := config.TapeConfig.NewArchiveReader(position.FileMarkNum)
+	if err != nil {
+		return nil, err
+	}
+	if err := archive.SkipTo(position.Offset); err != nil {
+		return nil, errors.New(err.Error() + "; couldn't reach " + span.File.Name + where)
+	}
+	tr := tar.NewReader(archive)
+	header, err := tr.Next()
+	if err != nil || header.Name != span.File.Name {
+		return nil, errors.New(span.File.Name + " was not found" + where)
+	}
+	if segment > 0 {
+		recorded, err := tape.ParseSegments(header)
+		if err != nil {
+			return nil, err
+		}
+		if len(recorded) == 0 || recorded[len(recorded)-1].FileOffset != position.FileOffset {
+			return nil, errors.New("The entry of " + span.File.Name + where + " isn't the segment starting at " +
+				strconv.FormatInt(position.FileOffset, 10) + " of the file")
+		}
+	}
+
+	// Only the part of the content that comes before the next segment made it to the tape
+	reader.segment, reader.content = segment, tr
+	if segment+1 < len(span.Segments) {
+		reader.content = io.LimitReader(tr, span.Segments[segment+1].FileOffset-position.FileOffset)
+	}
+	return header, nil
+}
+
+// Read reads the content of the segments in turn
+func (reader *spanReader) Read(p []byte) (int, error) {
+	for {
+		n, err := reader.content.Read(p)
+		if err != io.EOF || reader.segment+1 == len(reader.span.Segments) {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+		if _, err := reader.open(reader.segment + 1); err != nil {
+			return 0, err
+		}
+	}
+}
+
+/**
+Description:
+	This function reads a tar archive from its start, and extracts the wanted entries of it
+Parameter:
+	archive: The archive and the entries that need to be extracted from it
+	reader: The reader of the archive, at its start
+	target: Where the entries are written
+	conflict: What to do when a restored file already exists, one of conflictPolicies
+Return:
+	error if any
+*/
+func (config *backUpconfig) scanArchive(archive *restoreArchive, reader io.Reader, target restoreTarget, conflict string) error {
+	remaining := len(archive.Files)
+	tr := tar.NewReader(reader)
+	for remaining > 0 {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		file, found := archive.Files[header.Name]
+		if !found {
+			continue
+		}
+		if err := restoreEntry(target, conflict, header, tr, file.Checksum); err != nil {
+			return err
+		}
+		remaining--
+	}
+
+	if remaining > 0 {
+		return errors.New(strconv.Itoa(remaining) + " file(s) were not found at file mark " +
+			strconv.Itoa(archive.FileMarkNum) + " of tape " + archive.Tape.Name)
+	}
+	return nil
+}
+
+/**
+Description:
+	This function makes sure the tape sent as parameter is in the drive of this config. If another tape is
+	loaded, it is moved to an empty slot first. Unlike changeTape, the tapes keep their isfull flag,
+	because nothing is being written.
+Parameter:
+	want: The tape that needs to be in the drive
+Return:
+	error if any
+*/
+func (config *backUpconfig) mountTape(want *pgdb.Tape) error {
+
+	// Only one thread can use the scsi generic file at a time
+	config.syncTapeChange.Lock()
+	defer config.syncTapeChange.Unlock()
+
+	driveNum, tapeID, err := config.DB.GetTapeInfo(config.TapeConfig.TapePath)
+	if err != nil {
+		return err
+	}
+	if tapeID == want.ID {
+		return nil
+	}
+
+	// The library, not the DB, tells where the tape is
+	inventory, err := tape.GetInventory(config.Changer)
+	if err != nil {
+		return err
+	}
+	if drive := inventory.FindDrive(want.Name); drive != nil {
+		if drive.Number != driveNum {
+			return errors.New("Tape " + want.Name + " is loaded in another drive")
+		}
+		// The tape is already in this drive, only the DB didn't know
+		return config.DB.LoadTape(config.TapeConfig.TapePath, want.ID, false)
+	}
+	fromSlot := inventory.FindSlot(want.Name)
+	if fromSlot == nil {
+		return errors.New("Tape " + want.Name + " is not in the tape library")
+	}
+
+	if err := config.TapeConfig.CloseTape(); err != nil {
+		return err
+	}
+
+	// A drive whose tape isn't in the DB has no tapeid; the library tells whether it holds a tape anyway
+	loaded := tapeID >= 0
+	for _, drive := range inventory.Drives {
+		if drive.Number == driveNum {
+			loaded = drive.Loaded
+		}
+	}
+	if loaded {
+		unloadTo, err := inventory.EmptySlot()
+		if err != nil {
+			return err
+		}
+		if err := config.Changer.Unload(driveNum, unloadTo); err != nil {
+			return err
+		}
+		if tapeID >= 0 {
+			if err := config.DB.UnloadTape(config.TapeConfig.TapePath, tapeID, unloadTo, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := config.Changer.Load(driveNum, fromSlot.Number); err != nil {
+		return err
+	}
+	if err := config.TapeConfig.DeepCopy(config.TapeConfig.TapePath); err != nil {
+		return err
+	}
+
+	// Tapes written before labels were introduced have none, so only a label of another tape is an error
+	label, err := config.TapeConfig.ReadLabel()
+	if err != nil && err != tape.ErrNoLabel {
+		return err
+	}
+	if label != nil && label.TapeName != want.Name {
+		return errors.New("Wrong tape in drive " + config.TapeConfig.TapePath + ": expected " + want.Name +
+			" but the volume label is " + label.TapeName)
+	}
+
+	// A tape loaded for a restore keeps its state, it is usually full
+	if err := config.DB.LoadTape(config.TapeConfig.TapePath, want.ID, false); err != nil {
+		return err
+	}
+
+	// Keep the session's view of the tapes up to date
+	want.SlotNumber = 0
+	return nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/colinmarc/hdfs"
+)
+
+// The policies accepted by the -conflict option of the restore command
+var conflictPolicies = struct {
+	Overwrite string
+	Skip      string
+	Rename    string
+}{
+	Overwrite: "overwrite",
+	Skip:      "skip",
+	Rename:    "rename",
+}
+
+// The suffix added to the name of a restored file when the rename policy is used
+var renameSuffix = ".restored"
+
+// The suffix of the temporary file a restored entry is written to, before it is moved to its destination
+var partialSuffix = ".partial"
+
+// restoreTarget is a destination where restored entries are written
+type restoreTarget interface {
+	// destination returns the path where the entry backed up from the hdfs path "name" is restored
+	destination(name string) string
+	// exists reports whether something is already present at the path
+	exists(path string) (bool, error)
+	// remove deletes what is present at the path
+	remove(path string) error
+	// partial returns the temporary path the entry restored to the path is written to first, which is the
+	// path itself when it can't be moved afterwards
+	partial(path string) string
+	// rename moves what is at oldpath to newpath, replacing what is there
+	rename(oldpath string, newpath string) error
+	// write creates the file at the path with the content, and restores the mode and modification
+	// time recorded in the tar header
+	write(path string, header *tar.Header, content io.Reader) error
+}
+
+// fileTarget writes the single restored entry to a local path, or to stdout when the path is "-"
+type fileTarget struct {
+	dest string
+}
+
+// localTarget writes every restored entry below a local directory, keeping its hdfs path
+type localTarget struct {
+	root string
+}
+
+// hdfsTarget writes every restored entry back into hdfs, at its original path or below a relocated prefix
+type hdfsTarget struct {
+	client *hdfs.Client
+	prefix string
+}
+
+/**
+Description:
+	This function checks whether the value of the -conflict option is one of the conflictPolicies
+*/
+func validConflictPolicy(policy string) bool {
+	return policy == conflictPolicies.Overwrite || policy == conflictPolicies.Skip || policy == conflictPolicies.Rename
+}
+
+/**
+Description:
+	This function writes one restored entry to the target, applying the conflict policy when the
+	destination already exists, and checks the content written against the checksum recorded when the
+	file was backed up. The content goes to a temporary file that replaces the destination only once it
+	was read completely and matches the checksum, so a failed restore never destroys an existing file
+Parameters:
+	target: Where the entry is written
+	conflict: One of the conflictPolicies
+	header: The tar header of the entry
+	content: The reader positioned at the content of the entry
+	checksum: The hex SHA-256 of the content, "" when it isn't known
+Return:
+	error: any error occured while execution, or nil
+*/
+func restoreEntry(target restoreTarget, conflict string, header *tar.Header, content io.Reader, checksum string) error {
+	dest := target.destination(header.Name)
+
+	exists, err := target.exists(dest)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		switch conflict {
+		case conflictPolicies.Skip:
+			return nil
+		case conflictPolicies.Overwrite:
+			// The existing file is replaced by the rename below
+		case conflictPolicies.Rename:
+			dest, err = renamedDestination(target, dest)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("Unknown conflict policy " + conflict)
+		}
+	}
+
+	// A temporary file left by a previous restore that failed is written again
+	partial := target.partial(dest)
+	if partial != dest {
+		leftover, err := target.exists(partial)
+		if err != nil {
+			return err
+		}
+		if leftover {
+			if err := target.remove(partial); err != nil {
+				return err
+			}
+		}
+	}
+
+	restored := sha256.New()
+	if err := target.write(partial, header, io.TeeReader(content, restored)); err != nil {
+		if partial != dest {
+			target.remove(partial)
+		}
+		return err
+	}
+	if checksum != "" && hex.EncodeToString(restored.Sum(nil)) != checksum {
+		if partial != dest {
+			target.remove(partial)
+		}
+		return errors.New("The content of " + header.Name + " restored to " + dest +
+			" doesn't match the checksum recorded when it was backed up")
+	}
+	if partial == dest {
+		return nil
+	}
+	return target.rename(partial, dest)
+}
+
+/**
+Description:
+	This function finds a free path next to an existing one by adding renameSuffix, and a counter if
+	that is also taken
+Return:
+	string: The free path
+	error if any
+*/
+func renamedDestination(target restoreTarget, dest string) (string, error) {
+	renamed := dest + renameSuffix
+	for i := 1; ; i++ {
+		exists, err := target.exists(renamed)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return renamed, nil
+		}
+		renamed = dest + renameSuffix + "." + strconv.Itoa(i)
+	}
+}
+
+func (target *fileTarget) destination(name string) string {
+	return target.dest
+}
+
+func (target *fileTarget) exists(dest string) (bool, error) {
+	if dest == "-" {
+		return false, nil
+	}
+	return localExists(dest)
+}
+
+func (target *fileTarget) remove(dest string) error {
+	return os.Remove(dest)
+}
+
+// partial returns dest for stdout, which is written as the content is read
+func (target *fileTarget) partial(dest string) string {
+	if dest == "-" {
+		return dest
+	}
+	return dest + partialSuffix
+}
+
+func (target *fileTarget) rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (target *fileTarget) write(dest string, header *tar.Header, content io.Reader) error {
+	if dest == "-" {
+		_, err := io.Copy(os.Stdout, content)
+		return err
+	}
+	return writeLocalFile(dest, header, content)
+}
+
+func (target *localTarget) destination(name string) string {
+	return filepath.Join(target.root, filepath.FromSlash(name))
+}
+
+func (target *localTarget) exists(dest string) (bool, error) {
+	return localExists(dest)
+}
+
+func (target *localTarget) remove(dest string) error {
+	return os.Remove(dest)
+}
+
+func (target *localTarget) partial(dest string) string {
+	return dest + partialSuffix
+}
+
+func (target *localTarget) rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (target *localTarget) write(dest string, header *tar.Header, content io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return writeLocalFile(dest, header, content)
+}
+
+func (target *hdfsTarget) destination(name string) string {
+	if target.prefix == "" {
+		return name
+	}
+	return path.Join(target.prefix, name)
+}
+
+func (target *hdfsTarget) exists(dest string) (bool, error) {
+	_, err := target.client.Stat(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (target *hdfsTarget) remove(dest string) error {
+	return target.client.Remove(dest)
+}
+
+func (target *hdfsTarget) partial(dest string) string {
+	return dest + partialSuffix
+}
+
+// rename replaces an existing file at newpath, since the namenode is asked to overwrite the destination
+func (target *hdfsTarget) rename(oldpath string, newpath string) error {
+	return target.client.Rename(oldpath, newpath)
+}
+
+func (target *hdfsTarget) write(dest string, header *tar.Header, content io.Reader) error {
+	if err := target.client.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	writer, err := target.client.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(writer, content); err != nil {
+		writer.Close()
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	if err := target.client.Chmod(dest, os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	return target.client.Chtimes(dest, header.ModTime, header.ModTime)
+}
+
+/**
+Description:
+	This function checks whether a local path exists
+*/
+func localExists(dest string) (bool, error) {
+	_, err := os.Lstat(dest)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/**
+Description:
+	This function writes the content of a tar entry to a local file, restoring the mode and modification
+	time recorded in the tar header
+Parameter:
+	dest: The local path of the file
+	header: The tar header of the entry
+	content: The reader positioned at the content of the entry
+Return:
+	error if any
+*/
+func writeLocalFile(dest string, header *tar.Header, content io.Reader) error {
+	restored, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(restored, content); err != nil {
+		restored.Close()
+		return err
+	}
+	if err := restored.Close(); err != nil {
+		return err
+	}
+
+	// The mode is set again, since the one given to OpenFile is masked by the umask
+	if err := os.Chmod(dest, os.FileMode(header.Mode).Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, header.ModTime, header.ModTime)
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+// scannedJob is the job that the files found while scanning a tape are added to
+type scannedJob struct {
+	ID         int
+	Name       string
+	PoolID     int
+	StartTime  time.Time
+	NumOfFiles int
+	// EndTime is when the job ended, from its trailer; zero when the trailer wasn't read
+	EndTime time.Time
+	// existing is true when the job was already in the catalog
+	existing bool
+	// fromHeader is true when the name and start time of the job come from a job header on tape
+	fromHeader bool
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.count += int64(n)
+	return n, err
+}
+
+/**
+Description:
+	This function is the entry point of the scan command, which rebuilds the catalog from what is on tape
+		scan <tapeName>...
+		scan -pool <poolID>
+	Every file mark of the tapes is read, and the Job, File and JobTapeMap entries of the files found are
+	added to the DB. Files already in the catalog are left alone, so a scan can be repeated
+Parameters:
+	args: The command line arguments following the command name
+Return:
+	error: any error occured while execution, or nil
+*/
+func scanCommand(args []string) error {
+	flags := flag.NewFlagSet("scan", flag.ContinueOnError)
+	poolID := flags.Int("pool", -1, "scan every tape of the pool")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if (*poolID < 0) == (flags.NArg() == 0) {
+		return errors.New("usage: scan <tapeName>...\n\tscan -pool <poolID>")
+	}
+
+	catalog, err := openCatalog()
+	if err != nil {
+		return err
+	}
+	defer catalog.Close()
+
+	var tapes []pgdb.Tape
+	if *poolID >= 0 {
+		allTapes, err := catalog.GetTapes()
+		if err != nil {
+			return err
+		}
+		for _, tapeInfo := range allTapes {
+			if tapeInfo.PoolID == *poolID {
+				tapes = append(tapes, tapeInfo)
+			}
+		}
+	} else {
+		for _, name := range flags.Args() {
+			tapeInfo, err := catalog.GetTapeByName(name)
+			if err != nil {
+				return err
+			}
+			if tapeInfo == nil {
+				return errors.New("Tape " + name + " is not in the Tape table, please add it before scanning")
+			}
+			tapes = append(tapes, *tapeInfo)
+		}
+	}
+
+	session := &restoreSession{
+		DB:     catalog,
+		drives: make(map[int]*backUpconfig),
+	}
+	defer session.closeAll()
+
+	for i := range tapes {
+		drive, err := session.drive(tapes[i].PoolID)
+		if err != nil {
+			return err
+		}
+		if err := drive.scanTape(&tapes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Description:
+	This function reads a tape file mark by file mark, and adds every file found in the tar archives to the
+	catalog. The files following a job header become one Complete job with the name and start time of the
+	header. Files written before job headers were introduced are grouped by directory instead, and the
+	newest modification time of the files is used as start time, since the time of the backup isn't on tape
+Parameter:
+	tapeInfo: The tape being scanned
+Return:
+	error if any
+*/
+func (config *backUpconfig) scanTape(tapeInfo *pgdb.Tape) error {
+	if err := config.mountTape(tapeInfo); err != nil {
+		return err
+	}
+	if err := config.TapeConfig.Rewind(); err != nil {
+		return err
+	}
+
+	var job *scannedJob
+	// The job header read last, which describes the files that follow it
+	var jobHeader *tape.JobRecord
+
+	for fileMarkNum := 0; ; fileMarkNum++ {
+		reader := config.TapeConfig.NewReader()
+		counter := &countingReader{reader: reader}
+		tr := tar.NewReader(counter)
+
+		damaged := false
+		// The offset where the next entry of the archive starts: after the content of the previous one,
+		// padded to a tar block
+		next := int64(0)
+		for {
+			offset := next
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fmt.Println(tapeInfo.Name, fileMarkNum, "unreadable tar archive:", err)
+				damaged = true
+				break
+			}
+			next = counter.count + (header.Size+511)/512*512
+
+			if tape.IsRecordEntry(header.Name) {
+				job, jobHeader, err = config.scanRecord(job, header, tr, tapeInfo)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Nothing is cataloged from what was cut off by the end of the tape
+			if inInvalidTail(tapeInfo, fileMarkNum, offset) {
+				fmt.Println(tapeInfo.Name, fileMarkNum, header.Name, "was cut off by the end of the tape, skipping it")
+				continue
+			}
+
+			// Only files whose content can be read completely are added to the catalog
+			checksum := sha256.New()
+			if _, err := io.Copy(checksum, tr); err != nil {
+				fmt.Println(tapeInfo.Name, fileMarkNum, header.Name, "is incomplete:", err)
+				damaged = true
+				break
+			}
+
+			// A file continued from other tapes is added with the segments recorded in its header
+			segments, err := config.scannedSegments(header, tapeInfo, fileMarkNum, offset)
+			if err != nil {
+				return err
+			}
+			if segments == nil {
+				continue
+			}
+			job, err = config.catalogScannedFile(job, jobHeader, header, tapeInfo, segments, hex.EncodeToString(checksum.Sum(nil)))
+			if err != nil {
+				return err
+			}
+		}
+
+		// A file with no data at all means the end of the data on tape, an empty archive still has its
+		// end-of-archive blocks
+		if counter.count == 0 && !damaged {
+			break
+		}
+
+		// Skip the padding after the tar archive up to the file mark
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return errors.New(err.Error() + "; error while reading file mark " + strconv.Itoa(fileMarkNum) +
+				" of tape " + tapeInfo.Name)
+		}
+	}
+
+	return config.finishScannedJob(job)
+}
+
+/**
+Description:
+	This function handles a volume label or job record found while scanning. A label of another tape stops
+	the scan, a job header starts a new job and a trailer ends it
+Parameter:
+	job: The job the previous file was added to
+	header: The tar header of the record
+	content: The content of the record
+	tapeInfo: The tape being scanned
+Return:
+	*scannedJob: The job following files are added to, nil if a new one needs to be started
+	*tape.JobRecord: The job header describing the following files, nil if there is none
+	error if any
+*/
+func (config *backUpconfig) scanRecord(job *scannedJob, header *tar.Header, content io.Reader, tapeInfo *pgdb.Tape) (*scannedJob, *tape.JobRecord, error) {
+	switch header.Name {
+	case tape.LabelEntryName:
+		label := new(tape.Label)
+		if err := json.NewDecoder(content).Decode(label); err != nil {
+			return job, nil, errors.New(err.Error() + "; the volume label of tape " + tapeInfo.Name + " is corrupt")
+		}
+		if label.TapeName != tapeInfo.Name {
+			return job, nil, errors.New("Wrong tape in drive: expected " + tapeInfo.Name + " but the volume label is " +
+				label.TapeName)
+		}
+		return job, nil, nil
+
+	case tape.JobHeaderEntryName:
+		record, err := tape.ParseJobRecord(content)
+		if err != nil {
+			return job, nil, err
+		}
+		return nil, record, config.finishScannedJob(job)
+
+	default:
+		// The trailer has when the job ended
+		if header.Name == tape.JobTrailerEntryName && job != nil {
+			record, err := tape.ParseJobRecord(content)
+			if err != nil {
+				return job, nil, err
+			}
+			job.EndTime = record.EndTime.In(time.UTC)
+		}
+		return nil, nil, config.finishScannedJob(job)
+	}
+}
+
+/**
+Description:
+	This function works out the segments of a file found on tape. The first segments of a file continued
+	from other tapes are on those tapes, which are read as incomplete files there; its header records them
+Parameter:
+	header: The tar header of the file
+	tapeInfo: The tape being scanned
+	fileMarkNum: The file mark number where the file is on the tape
+	offset: Where the tar header of the file starts in the archive
+Return:
+	[]pgdb.FileSegment: The segments of the file, nil if the tape of one of them isn't in the catalog
+	error if any
+*/
+func (config *backUpconfig) scannedSegments(header *tar.Header, tapeInfo *pgdb.Tape, fileMarkNum int, offset int64) ([]pgdb.FileSegment, error) {
+	here := pgdb.FileSegment{TapeID: tapeInfo.ID, FileMarkNum: fileMarkNum, Offset: offset}
+	recorded, err := tape.ParseSegments(header)
+	if err != nil {
+		return nil, err
+	}
+	if recorded == nil {
+		return []pgdb.FileSegment{here}, nil
+	}
+
+	var segments []pgdb.FileSegment
+	for _, segment := range recorded[:len(recorded)-1] {
+		segmentTape, err := config.DB.GetTapeByName(segment.TapeName)
+		if err != nil {
+			return nil, err
+		}
+		if segmentTape == nil {
+			fmt.Println(tapeInfo.Name, fileMarkNum, header.Name, "continues from tape", segment.TapeName,
+				"which isn't in the catalog, skipping it")
+			return nil, nil
+		}
+		segments = append(segments, pgdb.FileSegment{
+			TapeID:      segmentTape.ID,
+			FileMarkNum: segment.FileMarkNum,
+			Offset:      segment.TarOffset,
+			FileOffset:  segment.FileOffset,
+		})
+	}
+	here.FileOffset = recorded[len(recorded)-1].FileOffset
+	return append(segments, here), nil
+}
+
+/**
+Description:
+	This function adds one file found on tape to the catalog, unless it is already there. A file that is
+	already there has the checksum of what was read checked against the catalog
+Parameter:
+	job: The job the previous file was added to, nil for the first file
+	jobHeader: The job header the file follows, nil if there is none
+	header: The tar header of the file
+	tapeInfo: The tape being scanned
+	segments: The segments of the file, the last one being where it was found
+	checksum: The hex SHA-256 of the content read, which is only the last segment of a continued file
+Return:
+	*scannedJob: The job the file belongs to
+	error if any
+*/
+func (config *backUpconfig) catalogScannedFile(job *scannedJob, jobHeader *tape.JobRecord, header *tar.Header, tapeInfo *pgdb.Tape, segments []pgdb.FileSegment, checksum string) (*scannedJob, error) {
+	dir := path.Dir(header.Name)
+	modTime := header.ModTime.In(time.UTC)
+	if jobHeader != nil {
+		dir = jobHeader.Name
+	}
+
+	// The content of a continued file is on several tapes, so its checksum can't be checked from this one
+	last := segments[len(segments)-1]
+	if len(segments) > 1 {
+		checksum = ""
+	}
+
+	existing, err := config.DB.GetFileOnTape(header.Name, segments[0].TapeID, segments[0].FileMarkNum)
+	if err != nil {
+		return job, err
+	}
+	if existing != nil {
+		if existing.Checksum != "" && checksum != "" && existing.Checksum != checksum {
+			fmt.Println(tapeInfo.Name, last.FileMarkNum, header.Name, "doesn't match the checksum in the catalog")
+		}
+		// Files following a file that is already in the catalog belong to its job
+		if job == nil || job.ID != existing.JobID {
+			if err := config.finishScannedJob(job); err != nil {
+				return job, err
+			}
+			job = &scannedJob{ID: existing.JobID, Name: dir, PoolID: tapeInfo.PoolID, existing: true}
+		}
+		return job, nil
+	}
+
+	if job == nil || job.Name != dir {
+		if err := config.finishScannedJob(job); err != nil {
+			return job, err
+		}
+
+		// A job that continues from the previous tape keeps the job its first files were added to
+		if jobHeader != nil && jobHeader.Continuation {
+			continued, err := config.continuedJob(dir, tapeInfo.PoolID, jobHeader.StartTime)
+			if err != nil {
+				return nil, err
+			}
+			if continued != nil {
+				if err := config.DB.AddJobTapeMap(dir, continued.ID, tapeInfo.ID); err != nil {
+					return nil, err
+				}
+				job = &scannedJob{ID: continued.ID, Name: dir, PoolID: tapeInfo.PoolID, StartTime: continued.StartTime.Time,
+					NumOfFiles: int(continued.NumOfFiles.Int64), fromHeader: true}
+			}
+		}
+	}
+
+	if job == nil || job.Name != dir {
+		startTime := modTime
+		if jobHeader != nil {
+			startTime = jobHeader.StartTime.In(time.UTC)
+		}
+
+		pathspecid, _, err := config.DB.GetPathSpec(dir)
+		if err != nil {
+			return nil, err
+		}
+		// Jobs written before levels were introduced were incremental
+		level := pgdb.Levels.Incremental
+		if jobHeader != nil && jobHeader.Level != "" {
+			level = jobHeader.Level
+		}
+		jobID, err := config.DB.AddCompleteJob(dir, tapeInfo.PoolID, pathspecid, startTime, level)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.DB.AddJobTapeMap(dir, jobID, tapeInfo.ID); err != nil {
+			return nil, err
+		}
+		job = &scannedJob{ID: jobID, Name: dir, PoolID: tapeInfo.PoolID, StartTime: startTime, fromHeader: jobHeader != nil}
+	}
+
+	// The size of the file is where its last segment starts in the file, and the size of that segment
+	if err := config.catalogMember(job.ID, header.Name, segments, checksum, last.FileOffset+header.Size, modTime); err != nil {
+		return job, err
+	}
+	fmt.Println(tapeInfo.Name, last.FileMarkNum, header.Name)
+
+	job.NumOfFiles++
+	if !job.fromHeader && modTime.After(job.StartTime) {
+		job.StartTime = modTime
+	}
+	return job, nil
+}
+
+/**
+Description:
+	This function finds the job that the continuation of a job on a new tape belongs to: the latest job of
+	the directory started before the continuation header was written, which was added to the catalog while
+	scanning the previous tape of the job. Tapes are scanned in the order they were written for it to be found
+Parameter:
+	name: The directory of the job
+	poolID: The pool of the tape being scanned
+	continuedAt: When the continuation header was written
+Return:
+	*pgdb.Job: The job, nil if there is none
+	error if any
+*/
+func (config *backUpconfig) continuedJob(name string, poolID int, continuedAt time.Time) (*pgdb.Job, error) {
+	jobs, err := config.DB.GetJobsByState(strconv.Itoa(poolID), pgdb.States.Complete)
+	if err != nil {
+		return nil, err
+	}
+	var latest *pgdb.Job
+	for i := range jobs {
+		if jobs[i].Name != name || !jobs[i].StartTime.Valid || jobs[i].StartTime.Time.After(continuedAt) {
+			continue
+		}
+		if latest == nil || jobs[i].StartTime.Time.After(latest.StartTime.Time) {
+			latest = &jobs[i]
+		}
+	}
+	return latest, nil
+}
+
+/**
+Description:
+	This function records the start time, end time and number of files of a job created while scanning,
+	once all of its files have been found. A job whose trailer wasn't read, eg because it continues on the
+	next tape, ends at its start until it is
+Parameter:
+	job: The job, which can be nil
+Return:
+	error if any
+*/
+func (config *backUpconfig) finishScannedJob(job *scannedJob) error {
+	if job == nil || job.existing {
+		return nil
+	}
+	err := config.DB.UpdateJob(job.ID, job.Name, job.StartTime, 0, job.NumOfFiles, pgdb.States.Complete, job.PoolID)
+	if err != nil {
+		return err
+	}
+	endTime := job.EndTime
+	if endTime.IsZero() {
+		endTime = job.StartTime
+	}
+	return config.DB.SetJobEndTime(job.ID, endTime)
+}
@@ -0,0 +1,410 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultPath is the configuration file read when BACKUPTEST_CONFIG isn't set
+const DefaultPath = "backuptest.yaml"
+
+// PathEnv is the environment variable that holds the path of the configuration file
+const PathEnv = "BACKUPTEST_CONFIG"
+
+// Settings is the content of the configuration file
+type Settings struct {
+	HDFS      HDFS       `yaml:"hdfs"`
+	Changer   Changer    `yaml:"changer"`
+	Drives    []Drive    `yaml:"drives"`
+	Pools     []Pool     `yaml:"pools"`
+	Pairs     []Pair     `yaml:"pairs"`
+	Roots     []string   `yaml:"roots"`
+	Schedules []Schedule `yaml:"schedules"`
+	Limits    Limits     `yaml:"limits"`
+	Database  Database   `yaml:"database"`
+}
+
+// HDFS is the cluster being backed up
+type HDFS struct {
+	// Namenodes are the host:port addresses of the namenodes, the standby ones included
+	Namenodes []string `yaml:"namenodes"`
+	// VerifyChecksums compares the checksum hdfs keeps of a file before it is read with the one hdfs has
+	// once it is written to tape, on top of its size and modification time. A file that changed isn't
+	// cataloged, and is left to the next backup
+	VerifyChecksums bool `yaml:"verifyChecksums"`
+}
+
+// Changer is the media changer of the tape library
+type Changer struct {
+	// Device is the scsi generic device of the changer, or the state file of a simulated library
+	Device string `yaml:"device"`
+	// FixAtStartup updates the DB to match the library when the backup starts, like reconcile -fix. By
+	// default the differences are only reported
+	FixAtStartup bool `yaml:"fixAtStartup"`
+}
+
+// Drive is a tape drive of the library
+type Drive struct {
+	// Path is the device of the drive, eg /dev/nst0, or the path of a virtual tape
+	Path string `yaml:"path"`
+	// Number is the data transfer element number the changer knows the drive by
+	Number int `yaml:"number"`
+}
+
+// Pool is a set of tapes written through one drive
+type Pool struct {
+	ID   int    `yaml:"id"`
+	Name string `yaml:"name"`
+	// Drive is the path of the drive the tapes of the pool are written with
+	Drive string `yaml:"drive"`
+}
+
+// Pair is two pools that get the same data, one for each location
+type Pair struct {
+	Pool int `yaml:"pool"`
+	Pair int `yaml:"pair"`
+}
+
+// Schedule is a type of backup and when it runs. Schedules can share a name, with different levels, so
+// that the directories of the schedule get eg a full backup monthly and an incremental one daily
+type Schedule struct {
+	Name string `yaml:"name"`
+	// Cron is the cron spec, with seconds, of the times the backup runs
+	Cron string `yaml:"cron"`
+	// Level is full (every file), differential (the files changed since the last full backup) or
+	// incremental (the files changed since the last backup of any level), the default
+	Level string `yaml:"level"`
+}
+
+// Limits are the sizes the backup works with
+type Limits struct {
+	// RecordSize is the block size the drives read and write
+	RecordSize int `yaml:"recordSize"`
+	// MaxFileSize is the size above which files aren't backed up, 0 for no limit
+	MaxFileSize int64 `yaml:"maxFileSize"`
+	// ArchiveSize is the size after which the tar archive of a job is closed and its next files go to a new
+	// one, 0 for one archive per job
+	ArchiveSize int64 `yaml:"archiveSize"`
+}
+
+// Database is how the catalog DB is connected to. Parameters left empty are taken from the PGHOST, PGPORT,
+// PGUSER, PGPASSWORD, PGDATABASE, PGSSLMODE... environment variables
+type Database struct {
+	// Driver is "postgres", or "sqlite" to keep the catalog in an embedded file at Path
+	Driver string `yaml:"driver"`
+	Path   string `yaml:"path"`
+	// DSN is a full connection string or postgres:// URL, which replaces every other parameter
+	DSN string `yaml:"dsn"`
+	// CredentialsFile holds the user, password and dbname; it must not be readable by other users
+	CredentialsFile string `yaml:"credentialsFile"`
+	Host            string `yaml:"host"`
+	Port            int    `yaml:"port"`
+	User            string `yaml:"user"`
+	DBName          string `yaml:"dbname"`
+	SSLMode         string `yaml:"sslMode"`
+	SSLRootCert     string `yaml:"sslRootCert"`
+	SSLCert         string `yaml:"sslCert"`
+	SSLKey          string `yaml:"sslKey"`
+	MaxOpenConns    int    `yaml:"maxOpenConns"`
+	MaxIdleConns    int    `yaml:"maxIdleConns"`
+	// ConnMaxLifetime and ConnectTimeout are durations like "30m" or "10s"
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
+	ConnectTimeout  time.Duration `yaml:"connectTimeout"`
+}
+
+// The levels a backup can have
+var levels = []string{"full", "differential", "incremental"}
+
+// The database drivers the catalog can be kept with
+var drivers = []string{"postgres", "sqlite"}
+
+// The sslmode values lib/pq accepts
+var sslModes = []string{"disable", "require", "verify-ca", "verify-full"}
+
+// Default returns the settings used when there is no configuration file
+func Default() *Settings {
+	return &Settings{
+		HDFS:    HDFS{Namenodes: []string{"us-lax-9a-ym-00:8020"}},
+		Changer: Changer{Device: "/dev/sg10"},
+		Roots:   []string{"/ccr", "/prod"},
+		Schedules: []Schedule{
+			{Name: "2Mins", Cron: "00 */05 * * * *", Level: "incremental"},
+		},
+		Limits: Limits{
+			RecordSize:  4096,
+			MaxFileSize: 0,
+			ArchiveSize: 1073741824,
+		},
+		Database: Database{
+			Driver:          "postgres",
+			CredentialsFile: "dbAuthen.txt",
+			MaxOpenConns:    4,
+			MaxIdleConns:    2,
+			ConnMaxLifetime: 30 * time.Minute,
+			ConnectTimeout:  10 * time.Second,
+		},
+	}
+}
+
+// Path returns the path of the configuration file, and whether it was set explicitly
+func Path() (string, bool) {
+	if configPath := os.Getenv(PathEnv); configPath != "" {
+		return configPath, true
+	}
+	return DefaultPath, false
+}
+
+// Load reads the configuration file. A missing file is only an error when its path was set explicitly;
+// otherwise the defaults are used
+func Load() (*Settings, error) {
+	configPath, explicit := Path()
+	if _, err := os.Stat(configPath); os.IsNotExist(err) && !explicit {
+		return Default(), nil
+	}
+	return LoadFile(configPath)
+}
+
+// LoadFile reads and validates the configuration file at configPath. Settings missing from the file keep
+// their default
+func LoadFile(configPath string) (*Settings, error) {
+	content, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := Default()
+	if err := yaml.UnmarshalStrict(content, settings); err != nil {
+		return nil, errors.New(configPath + ": " + err.Error())
+	}
+	// Schedules without a level are incremental, like every backup before levels
+	for i := range settings.Schedules {
+		if settings.Schedules[i].Level == "" {
+			settings.Schedules[i].Level = "incremental"
+		}
+	}
+
+	if problems := settings.Validate(); len(problems) != 0 {
+		return nil, errors.New(configPath + ": " + strings.Join(problems, "\n"+configPath+": "))
+	}
+	return settings, nil
+}
+
+// Validate checks the settings, and returns one message for every problem found. Every message starts
+// with the key of the offending setting
+func (settings *Settings) Validate() []string {
+	var problems []string
+	problem := func(key string, format string, args ...interface{}) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(settings.HDFS.Namenodes) == 0 {
+		problem("hdfs.namenodes", "at least one namenode is needed")
+	}
+	for i, namenode := range settings.HDFS.Namenodes {
+		if !strings.Contains(namenode, ":") {
+			problem(fmt.Sprintf("hdfs.namenodes[%d]", i), "%q is not a host:port address", namenode)
+		}
+	}
+
+	if settings.Changer.Device == "" {
+		problem("changer.device", "the changer device is needed")
+	}
+
+	drivePaths := make(map[string]bool)
+	driveNumbers := make(map[int]bool)
+	for i, drive := range settings.Drives {
+		key := fmt.Sprintf("drives[%d]", i)
+		if drive.Path == "" {
+			problem(key+".path", "the path of the drive is needed")
+		} else if drivePaths[drive.Path] {
+			problem(key+".path", "%q is used by another drive", drive.Path)
+		}
+		if drive.Number < 0 {
+			problem(key+".number", "%d is not a valid drive number", drive.Number)
+		} else if driveNumbers[drive.Number] {
+			problem(key+".number", "%d is used by another drive", drive.Number)
+		}
+		drivePaths[drive.Path] = true
+		driveNumbers[drive.Number] = true
+	}
+
+	poolIDs := make(map[int]bool)
+	for i, pool := range settings.Pools {
+		key := fmt.Sprintf("pools[%d]", i)
+		if pool.ID <= 0 {
+			problem(key+".id", "%d is not a valid poolID", pool.ID)
+		} else if poolIDs[pool.ID] {
+			problem(key+".id", "%d is used by another pool", pool.ID)
+		}
+		if !drivePaths[pool.Drive] {
+			problem(key+".drive", "%q is not one of the drives", pool.Drive)
+		}
+		poolIDs[pool.ID] = true
+	}
+
+	paired := make(map[int]bool)
+	for i, pair := range settings.Pairs {
+		key := fmt.Sprintf("pairs[%d]", i)
+		for _, member := range []struct {
+			key    string
+			poolID int
+		}{{key + ".pool", pair.Pool}, {key + ".pair", pair.Pair}} {
+			if !poolIDs[member.poolID] {
+				problem(member.key, "%d is not one of the pools", member.poolID)
+			} else if paired[member.poolID] {
+				problem(member.key, "pool %d is in another pair", member.poolID)
+			}
+			paired[member.poolID] = true
+		}
+		if pair.Pool == pair.Pair {
+			problem(key, "a pool can't be paired with itself")
+		}
+	}
+
+	if len(settings.Roots) == 0 {
+		problem("roots", "at least one root is needed")
+	}
+	for i, root := range settings.Roots {
+		if !path.IsAbs(root) {
+			problem(fmt.Sprintf("roots[%d]", i), "%q is not an absolute path", root)
+		}
+	}
+
+	if len(settings.Schedules) == 0 {
+		problem("schedules", "at least one schedule is needed")
+	}
+	scheduleLevels := make(map[string]bool)
+	for i, schedule := range settings.Schedules {
+		key := fmt.Sprintf("schedules[%d]", i)
+		if schedule.Name == "" {
+			problem(key+".name", "the name of the schedule is needed")
+		} else if scheduleLevels[schedule.Name+" "+schedule.Level] {
+			problem(key+".name", "%q is used by another %s schedule", schedule.Name, schedule.Level)
+		}
+		scheduleLevels[schedule.Name+" "+schedule.Level] = true
+		if !contains(levels, schedule.Level) {
+			problem(key+".level", "%q is not one of %s", schedule.Level, strings.Join(levels, ", "))
+		}
+		if _, err := cron.Parse(schedule.Cron); err != nil {
+			problem(key+".cron", "%q is not a valid cron spec: %v", schedule.Cron, err)
+		}
+	}
+
+	if settings.Limits.RecordSize <= 0 || settings.Limits.RecordSize%512 != 0 {
+		problem("limits.recordSize", "%d is not a positive multiple of 512", settings.Limits.RecordSize)
+	}
+	if settings.Limits.MaxFileSize < 0 {
+		problem("limits.maxFileSize", "%d can't be negative", settings.Limits.MaxFileSize)
+	}
+	if settings.Limits.ArchiveSize < 0 {
+		problem("limits.archiveSize", "%d can't be negative", settings.Limits.ArchiveSize)
+	}
+
+	database := settings.Database
+	if !contains(drivers, database.Driver) {
+		problem("database.driver", "%q is not one of %s", database.Driver, strings.Join(drivers, ", "))
+	}
+	if database.Driver == "sqlite" && database.Path == "" {
+		problem("database.path", "the path of the SQLite catalog is needed")
+	}
+	if database.Driver != "sqlite" && database.Path != "" {
+		problem("database.path", "the path is only used by the sqlite driver")
+	}
+	if database.DSN != "" && (database.Host != "" || database.User != "" || database.DBName != "") {
+		problem("database.dsn", "the dsn can't be combined with host, user or dbname")
+	}
+	if database.Port < 0 || database.Port > 65535 {
+		problem("database.port", "%d is not a valid port", database.Port)
+	}
+	if database.SSLMode != "" {
+		if !contains(sslModes, database.SSLMode) {
+			problem("database.sslMode", "%q is not one of %s", database.SSLMode, strings.Join(sslModes, ", "))
+		}
+	}
+	if (database.SSLCert == "") != (database.SSLKey == "") {
+		problem("database.sslCert", "the client certificate and database.sslKey go together")
+	}
+	for _, file := range []struct {
+		key  string
+		path string
+	}{{"database.sslRootCert", database.SSLRootCert}, {"database.sslCert", database.SSLCert}, {"database.sslKey", database.SSLKey}} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problem(file.key, "%v", err)
+		}
+	}
+	if database.MaxOpenConns < 0 {
+		problem("database.maxOpenConns", "%d can't be negative", database.MaxOpenConns)
+	}
+	if database.MaxIdleConns < 0 {
+		problem("database.maxIdleConns", "%d can't be negative", database.MaxIdleConns)
+	} else if database.MaxOpenConns > 0 && database.MaxIdleConns > database.MaxOpenConns {
+		problem("database.maxIdleConns", "%d is more than database.maxOpenConns", database.MaxIdleConns)
+	}
+	if database.ConnMaxLifetime < 0 {
+		problem("database.connMaxLifetime", "%v can't be negative", database.ConnMaxLifetime)
+	}
+	if database.ConnectTimeout < 0 {
+		problem("database.connectTimeout", "%v can't be negative", database.ConnectTimeout)
+	}
+
+	return problems
+}
+
+// contains tells whether value is one of values
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HDFSAddress returns the namenodes in the form hdfs.New expects them
+func (settings *Settings) HDFSAddress() string {
+	return strings.Join(settings.HDFS.Namenodes, ",")
+}
+
+// PoolDrive returns the path of the drive of a pool, or "" if the pool isn't configured
+func (settings *Settings) PoolDrive(poolID int) string {
+	for _, pool := range settings.Pools {
+		if pool.ID == poolID {
+			return pool.Drive
+		}
+	}
+	return ""
+}
+
+// PairOf returns the pool paired with a pool, or -1 if it isn't in a pair
+func (settings *Settings) PairOf(poolID int) int {
+	for _, pair := range settings.Pairs {
+		if pair.Pool == poolID {
+			return pair.Pair
+		}
+		if pair.Pair == poolID {
+			return pair.Pool
+		}
+	}
+	return -1
+}
+
+// HasSchedule reports whether a schedule of the configuration file has the name
+func (settings *Settings) HasSchedule(name string) bool {
+	for _, schedule := range settings.Schedules {
+		if schedule.Name == name {
+			return true
+		}
+	}
+	return false
+}
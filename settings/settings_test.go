@@ -0,0 +1,278 @@
+package settings
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// valid returns settings that pass Validate, with two drives, two paired pools and a SQLite catalog
+func valid() *Settings {
+	settings := Default()
+	settings.Drives = []Drive{{Path: "/dev/nst0", Number: 0}, {Path: "/dev/nst1", Number: 1}}
+	settings.Pools = []Pool{{ID: 1, Name: "onsite", Drive: "/dev/nst0"}, {ID: 2, Name: "offsite", Drive: "/dev/nst1"}}
+	settings.Pairs = []Pair{{Pool: 1, Pair: 2}}
+	settings.Database.Driver = "sqlite"
+	settings.Database.Path = "catalog.db"
+	return settings
+}
+
+// hasProblem tells whether one of the problems is about the key
+func hasProblem(problems []string, key string) bool {
+	for _, problem := range problems {
+		if strings.HasPrefix(problem, key+": ") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(settings *Settings)
+		// key is the setting a problem is expected for, "" for none
+		key string
+	}{
+		{"valid", func(settings *Settings) {}, ""},
+		{"default", func(settings *Settings) { *settings = *Default() }, ""},
+		{"no namenode", func(settings *Settings) { settings.HDFS.Namenodes = nil }, "hdfs.namenodes"},
+		{"namenode without port", func(settings *Settings) {
+			settings.HDFS.Namenodes = []string{"nn1:8020", "nn2"}
+		}, "hdfs.namenodes[1]"},
+		{"no changer", func(settings *Settings) { settings.Changer.Device = "" }, "changer.device"},
+		{"duplicate drive path", func(settings *Settings) {
+			settings.Drives[1].Path = "/dev/nst0"
+		}, "drives[1].path"},
+		{"duplicate drive number", func(settings *Settings) { settings.Drives[1].Number = 0 }, "drives[1].number"},
+		{"negative drive number", func(settings *Settings) { settings.Drives[0].Number = -1 }, "drives[0].number"},
+		{"duplicate pool", func(settings *Settings) { settings.Pools[1].ID = 1 }, "pools[1].id"},
+		{"pool without id", func(settings *Settings) { settings.Pools[0].ID = 0 }, "pools[0].id"},
+		{"pool on unknown drive", func(settings *Settings) { settings.Pools[1].Drive = "/dev/nst9" }, "pools[1].drive"},
+		{"pair of unknown pool", func(settings *Settings) { settings.Pairs[0].Pair = 3 }, "pairs[0].pair"},
+		{"pool paired with itself", func(settings *Settings) { settings.Pairs[0].Pair = 1 }, "pairs[0]"},
+		{"pool in two pairs", func(settings *Settings) {
+			settings.Pools = append(settings.Pools, Pool{ID: 3, Drive: "/dev/nst1"})
+			settings.Pairs = append(settings.Pairs, Pair{Pool: 3, Pair: 1})
+		}, "pairs[1].pair"},
+		{"relative root", func(settings *Settings) { settings.Roots = []string{"/prod", "ccr"} }, "roots[1]"},
+		{"no schedule", func(settings *Settings) { settings.Schedules = nil }, "schedules"},
+		{"bad cron spec", func(settings *Settings) { settings.Schedules[0].Cron = "every 5 minutes" }, "schedules[0].cron"},
+		{"cron spec out of range", func(settings *Settings) { settings.Schedules[0].Cron = "0 0 25 * * *" }, "schedules[0].cron"},
+		{"unknown level", func(settings *Settings) { settings.Schedules[0].Level = "weekly" }, "schedules[0].level"},
+		{"duplicate schedule", func(settings *Settings) {
+			settings.Schedules = append(settings.Schedules, settings.Schedules[0])
+		}, "schedules[1].name"},
+		{"schedule with two levels", func(settings *Settings) {
+			settings.Schedules = append(settings.Schedules, Schedule{Name: "2Mins", Cron: "0 0 0 1 * *", Level: "full"})
+		}, ""},
+		{"record size", func(settings *Settings) { settings.Limits.RecordSize = 1000 }, "limits.recordSize"},
+		{"negative archive size", func(settings *Settings) { settings.Limits.ArchiveSize = -1 }, "limits.archiveSize"},
+		{"unknown driver", func(settings *Settings) { settings.Database.Driver = "mysql" }, "database.driver"},
+		{"sqlite without path", func(settings *Settings) { settings.Database.Path = "" }, "database.path"},
+		{"path with postgres", func(settings *Settings) { settings.Database.Driver = "postgres" }, "database.path"},
+		{"dsn with host", func(settings *Settings) {
+			settings.Database.DSN = "postgres://backup@db/backupTest"
+			settings.Database.Host = "db"
+		}, "database.dsn"},
+		{"bad port", func(settings *Settings) { settings.Database.Port = 70000 }, "database.port"},
+		{"bad sslmode", func(settings *Settings) { settings.Database.SSLMode = "prefer" }, "database.sslMode"},
+		{"cert without key", func(settings *Settings) { settings.Database.SSLCert = "client.crt" }, "database.sslCert"},
+		{"missing root cert", func(settings *Settings) {
+			settings.Database.SSLRootCert = "/nonexistent/root.crt"
+		}, "database.sslRootCert"},
+		{"more idle than open", func(settings *Settings) {
+			settings.Database.MaxOpenConns = 2
+			settings.Database.MaxIdleConns = 3
+		}, "database.maxIdleConns"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := valid()
+			test.change(settings)
+			problems := settings.Validate()
+			if test.key == "" {
+				if len(problems) != 0 {
+					t.Errorf("expected no problem, got %q", problems)
+				}
+				return
+			}
+			if !hasProblem(problems, test.key) {
+				t.Errorf("expected a problem with %s, got %q", test.key, problems)
+			}
+		})
+	}
+}
+
+// writeFile writes content to a file of dir, and returns its path
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	filePath := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const base = `
+drives:
+  - path: /dev/nst0
+    number: 0
+pools:
+  - id: 1
+    name: onsite
+    drive: /dev/nst0
+`
+	tests := []struct {
+		name    string
+		content string
+		// errs are parts of the expected error, none for no error
+		errs []string
+	}{
+		{"valid", base, nil},
+		{"empty file", "", nil},
+		{"unknown key", base + "retention: 30\n", []string{"retention"}},
+		{"unknown nested key", base + "limits:\n  blockSize: 4096\n", []string{"blockSize"}},
+		{"misspelled key", "hdfs:\n  namenode: [\"nn1:8020\"]\n", []string{"namenode"}},
+		{"duplicate drive", `
+drives:
+  - path: /dev/nst0
+    number: 0
+  - path: /dev/nst0
+    number: 1
+`, []string{"drives[1].path"}},
+		{"duplicate pool", `
+drives:
+  - path: /dev/nst0
+    number: 0
+pools:
+  - id: 1
+    drive: /dev/nst0
+  - id: 1
+    drive: /dev/nst0
+`, []string{"pools[1].id"}},
+		{"bad cron spec", base + "schedules:\n  - name: nightly\n    cron: \"0 61 2 * * *\"\n",
+			[]string{"schedules[0].cron"}},
+		{"every problem reported", `
+drives:
+  - path: /dev/nst0
+    number: 0
+  - path: /dev/nst0
+    number: 0
+schedules:
+  - name: nightly
+    cron: "* * *"
+    level: weekly
+`, []string{"drives[1].path", "drives[1].number", "schedules[0].cron", "schedules[0].level"}},
+		{"not yaml", "drives: [", []string{"yaml"}},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configPath := writeFile(t, dir, "config"+string(rune('a'+i))+".yaml", test.content)
+			settings, err := LoadFile(configPath)
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error, got %+v", settings)
+			}
+			for _, part := range test.errs {
+				if !strings.Contains(err.Error(), part) {
+					t.Errorf("expected %q in the error, got %v", part, err)
+				}
+			}
+			if !strings.HasPrefix(err.Error(), configPath+": ") {
+				t.Errorf("expected the error to start with the path of the file, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadFileDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := writeFile(t, dir, "backuptest.yaml", `
+schedules:
+  - name: nightly
+    cron: "0 0 2 * * *"
+limits:
+  recordSize: 65536
+`)
+	settings, err := LoadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Schedules without a level are incremental
+	if level := settings.Schedules[0].Level; level != "incremental" {
+		t.Errorf("level = %q, want incremental", level)
+	}
+	if settings.Limits.RecordSize != 65536 {
+		t.Errorf("recordSize = %d, want 65536", settings.Limits.RecordSize)
+	}
+	// Settings missing from the file keep their default
+	if settings.Limits.ArchiveSize != Default().Limits.ArchiveSize {
+		t.Errorf("archiveSize = %d, want the default", settings.Limits.ArchiveSize)
+	}
+	if settings.HDFSAddress() != Default().HDFSAddress() {
+		t.Errorf("namenodes = %q, want the default", settings.HDFSAddress())
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Setenv(PathEnv, os.Getenv(PathEnv))
+
+	// A missing file is an error when its path was set explicitly
+	os.Setenv(PathEnv, filepath.Join(dir, "missing.yaml"))
+	if settings, err := Load(); err == nil || !os.IsNotExist(err) {
+		t.Errorf("Load() = %+v, %v, want a not exist error", settings, err)
+	}
+
+	os.Setenv(PathEnv, writeFile(t, dir, "explicit.yaml", "roots: [/ccr]\n"))
+	settings, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Roots) != 1 || settings.Roots[0] != "/ccr" {
+		t.Errorf("roots = %q, want [/ccr]", settings.Roots)
+	}
+
+	// Without the environment variable, the defaults are used when the default file doesn't exist
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	os.Unsetenv(PathEnv)
+	settings, err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(settings.Roots) != len(Default().Roots) {
+		t.Errorf("roots = %q, want the default", settings.Roots)
+	}
+}
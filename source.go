@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/colinmarc/hdfs"
+)
+
+// source is the file system the backups are taken from: hdfs, through hdfsSource
+type source interface {
+	Walk(root string, walkFn filepath.WalkFunc) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (sourceFile, error)
+	Close() error
+}
+
+// sourceFile is a file of the source opened for reading
+type sourceFile interface {
+	io.ReadCloser
+	// Checksum returns the checksum the source keeps of the content of the file
+	Checksum() ([]byte, error)
+}
+
+// hdfsSource is the source of the backups of an hdfs cluster
+type hdfsSource struct {
+	*hdfs.Client
+}
+
+// openSource connects to the source of the backups, the hdfs cluster of the configuration file
+var openSource = func() (source, error) {
+	client, err := hdfs.New(appSettings.HDFSAddress())
+	if err != nil {
+		return nil, err
+	}
+	return hdfsSource{client}, nil
+}
+
+// Open opens a file of hdfs for reading
+func (source hdfsSource) Open(name string) (sourceFile, error) {
+	reader, err := source.Client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/testusr/BackUpTest/db"
+	"github.com/testusr/BackUpTest/tape"
+)
+
+// tarStream is a tar archive the files of a job are written to, as members of one tape file. A file is
+// only added to the catalog once its content has reached the drive
+type tarStream struct {
+	config *backUpconfig
+	tw     *tar.Writer
+	// tapeID and fileMarkNum are the tape the archive is on, and its file mark number
+	tapeID      int
+	fileMarkNum int
+	// written is the number of bytes of the archive given to the tape writer
+	written int64
+	// pending are the members whose content may still be in the buffers, in the order they were written
+	pending []streamMember
+}
+
+// streamMember is a file written to a tarStream, where its tar header and its content start in the archive
+// and where its content ends. A file that didn't fit on the previous tape is continued from start, after the
+// segments written there
+type streamMember struct {
+	index    int
+	file     jobFile
+	start    int64
+	segments []pgdb.FileSegment
+	offset   int64
+	content  int64
+	// end is -1 while the content is being written
+	end int64
+	// checksum is the hex SHA-256 of the whole content of the file, once it is written
+	checksum string
+	// changed is whether the file changed in hdfs while it was written, which leaves it to the next backup
+	changed bool
+}
+
+/**
+Description:
+	This function starts a tar archive at the current position of the tape
+Parameter:
+	tapeID: The tape in the drive
+Return:
+	*tarStream: The archive the files are added to
+*/
+func (config *backUpconfig) newTarStream(tapeID int) *tarStream {
+	stream := &tarStream{config: config, tapeID: tapeID, fileMarkNum: config.TapeConfig.GetFileMarkNum()}
+	stream.tw = tar.NewWriter(stream)
+	return stream
+}
+
+// Write passes the bytes of the archive to the tape writer, counting them
+func (stream *tarStream) Write(p []byte) (int, error) {
+	n, err := stream.config.TapeConfig.TapeWriter.Write(p)
+	stream.written += int64(n)
+	return n, err
+}
+
+/**
+Description:
+	This method streams a file from hdfs to the archive, as its next member, computing the SHA-256 of its
+	content on the way. A file continued from a previous tape gets the segments written so far recorded in
+	its tar header, and only the rest of its content. The content before where it continues is read again
+	for the checksum, since it covers the whole file. A file that changed while it was read is marked as
+	changed, since what is on tape may be neither its old nor its new content
+Parameter:
+	member: The file being written, with where it continues from
+Return:
+	error if any
+*/
+func (stream *tarStream) add(member streamMember) error {
+	fileReader, err := stream.config.Client.Open(member.file.Path)
+	if err != nil {
+		return err
+	}
+	defer fileReader.Close()
+	var hdfsChecksum []byte
+	if appSettings.HDFS.VerifyChecksums {
+		if hdfsChecksum, err = fileReader.Checksum(); err != nil {
+			return err
+		}
+	}
+	checksum := sha256.New()
+	if member.start > 0 {
+		if _, err := io.CopyN(checksum, fileReader, member.start); err != nil {
+			return err
+		}
+	}
+
+	// The padding of the previous member is written first, so that the header starts at the offset
+	if err := stream.tw.Flush(); err != nil {
+		return err
+	}
+	member.offset = stream.written
+
+	size := member.file.Info.Size() - member.start
+	header := &tar.Header{
+		Name:    member.file.Path,
+		Size:    size,
+		Mode:    int64(member.file.Info.Mode()),
+		ModTime: member.file.Info.ModTime(),
+	}
+	if len(member.segments) > 0 {
+		segments, err := stream.config.tapeSegments(append(member.segments, stream.segmentOf(member)))
+		if err != nil {
+			return err
+		}
+		if err := tape.SetSegments(header, segments); err != nil {
+			return err
+		}
+	}
+	if err := stream.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	member.content, member.end = stream.written, -1
+	stream.pending = append(stream.pending, member)
+
+	// The content is copied in pieces no larger than the buffer of the tape writer, which passes larger
+	// writes to the drive as they are instead of in records
+	buffer := make([]byte, stream.config.TapeConfig.TapeWriter.Size())
+	content := io.TeeReader(io.LimitReader(fileReader, size), checksum)
+	if _, err := io.CopyBuffer(stream.tw, content, buffer); err != nil {
+		return err
+	}
+	changed, err := stream.config.sourceChanged(member.file, hdfsChecksum)
+	if err != nil {
+		return err
+	}
+	written := &stream.pending[len(stream.pending)-1]
+	written.end, written.checksum, written.changed = stream.written, hex.EncodeToString(checksum.Sum(nil)), changed
+	return nil
+}
+
+/**
+Description:
+	This method checks whether a file changed in hdfs since its directory was walked, which includes the
+	time it was being written to tape. Its size and modification time are compared with those of the walk,
+	and with hdfs.verifyChecksums the checksum hdfs keeps of it with the one taken before it was read. The
+	checksum is read through a new reader, since a reader keeps the block locations it started with
+Parameter:
+	file: The file
+	before: The checksum hdfs had of the file before it was read, nil when checksums aren't verified
+Return:
+	bool: Whether the file changed
+	error if any
+*/
+func (config *backUpconfig) sourceChanged(file jobFile, before []byte) (bool, error) {
+	info, err := config.Client.Stat(file.Path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != file.Info.Size() || !info.ModTime().Equal(file.Info.ModTime()) {
+		return true, nil
+	}
+	if before == nil {
+		return false, nil
+	}
+
+	reader, err := config.Client.Open(file.Path)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+	after, err := reader.Checksum()
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(before, after), nil
+}
+
+// segmentOf returns the position of a member in the archive
+func (stream *tarStream) segmentOf(member streamMember) pgdb.FileSegment {
+	return pgdb.FileSegment{
+		TapeID:      stream.tapeID,
+		FileMarkNum: stream.fileMarkNum,
+		Offset:      member.offset,
+		FileOffset:  member.start,
+	}
+}
+
+/**
+Description:
+	This method returns the members whose content has reached the drive since it was last called
+Return:
+	[]streamMember: The members
+*/
+func (stream *tarStream) flushed() []streamMember {
+	onDrive := stream.onDrive()
+	var members []streamMember
+	for len(stream.pending) > 0 && stream.pending[0].end >= 0 && stream.pending[0].end <= onDrive {
+		members = append(members, stream.pending[0])
+		stream.pending = stream.pending[1:]
+	}
+	return members
+}
+
+// onDrive returns the number of bytes of the archive that reached the drive
+func (stream *tarStream) onDrive() int64 {
+	return stream.written - int64(stream.config.TapeConfig.Buffered())
+}
+
+/**
+Description:
+	This method writes the end of the archive, and pushes the rest of it to the drive
+Return:
+	error if any
+*/
+func (stream *tarStream) close() error {
+	if err := stream.tw.Close(); err != nil {
+		return err
+	}
+
+	// Fill the buffer to flush the remaning bytes to the tape
+	if _, err := stream.Write(make([]byte, stream.config.TapeConfig.TapeWriter.Available())); err != nil {
+		return err
+	}
+	return stream.config.TapeConfig.FlushBuffers()
+}
+
+/**
+Description:
+	This function writes the files of a job as the members of tar archives, each followed by a file mark,
+	so that small files are dense on tape and the drive keeps streaming. An archive is closed after the
+	last file, or once it reaches limits.archiveSize. No archive is started past the early warning near the
+	end of the tape, the job is continued on the next tape instead. When the drive refuses a write at the
+	early warning, the archive is closed with a file mark and the data after what made it to tape is
+	recorded as the invalid tail of the tape. The archive is continued by a new one on the next tape. A
+	file whose content was cut short by the end of the tape is continued there from where it was cut, so
+	that files larger than a tape can be backed up; the files after it are written again
+Parameter:
+	jobID, path, level, poolID: The job being executed
+	tapeID: The tape in the drive
+	files: The files that need backing up, in the order they are written
+Return:
+	int: The number of files added to the catalog
+	error if any
+*/
+func (config *backUpconfig) writeArchives(jobID int, path string, level string, poolID string, tapeID int, files []jobFile) (int, error) {
+	filesAdded := 0
+	stream := config.newTarStream(tapeID)
+	// Whether the tape in the drive was loaded by this job, and whether a file made it to it since
+	newTape, progress := false, false
+	// The file continued on the tape in the drive, after the segments of it on the previous tapes
+	var resume *streamMember
+
+	for next := 0; ; {
+		if config.signalInterruptChan {
+			return filesAdded, errors.New("Signal Interrupt")
+		}
+
+		// An archive isn't started past the early warning, whose room is for closing what was written: the
+		// job moves on to the next tape ahead of time, without waiting for the drive to refuse a write
+		if stream.written == 0 && next < len(files) && config.TapeConfig.EarlyWarning() {
+			if newTape && !progress {
+				return filesAdded, errors.New("The tape loaded for " + path + " is already past its early warning")
+			}
+			var err error
+			if tapeID, err = config.continueOnNewTape(jobID, path, level, poolID); err != nil {
+				return filesAdded, err
+			}
+			stream = config.newTarStream(tapeID)
+			newTape, progress = true, false
+			continue
+		}
+
+		closing := next == len(files) ||
+			(appSettings.Limits.ArchiveSize > 0 && stream.written >= appSettings.Limits.ArchiveSize)
+		var err error
+		if closing {
+			err = stream.close()
+		} else {
+			member := streamMember{index: next, file: files[next]}
+			if resume != nil && resume.index == next {
+				member.start, member.segments = resume.start, resume.segments
+			}
+			err = stream.add(member)
+		}
+
+		// The members that reached the drive are on tape, even when the tape filled up after them. A file
+		// that changed while it was read isn't cataloged; having been modified since the job started, it is
+		// backed up again by the next job of the directory
+		for _, member := range stream.flushed() {
+			if member.changed {
+				fmt.Println(member.file.Path, "changed while it was written to tape, leaving it to the next backup")
+				continue
+			}
+			segments, info := append(member.segments, stream.segmentOf(member)), member.file.Info
+			if err := config.catalogMember(jobID, member.file.Path, segments, member.checksum, info.Size(), info.ModTime()); err != nil {
+				return filesAdded, err
+			}
+			filesAdded++
+			progress = true
+		}
+
+		if err == nil {
+			if !closing {
+				next++
+				continue
+			}
+			// Writing end of file marker on tape to distinguish the archive from the next one
+			if err := config.TapeConfig.WriteEOF(); err != nil {
+				return filesAdded, err
+			}
+			if next == len(files) {
+				return filesAdded, nil
+			}
+			stream = config.newTarStream(tapeID)
+			continue
+		}
+
+		if !tape.IsFull(err) {
+			return filesAdded, err
+		}
+
+		// The writing starts again on the next tape with the first file not on this one. When part of its
+		// content made it, that part is a segment of the file, and the file continues after it. Whatever
+		// follows on this tape is invalid
+		invalidOffset := stream.onDrive()
+		if len(stream.pending) > 0 {
+			cut := stream.pending[0]
+			next = cut.index
+			resume = &cut
+			if onTape := stream.onDrive() - cut.content; onTape > 0 {
+				resume.segments = append(cut.segments[:len(cut.segments):len(cut.segments)], stream.segmentOf(cut))
+				resume.start = cut.start + onTape
+				progress = true
+			} else {
+				invalidOffset = cut.offset
+			}
+		}
+
+		// File marks can still be written past the early warning, but not past the physical end of the tape
+		if err := config.TapeConfig.WriteEOF(); err != nil && !tape.IsFull(err) {
+			return filesAdded, err
+		}
+		if err := config.DB.SetInvalidTail(tapeID, stream.fileMarkNum, invalidOffset); err != nil {
+			return filesAdded, err
+		}
+
+		// When only the end of the last archive didn't fit, every file is on tape and no archive is started
+		// on a new tape
+		if next == len(files) {
+			return filesAdded, nil
+		}
+		if newTape && !progress {
+			return filesAdded, errors.New(err.Error() + "; nothing of the next file of " + path + " fits on an empty tape")
+		}
+
+		// The job continues on the new tape, which gets a header of its own
+		if tapeID, err = config.continueOnNewTape(jobID, path, level, poolID); err != nil {
+			return filesAdded, err
+		}
+		stream = config.newTarStream(tapeID)
+		newTape, progress = true, false
+	}
+}
+
+/**
+Description:
+	This function adds a file whose content is all on tape to the catalog: the File row is its first
+	segment, and the others are its FileSegments
+Parameter:
+	jobID: The job that wrote the file
+	name: The hdfs path of the file
+	segments: The segments of the file, the first one being where the file starts
+	checksum: The hex SHA-256 of the content of the file, "" when it isn't known
+	size, modTime: The size and modification time of the file
+Return:
+	error if any
+*/
+func (config *backUpconfig) catalogMember(jobID int, name string, segments []pgdb.FileSegment, checksum string, size int64, modTime time.Time) error {
+	first := segments[0]
+	fileID, err := config.DB.AddFile(name, jobID, first.TapeID, first.FileMarkNum, first.Offset, checksum, size, modTime)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments[1:] {
+		if err := config.DB.AddFileSegment(fileID, segment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**
+Description:
+	This function converts the segments of a file to what is recorded on tape, where tapes are known by
+	their name
+Parameter:
+	segments: The segments of the file
+Return:
+	[]tape.Segment: The segments
+	error if any
+*/
+func (config *backUpconfig) tapeSegments(segments []pgdb.FileSegment) ([]tape.Segment, error) {
+	var recorded []tape.Segment
+	for _, segment := range segments {
+		tapeInfo, err := config.DB.GetTape(segment.TapeID)
+		if err != nil {
+			return nil, err
+		}
+		recorded = append(recorded, tape.Segment{
+			TapeName:    tapeInfo.Name,
+			FileMarkNum: segment.FileMarkNum,
+			TarOffset:   segment.Offset,
+			FileOffset:  segment.FileOffset,
+		})
+	}
+	return recorded, nil
+}
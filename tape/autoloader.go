@@ -3,28 +3,44 @@ package tape
 import (
 	"bytes"
 	"errors"
+	"os"
 	"os/exec"
 	"strconv"
 )
 
-// Unload Method is used to unload a tape from drive "driveNum", and place the tape in slotnumber "slotNum"
-func Unload(driveNum int, slotNum int) error {
-	driveN := strconv.Itoa(driveNum)
-	slotN := strconv.Itoa(slotNum)
-	cmd := exec.Command("mtx", "-f", "/dev/sg10", "unload", slotN, driveN)
-	var errorMessg bytes.Buffer
-	cmd.Stderr = &errorMessg
-	err := cmd.Run()
+// Changer is a media changer (autoloader) that moves tapes between its storage slots and drives
+type Changer interface {
+	// Load moves the tape in slot "slotNum" into drive "driveNum"
+	Load(driveNum int, slotNum int) error
+	// Unload moves the tape in drive "driveNum" into slot "slotNum"
+	Unload(driveNum int, slotNum int) error
+	// Transfer moves a tape from one slot to another, eg to or from an import/export slot
+	Transfer(fromSlot int, toSlot int) error
+	// Status returns the status of the library in the format printed by "mtx status"
+	Status() (string, error)
+}
+
+// MTXChanger is a changer controlled with the mtx command through its scsi generic device, eg /dev/sg10
+type MTXChanger struct {
+	Device string
+}
+
+// NewChanger returns the changer for device. Character devices are controlled with mtx, anything else is
+// the state file of a simulated library
+func NewChanger(device string) (Changer, error) {
+	info, err := os.Stat(device)
 	if err != nil {
-		return errors.New(errorMessg.String())
+		return nil, err
 	}
-	return nil
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return &SimulatedChanger{StatePath: device}, nil
+	}
+	return &MTXChanger{Device: device}, nil
 }
 
-// GetMTXStatus is used to get the status of the tape library, which slot are empty, full, and name of tape if present
-func GetMTXStatus() (string, error) {
-
-	cmd := exec.Command("mtx", "-f", "/dev/sg10", "status")
+// run runs mtx with the arguments, returning its output or its error message
+func (changer *MTXChanger) run(args ...string) (string, error) {
+	cmd := exec.Command("mtx", append([]string{"-f", changer.Device}, args...)...)
 	var out bytes.Buffer
 	cmd.Stdout = &out
 	var errorMessg bytes.Buffer
@@ -33,41 +49,30 @@ func GetMTXStatus() (string, error) {
 	if err != nil {
 		return "", errors.New(errorMessg.String())
 	}
-
 	return out.String(), nil
 }
 
-// TODO: need to find how does the tape drive get paired with particular file
-
-// Load is used to load a tape form slot number "SlotNum" to drive "driveNum"
-func Load(driveNum int, slotNum int) error {
-	driveN := strconv.Itoa(driveNum)
-	slotN := strconv.Itoa(slotNum)
-	cmd := exec.Command("mtx", "-f", "/dev/sg10", "load", slotN, driveN)
-	var errorMessg bytes.Buffer
-	cmd.Stderr = &errorMessg
-	err := cmd.Run()
-	if err != nil {
-		return errors.New(errorMessg.String())
-	}
-	return nil
+// Unload Method is used to unload a tape from drive "driveNum", and place the tape in slotnumber "slotNum"
+func (changer *MTXChanger) Unload(driveNum int, slotNum int) error {
+	_, err := changer.run("unload", strconv.Itoa(slotNum), strconv.Itoa(driveNum))
+	return err
 }
 
-func GetAEmptySlot() (int, error) {
-	statusString, err := GetMTXStatus()
-	if err != nil {
-		return -1, err
-	}
-	matches := emptyReg.FindStringSubmatch(statusString)
-	if matches == nil {
-		return -1, err
-	}
+// Status is used to get the status of the tape library, which slot are empty, full, and name of tape if present
+func (changer *MTXChanger) Status() (string, error) {
+	return changer.run("status")
+}
 
-	slot, err := strconv.Atoi(matches[1])
-	if err != nil {
-		return -1, err
-	}
+// TODO: need to find how does the tape drive get paired with particular file
 
-	return slot, nil
+// Load is used to load a tape form slot number "SlotNum" to drive "driveNum"
+func (changer *MTXChanger) Load(driveNum int, slotNum int) error {
+	_, err := changer.run("load", strconv.Itoa(slotNum), strconv.Itoa(driveNum))
+	return err
+}
 
+// Transfer is used to move a tape from slot number "fromSlot" to slot number "toSlot"
+func (changer *MTXChanger) Transfer(fromSlot int, toSlot int) error {
+	_, err := changer.run("transfer", strconv.Itoa(fromSlot), strconv.Itoa(toSlot))
+	return err
 }
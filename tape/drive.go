@@ -0,0 +1,168 @@
+package tape
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/benmcclelland/mtio"
+)
+
+// Drive is a tape drive holding a loaded tape. Every Write writes one record, and Read reads one record,
+// returning io.EOF when a file mark is read.
+type Drive interface {
+	io.ReadWriteCloser
+	// WriteFileMark writes a file mark at the current position
+	WriteFileMark() error
+	// Rewind positions the tape at the beginning of the medium
+	Rewind() error
+	// SpaceFileMarks skips forward "count" file marks
+	SpaceFileMarks(count int) error
+	// SpaceRecords skips forward "count" records of the current file
+	SpaceRecords(count int) error
+	// SpaceToEOM positions the tape after the last written data
+	SpaceToEOM() error
+	// Retension rewinds the tape and refreshes the position the drive reports
+	Retension() error
+	// Erase discards everything from the current position to the end of the tape
+	Erase() error
+	// FileMarkNum returns the number of the file the tape is positioned in
+	FileMarkNum() (int, error)
+	// EarlyWarning reports whether the tape is past its early warning point. The first write after it fails
+	// with ErrFull, and the little room left after it is for closing what was being written
+	EarlyWarning() (bool, error)
+}
+
+// The bits of the device independent status (mt_gstat) reported by the st driver
+const (
+	gmtEOT      = 0x20000000
+	gmtEOD      = 0x08000000
+	gmtOnline   = 0x01000000
+	gmtDoorOpen = 0x00040000
+)
+
+// scsiDrive is a drive accessed through the linux st driver, eg /dev/nst0
+type scsiDrive struct {
+	*os.File
+}
+
+// OpenDrive opens the drive at tapePath, for reading only when readOnly is set. Character devices are
+// opened as scsi tape drives, anything else as a virtual tape
+func OpenDrive(tapePath string, readOnly bool) (Drive, error) {
+	info, err := os.Stat(tapePath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		if readOnly {
+			return OpenVirtualReadOnly(tapePath)
+		}
+		return OpenVirtual(tapePath)
+	}
+
+	// The st driver refuses to open a write protected tape for writing with EROFS, and a drive without a
+	// tape with ENOMEDIUM. A drive opened read-only reads write protected tapes
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	tape, err := os.OpenFile(tapePath, flag, os.ModePerm)
+	if err != nil {
+		var errno syscall.Errno
+		if errors.As(err, &errno) {
+			return nil, &Error{Op: "open", Path: tapePath, Condition: conditionOf(errno, false), Err: errno}
+		}
+		return nil, err
+	}
+	return &scsiDrive{File: tape}, nil
+}
+
+func (drive *scsiDrive) doOp(operation mtio.Operation, count int) error {
+	err := mtio.DoOp(drive.File, mtio.NewMtOp(mtio.WithOperation(operation), mtio.WithCount(int32(count))))
+	if err != nil {
+		return drive.fail("ioctl", err)
+	}
+	return nil
+}
+
+// fail returns the error of a failed operation with the condition the drive reported
+func (drive *scsiDrive) fail(op string, err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return &Error{Op: op, Path: drive.Name(), Err: err}
+	}
+	online := true
+	if status, statusErr := mtio.GetStatus(drive.File); statusErr == nil {
+		online = status.GStat&gmtOnline != 0 && status.GStat&gmtDoorOpen == 0
+	}
+	return &Error{Op: op, Path: drive.Name(), Condition: conditionOf(errno, online), Err: errno}
+}
+
+// Read reads the next record. Reading past the end of the data (a blank check) fails with EIO on the st
+// driver; it returns io.EOF instead, like a read of a file mark
+func (drive *scsiDrive) Read(p []byte) (int, error) {
+	n, err := drive.File.Read(p)
+	if err != nil && err != io.EOF {
+		if status, statusErr := mtio.GetStatus(drive.File); statusErr == nil && status.GStat&gmtEOD != 0 {
+			return n, io.EOF
+		}
+		return n, drive.fail("read", err)
+	}
+	return n, err
+}
+
+// Write writes one record. Past the early warning, the st driver fails the first write with ENOSPC and
+// lets the following ones through, until the physical end of the tape
+func (drive *scsiDrive) Write(p []byte) (int, error) {
+	n, err := drive.File.Write(p)
+	if err != nil {
+		return n, drive.fail("write", err)
+	}
+	return n, nil
+}
+
+func (drive *scsiDrive) WriteFileMark() error {
+	return drive.doOp(mtio.MTWEOF, 1)
+}
+
+func (drive *scsiDrive) Rewind() error {
+	return drive.doOp(mtio.MTREW, 1)
+}
+
+func (drive *scsiDrive) SpaceFileMarks(count int) error {
+	return drive.doOp(mtio.MTFSF, count)
+}
+
+func (drive *scsiDrive) SpaceRecords(count int) error {
+	return drive.doOp(mtio.MTFSR, count)
+}
+
+func (drive *scsiDrive) SpaceToEOM() error {
+	return drive.doOp(mtio.MTEOM, 1)
+}
+
+func (drive *scsiDrive) Retension() error {
+	return drive.doOp(mtio.MTRETEN, 1)
+}
+
+// Erase does a short erase, which only writes an end of data mark at the current position
+func (drive *scsiDrive) Erase() error {
+	return drive.doOp(mtio.MTERASE, 0)
+}
+
+func (drive *scsiDrive) FileMarkNum() (int, error) {
+	status, err := mtio.GetStatus(drive.File)
+	if err != nil {
+		return -1, drive.fail("status", err)
+	}
+	return int(status.FileNo), nil
+}
+
+func (drive *scsiDrive) EarlyWarning() (bool, error) {
+	status, err := mtio.GetStatus(drive.File)
+	if err != nil {
+		return false, drive.fail("status", err)
+	}
+	return status.GStat&gmtEOT != 0, nil
+}
@@ -0,0 +1,83 @@
+package tape
+
+import (
+	"errors"
+	"syscall"
+)
+
+// The conditions a drive operation fails with. The drives return an *Error carrying one of them, which
+// IsFull, IsIOError, IsNotReady and IsWriteProtected test for, instead of callers matching error messages
+var (
+	ErrFull           = errors.New("end of medium")
+	ErrIO             = errors.New("medium or hardware error")
+	ErrNotReady       = errors.New("drive not ready")
+	ErrWriteProtected = errors.New("tape is write protected")
+)
+
+// Error is a failed operation of the drive at Path. Condition is one of the conditions above, nil for a
+// failure that is none of them
+type Error struct {
+	Op        string
+	Path      string
+	Condition error
+	Err       error
+}
+
+func (err *Error) Error() string {
+	message := err.Op + " " + err.Path + ": " + err.Err.Error()
+	if err.Condition != nil {
+		message += " (" + err.Condition.Error() + ")"
+	}
+	return message
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// IsFull reports whether the error is a write refused at the end of the tape, or at its early warning
+func IsFull(err error) bool {
+	return condition(err) == ErrFull
+}
+
+// IsIOError reports whether the error is a medium or hardware error
+func IsIOError(err error) bool {
+	return condition(err) == ErrIO
+}
+
+// IsNotReady reports whether the error is a drive without a tape, or whose tape isn't loaded yet
+func IsNotReady(err error) bool {
+	return condition(err) == ErrNotReady
+}
+
+// IsWriteProtected reports whether the error is a write to a write protected tape
+func IsWriteProtected(err error) bool {
+	return condition(err) == ErrWriteProtected
+}
+
+func condition(err error) error {
+	var driveErr *Error
+	if errors.As(err, &driveErr) {
+		return driveErr.Condition
+	}
+	return nil
+}
+
+// conditionOf returns the condition of an errno of the st driver, which reports a drive without a loaded
+// tape as EIO too; online tells them apart
+func conditionOf(errno syscall.Errno, online bool) error {
+	switch errno {
+	case syscall.ENOSPC:
+		return ErrFull
+	case syscall.EACCES, syscall.EROFS:
+		return ErrWriteProtected
+	case syscall.ENOMEDIUM:
+		return ErrNotReady
+	case syscall.EIO:
+		if !online {
+			return ErrNotReady
+		}
+		return ErrIO
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package tape
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Inventory is the content of a tape library as reported by "mtx status"
+type Inventory struct {
+	Drives []DriveElement
+	// Slots has the storage slots, including the import/export slots, in the order they are reported
+	Slots []SlotElement
+}
+
+// DriveElement is a drive (data transfer element) of the library
+type DriveElement struct {
+	Number int
+	Loaded bool
+	// SourceSlot is the slot the loaded tape came from, 0 if unknown
+	SourceSlot int
+	// Barcode is the volume tag of the loaded tape, "" if the tape has none
+	Barcode string
+}
+
+// SlotElement is a storage slot of the library
+type SlotElement struct {
+	Number       int
+	Full         bool
+	ImportExport bool
+	// Barcode is the volume tag of the tape in the slot, "" if the tape has none
+	Barcode string
+}
+
+// eg "Data Transfer Element 0:Full (Storage Element 1 Loaded):VolumeTag = STA000L7"
+var driveReg = regexp.MustCompile(`^Data Transfer Element (\d+):(Empty|Full)` +
+	`(?: \((?:Storage Element (\d+)|Unknown Storage Element) Loaded\))?(?::VolumeTag\s*=\s*(\S+))?`)
+
+// eg "Storage Element 2:Full :VolumeTag=STA001L7" or "Storage Element 10 IMPORT/EXPORT:Empty"
+var slotReg = regexp.MustCompile(`^Storage Element (\d+)( IMPORT/EXPORT)?:(Empty|Full)(?:\s*:VolumeTag\s*=\s*(\S+))?`)
+
+// ParseStatus parses the output of "mtx status" into an Inventory
+func ParseStatus(status string) (*Inventory, error) {
+	inventory := new(Inventory)
+
+	for _, line := range strings.Split(status, "\n") {
+		line = strings.TrimSpace(line)
+
+		if matches := driveReg.FindStringSubmatch(line); matches != nil {
+			number, _ := strconv.Atoi(matches[1])
+			sourceSlot, _ := strconv.Atoi(matches[3])
+			inventory.Drives = append(inventory.Drives, DriveElement{
+				Number:     number,
+				Loaded:     matches[2] == "Full",
+				SourceSlot: sourceSlot,
+				Barcode:    matches[4],
+			})
+			continue
+		}
+
+		if matches := slotReg.FindStringSubmatch(line); matches != nil {
+			number, _ := strconv.Atoi(matches[1])
+			inventory.Slots = append(inventory.Slots, SlotElement{
+				Number:       number,
+				Full:         matches[3] == "Full",
+				ImportExport: matches[2] != "",
+				Barcode:      matches[4],
+			})
+		}
+	}
+
+	if len(inventory.Drives) == 0 && len(inventory.Slots) == 0 {
+		return nil, errors.New("Couldn't find any drive or slot in the status of the tape library")
+	}
+	return inventory, nil
+}
+
+// GetInventory returns the current inventory of the changer
+func GetInventory(changer Changer) (*Inventory, error) {
+	status, err := changer.Status()
+	if err != nil {
+		return nil, err
+	}
+	return ParseStatus(status)
+}
+
+// EmptySlot returns the first empty storage slot that isn't an import/export slot
+func (inventory *Inventory) EmptySlot() (int, error) {
+	for _, slot := range inventory.Slots {
+		if !slot.Full && !slot.ImportExport {
+			return slot.Number, nil
+		}
+	}
+	return -1, errors.New("There is no empty slot in the tape library")
+}
+
+// FindSlot returns the slot that holds the tape with the barcode, or nil if no slot has it
+func (inventory *Inventory) FindSlot(barcode string) *SlotElement {
+	for i := range inventory.Slots {
+		if inventory.Slots[i].Full && inventory.Slots[i].Barcode == barcode {
+			return &inventory.Slots[i]
+		}
+	}
+	return nil
+}
+
+// FindDrive returns the drive that holds the tape with the barcode, or nil if no drive has it
+func (inventory *Inventory) FindDrive(barcode string) *DriveElement {
+	for i := range inventory.Drives {
+		if inventory.Drives[i].Loaded && inventory.Drives[i].Barcode == barcode {
+			return &inventory.Drives[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package tape
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Captured from a two-drive library with one import/export slot
+const statusTwoDrives = `  Storage Changer /dev/sg10:2 Drives, 6 Slots ( 1 Import/Export )
+Data Transfer Element 0:Full (Storage Element 3 Loaded):VolumeTag = STA002L7
+Data Transfer Element 1:Empty
+      Storage Element 1:Full :VolumeTag=STA000L7
+      Storage Element 2:Full :VolumeTag=STA001L7
+      Storage Element 3:Empty
+      Storage Element 4:Full
+      Storage Element 5:Empty
+      Storage Element 6 IMPORT/EXPORT:Full :VolumeTag=CLN001L1
+`
+
+// Captured from an autoloader without a barcode reader, after a power cycle with a tape in the drive
+const statusNoBarcodes = `  Storage Changer /dev/sg3:1 Drives, 8 Slots ( 0 Import/Export )
+Data Transfer Element 0:Full (Unknown Storage Element Loaded)
+      Storage Element 1:Full
+      Storage Element 2:Empty
+      Storage Element 3:Full
+      Storage Element 4:Empty
+      Storage Element 5:Empty
+      Storage Element 6:Empty
+      Storage Element 7:Empty
+      Storage Element 8 IMPORT/EXPORT:Empty
+`
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+		want   *Inventory
+		hasErr bool
+	}{
+		{
+			name:   "two drives",
+			status: statusTwoDrives,
+			want: &Inventory{
+				Drives: []DriveElement{
+					{Number: 0, Loaded: true, SourceSlot: 3, Barcode: "STA002L7"},
+					{Number: 1},
+				},
+				Slots: []SlotElement{
+					{Number: 1, Full: true, Barcode: "STA000L7"},
+					{Number: 2, Full: true, Barcode: "STA001L7"},
+					{Number: 3},
+					{Number: 4, Full: true},
+					{Number: 5},
+					{Number: 6, Full: true, ImportExport: true, Barcode: "CLN001L1"},
+				},
+			},
+		},
+		{
+			name:   "no barcodes",
+			status: statusNoBarcodes,
+			want: &Inventory{
+				Drives: []DriveElement{
+					{Number: 0, Loaded: true},
+				},
+				Slots: []SlotElement{
+					{Number: 1, Full: true},
+					{Number: 2},
+					{Number: 3, Full: true},
+					{Number: 4},
+					{Number: 5},
+					{Number: 6},
+					{Number: 7},
+					{Number: 8, ImportExport: true},
+				},
+			},
+		},
+		{
+			name:   "empty output",
+			status: "",
+			hasErr: true,
+		},
+		{
+			name:   "not a status",
+			status: "mtx: Request Sense: Long Report=yes\nmtx: cannot open SCSI device '/dev/sg10'\n",
+			hasErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inventory, err := ParseStatus(test.status)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", inventory)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(inventory, test.want) {
+				t.Errorf("got %+v, want %+v", inventory, test.want)
+			}
+		})
+	}
+}
+
+func TestInventoryLookups(t *testing.T) {
+	inventory, err := ParseStatus(statusTwoDrives)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Import/export slots are never used to unload a tape
+	if slot, err := inventory.EmptySlot(); err != nil || slot != 3 {
+		t.Errorf("EmptySlot() = %d, %v, want 3", slot, err)
+	}
+	if slot := inventory.FindSlot("STA001L7"); slot == nil || slot.Number != 2 {
+		t.Errorf("FindSlot(STA001L7) = %+v, want slot 2", slot)
+	}
+	if slot := inventory.FindSlot("STA002L7"); slot != nil {
+		t.Errorf("FindSlot(STA002L7) = %+v, want nil as the tape is in a drive", slot)
+	}
+	if drive := inventory.FindDrive("STA002L7"); drive == nil || drive.Number != 0 {
+		t.Errorf("FindDrive(STA002L7) = %+v, want drive 0", drive)
+	}
+
+	full, err := ParseStatus(`Data Transfer Element 0:Empty
+      Storage Element 1:Full :VolumeTag=STA000L7
+      Storage Element 2 IMPORT/EXPORT:Empty
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slot, err := full.EmptySlot(); err == nil {
+		t.Errorf("EmptySlot() = %d, want an error when only the import/export slot is empty", slot)
+	}
+}
@@ -0,0 +1,204 @@
+package tape
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// The version of the on-tape format, recorded in the volume label
+const FormatVersion = 1
+
+// The names of the tar entries of the records written around the backed up files. Every record is a tar
+// archive with one entry holding json, in a tape file of its own
+const (
+	LabelEntryName      = "BACKUPTEST.LABEL"
+	JobHeaderEntryName  = "BACKUPTEST.JOBHEADER"
+	JobTrailerEntryName = "BACKUPTEST.JOBTRAILER"
+)
+
+// SegmentsRecord is the PAX record of a tar entry that continues a file on a new tape, because the file
+// didn't fit on the previous one. Its value is the json of the Segments of the file up to this entry
+const SegmentsRecord = "BACKUPTEST.segments"
+
+// ErrNoLabel is returned by ReadLabel when the tape has data but doesn't start with a volume label
+var ErrNoLabel = errors.New("The tape has data but no volume label")
+
+// Label is the volume label written in the first file of every tape
+type Label struct {
+	TapeName      string
+	PoolID        int
+	LabelTime     time.Time
+	FormatVersion int
+}
+
+// JobRecord is written before (header) and after (trailer) the files of a job. A job that continues on a
+// new tape after a tape change gets another header there, with Continuation set
+type JobRecord struct {
+	JobID        int
+	Name         string
+	PoolID       int
+	StartTime    time.Time
+	Continuation bool `json:",omitempty"`
+	// Level is the backup level of the job: full, differential or incremental
+	Level string `json:",omitempty"`
+	// Only set in trailers
+	EndTime    time.Time
+	NumOfFiles int `json:",omitempty"`
+}
+
+// Segment is a part of a file written to one tape: the tar entry at TarOffset of the file at FileMarkNum,
+// whose content starts at FileOffset of the file. The first segment of a file is an ordinary entry with the
+// size of the whole file, which is cut short by the end of the tape
+type Segment struct {
+	TapeName    string
+	FileMarkNum int
+	TarOffset   int64
+	FileOffset  int64
+}
+
+// SetSegments records in the tar header of a continuation entry the segments of the file, the last of
+// them being the entry itself
+func SetSegments(header *tar.Header, segments []Segment) error {
+	content, err := json.Marshal(segments)
+	if err != nil {
+		return err
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	header.PAXRecords[SegmentsRecord] = string(content)
+	header.Format = tar.FormatPAX
+	return nil
+}
+
+// ParseSegments returns the segments recorded in a tar header, nil for an entry that isn't a continuation
+func ParseSegments(header *tar.Header) ([]Segment, error) {
+	content, found := header.PAXRecords[SegmentsRecord]
+	if !found {
+		return nil, nil
+	}
+	var segments []Segment
+	if err := json.Unmarshal([]byte(content), &segments); err != nil || len(segments) < 2 {
+		return nil, errors.New("the segments recorded with " + header.Name + " are corrupt")
+	}
+	return segments, nil
+}
+
+// IsRecordEntry reports whether a tar entry name is one of the records rather than a backed up file
+func IsRecordEntry(name string) bool {
+	return name == LabelEntryName || name == JobHeaderEntryName || name == JobTrailerEntryName
+}
+
+// writeRecord writes the record as a tape file of its own at the current position. A record written past
+// the early warning is refused once by the drive, and written again in the room left for it. That room is
+// for closing what was written; callers check EarlyWarning before starting something new, since the drive
+// only refuses one write
+func (ConfigVar *Config) writeRecord(entryName string, record interface{}) error {
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// Nothing else may be buffered, since the record goes to the drive directly
+	if err := ConfigVar.FlushBuffers(); err != nil {
+		return err
+	}
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	header := &tar.Header{
+		Name:    entryName,
+		Size:    int64(len(content)),
+		Mode:    0644,
+		ModTime: time.Now().In(time.UTC),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	// Pad the archive to whole records
+	archive.Write(make([]byte, (ConfigVar.RecordSize-archive.Len()%ConfigVar.RecordSize)%ConfigVar.RecordSize))
+
+	for archive.Len() > 0 {
+		recordBytes := archive.Next(ConfigVar.RecordSize)
+		_, err := ConfigVar.Drive.Write(recordBytes)
+		if IsFull(err) && ConfigVar.EarlyWarning() {
+			_, err = ConfigVar.Drive.Write(recordBytes)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return ConfigVar.WriteEOF()
+}
+
+// WriteLabel rewinds the tape and writes the volume label, which discards everything on the tape
+func (ConfigVar *Config) WriteLabel(label *Label) error {
+	if err := ConfigVar.Rewind(); err != nil {
+		return err
+	}
+	return ConfigVar.writeRecord(LabelEntryName, label)
+}
+
+// ReadLabel rewinds the tape and reads its volume label. It returns nil for a blank tape, and ErrNoLabel
+// for a tape whose first file is a tar archive starting with another entry. A tape that can't be read, or
+// whose first file isn't a tar archive, returns the error of the drive or of tar, so that it is never
+// taken for an unlabeled tape. The tape is left after the first file mark
+func (ConfigVar *Config) ReadLabel() (*Label, error) {
+	if err := ConfigVar.Rewind(); err != nil {
+		return nil, err
+	}
+
+	reader := ConfigVar.NewReader()
+	tr := tar.NewReader(reader)
+	header, err := tr.Next()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if header.Name != LabelEntryName {
+		return nil, ErrNoLabel
+	}
+
+	label := new(Label)
+	if err := json.NewDecoder(tr).Decode(label); err != nil {
+		return nil, errors.New(err.Error() + "; the volume label is corrupt")
+	}
+
+	// Skip the rest of the label up to the file mark
+	if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+		return nil, err
+	}
+	return label, nil
+}
+
+// WriteJobHeader writes the header of a job at the current position
+func (ConfigVar *Config) WriteJobHeader(record *JobRecord) error {
+	return ConfigVar.writeRecord(JobHeaderEntryName, record)
+}
+
+// WriteJobTrailer writes the trailer of a job at the current position
+func (ConfigVar *Config) WriteJobTrailer(record *JobRecord) error {
+	return ConfigVar.writeRecord(JobTrailerEntryName, record)
+}
+
+// ParseJobRecord decodes the content of a job header or trailer entry
+func ParseJobRecord(content io.Reader) (*JobRecord, error) {
+	record := new(JobRecord)
+	if err := json.NewDecoder(content).Decode(record); err != nil {
+		return nil, errors.New(err.Error() + "; the job record is corrupt")
+	}
+	return record, nil
+}
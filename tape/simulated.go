@@ -0,0 +1,232 @@
+package tape
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SimulatedChanger is an in-process tape library whose state is persisted in a json file, so that tape
+// changes can be exercised without hardware. Its tapes are virtual tape files named after their
+// barcode; loading a tape points the drive's path at the tape's file with a symbolic link, so the drive
+// is opened like any other virtual tape.
+type SimulatedChanger struct {
+	StatePath string
+}
+
+// SimulatedLibrary is the persisted state of a SimulatedChanger
+type SimulatedLibrary struct {
+	// TapeDir is the directory with the virtual tape files
+	TapeDir string
+	// Capacity is the capacity of the virtual tape files created on first load
+	Capacity int64
+	Drives   []SimulatedDrive
+	Slots    []SimulatedSlot
+}
+
+// SimulatedDrive is a drive of a SimulatedLibrary; drive numbers are the indexes in Drives
+type SimulatedDrive struct {
+	Path       string
+	Barcode    string
+	SourceSlot int
+}
+
+// SimulatedSlot is a storage slot of a SimulatedLibrary; slot numbers start at 1
+type SimulatedSlot struct {
+	Barcode      string
+	ImportExport bool
+}
+
+// CreateSimulatedLibrary writes the state file of a new simulated library. The barcodes are placed in
+// the first storage slots, and the import/export slots come after the storage slots
+func CreateSimulatedLibrary(statePath string, library *SimulatedLibrary, slots int, importExport int, barcodes []string) error {
+	if len(barcodes) > slots {
+		return errors.New("There are more barcodes than slots")
+	}
+	library.Slots = make([]SimulatedSlot, slots+importExport)
+	for i := range library.Slots {
+		library.Slots[i].ImportExport = i >= slots
+		if i < len(barcodes) {
+			library.Slots[i].Barcode = barcodes[i]
+		}
+	}
+	if err := os.MkdirAll(library.TapeDir, 0755); err != nil {
+		return err
+	}
+	return (&SimulatedChanger{StatePath: statePath}).save(library)
+}
+
+func (changer *SimulatedChanger) load() (*SimulatedLibrary, error) {
+	bytesRead, err := ioutil.ReadFile(changer.StatePath)
+	if err != nil {
+		return nil, err
+	}
+	library := new(SimulatedLibrary)
+	if err := json.Unmarshal(bytesRead, library); err != nil {
+		return nil, errors.New(err.Error() + "; " + changer.StatePath + " is not a simulated library")
+	}
+	return library, nil
+}
+
+func (changer *SimulatedChanger) save(library *SimulatedLibrary) error {
+	bytesWritten, err := json.MarshalIndent(library, "", "\t")
+	if err != nil {
+		return err
+	}
+	temp := changer.StatePath + ".tmp"
+	if err := ioutil.WriteFile(temp, bytesWritten, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, changer.StatePath)
+}
+
+// element returns the drive and slot sent as parameter, checking that they exist
+func (library *SimulatedLibrary) element(driveNum int, slotNum int) (*SimulatedDrive, *SimulatedSlot, error) {
+	if driveNum < 0 || driveNum >= len(library.Drives) {
+		return nil, nil, errors.New("Invalid Data Transfer Element " + strconv.Itoa(driveNum))
+	}
+	slot, err := library.slot(slotNum)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &library.Drives[driveNum], slot, nil
+}
+
+func (library *SimulatedLibrary) slot(slotNum int) (*SimulatedSlot, error) {
+	if slotNum < 1 || slotNum > len(library.Slots) {
+		return nil, errors.New("Invalid Storage Element " + strconv.Itoa(slotNum))
+	}
+	return &library.Slots[slotNum-1], nil
+}
+
+// Load is used to load a tape from slot number "slotNum" to drive "driveNum"
+func (changer *SimulatedChanger) Load(driveNum int, slotNum int) error {
+	library, err := changer.load()
+	if err != nil {
+		return err
+	}
+	drive, slot, err := library.element(driveNum, slotNum)
+	if err != nil {
+		return err
+	}
+	if drive.Barcode != "" {
+		return errors.New("Drive " + strconv.Itoa(driveNum) + " Full (Storage Element " +
+			strconv.Itoa(drive.SourceSlot) + " loaded)")
+	}
+	if slot.Barcode == "" {
+		return errors.New("source Element Address " + strconv.Itoa(slotNum) + " is Empty")
+	}
+
+	tapePath := filepath.Join(library.TapeDir, slot.Barcode+".vtape")
+	if _, err := os.Stat(tapePath); os.IsNotExist(err) {
+		if err := CreateVirtual(tapePath, library.Capacity); err != nil {
+			return err
+		}
+	}
+	os.Remove(drive.Path)
+	if err := os.Symlink(tapePath, drive.Path); err != nil {
+		return err
+	}
+
+	drive.Barcode = slot.Barcode
+	drive.SourceSlot = slotNum
+	slot.Barcode = ""
+	return changer.save(library)
+}
+
+// Unload is used to unload a tape from drive "driveNum", and place the tape in slot number "slotNum"
+func (changer *SimulatedChanger) Unload(driveNum int, slotNum int) error {
+	library, err := changer.load()
+	if err != nil {
+		return err
+	}
+	drive, slot, err := library.element(driveNum, slotNum)
+	if err != nil {
+		return err
+	}
+	if drive.Barcode == "" {
+		return errors.New("Data Transfer Element " + strconv.Itoa(driveNum) + " is Empty")
+	}
+	if slot.Barcode != "" {
+		return errors.New("Storage Element " + strconv.Itoa(slotNum) + " is Already Full")
+	}
+
+	if err := os.Remove(drive.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	slot.Barcode = drive.Barcode
+	drive.Barcode = ""
+	drive.SourceSlot = 0
+	return changer.save(library)
+}
+
+// Transfer is used to move a tape from slot number "fromSlot" to slot number "toSlot"
+func (changer *SimulatedChanger) Transfer(fromSlot int, toSlot int) error {
+	library, err := changer.load()
+	if err != nil {
+		return err
+	}
+	from, err := library.slot(fromSlot)
+	if err != nil {
+		return err
+	}
+	to, err := library.slot(toSlot)
+	if err != nil {
+		return err
+	}
+	if from.Barcode == "" {
+		return errors.New("source Element Address " + strconv.Itoa(fromSlot) + " is Empty")
+	}
+	if to.Barcode != "" {
+		return errors.New("destination Element Address " + strconv.Itoa(toSlot) + " is Already Full")
+	}
+
+	to.Barcode = from.Barcode
+	from.Barcode = ""
+	return changer.save(library)
+}
+
+// Status returns the state of the library in the format printed by "mtx status"
+func (changer *SimulatedChanger) Status() (string, error) {
+	library, err := changer.load()
+	if err != nil {
+		return "", err
+	}
+
+	importExport := 0
+	for _, slot := range library.Slots {
+		if slot.ImportExport {
+			importExport++
+		}
+	}
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "  Storage Changer %s:%d Drives, %d Slots ( %d Import/Export )\n",
+		changer.StatePath, len(library.Drives), len(library.Slots), importExport)
+	for i, drive := range library.Drives {
+		if drive.Barcode == "" {
+			fmt.Fprintf(&status, "Data Transfer Element %d:Empty\n", i)
+			continue
+		}
+		fmt.Fprintf(&status, "Data Transfer Element %d:Full (Storage Element %d Loaded):VolumeTag = %s\n",
+			i, drive.SourceSlot, drive.Barcode)
+	}
+	for i, slot := range library.Slots {
+		kind := ""
+		if slot.ImportExport {
+			kind = " IMPORT/EXPORT"
+		}
+		if slot.Barcode == "" {
+			fmt.Fprintf(&status, "      Storage Element %d%s:Empty\n", i+1, kind)
+			continue
+		}
+		fmt.Fprintf(&status, "      Storage Element %d%s:Full :VolumeTag=%s\n", i+1, kind, slot.Barcode)
+	}
+	return status.String(), nil
+}
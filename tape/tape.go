@@ -3,66 +3,69 @@ package tape
 import (
 	"bufio"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
-	"regexp"
-
-	"github.com/benmcclelland/mtio"
 )
 
 type Config struct {
 	TapePath        string
 	RecordSize      int
-	Tape            *os.File
+	Drive           Drive
 	TapeWriter      *bufio.Writer
 	lowerTapeBuffer *bufio.Writer
+	// ReadOnly is whether the drive is opened for reading only, eg to restore from write protected tapes
+	ReadOnly bool
 }
 
-var emptyReg *regexp.Regexp
-var fullReg *regexp.Regexp
+func New(tapePath string, recordSize int) (*Config, error) {
+	return open(tapePath, recordSize, false)
+}
 
-func init() {
-	emptyExp := "Storage.*\\s(\\d+):Empty.*"
-	fullExp := "Storage.*\\s(\\d+):Full.*=(.*)"
-	var err error
-	emptyReg, err = regexp.Compile(emptyExp)
-	if err != nil {
-		return
-	}
-	fullReg, err = regexp.Compile(fullExp)
-	if err != nil {
-		return
-	}
+// NewReadOnly opens the drive for reading only, so that write protected tapes can be read
+func NewReadOnly(tapePath string, recordSize int) (*Config, error) {
+	return open(tapePath, recordSize, true)
 }
 
-func New(tapePath string, recordSize int) (*Config, error) {
-	tape, err := os.OpenFile(tapePath, os.O_RDWR, os.ModePerm)
+func open(tapePath string, recordSize int, readOnly bool) (*Config, error) {
+	drive, err := OpenDrive(tapePath, readOnly)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return nil, err
 	}
 
-	// This is the low level writer that will directly write to the tape at block size of 4096
-	lowerTapeBuffer := bufio.NewWriterSize(tape, recordSize)
+	config := NewWithDrive(tapePath, drive, recordSize)
+	config.ReadOnly = readOnly
+	return config, nil
+}
+
+// NewWithDrive sets up the buffers used to write to an already opened drive
+func NewWithDrive(tapePath string, drive Drive, recordSize int) *Config {
+	// This is the low level writer that will directly write to the tape at block size of recordSize
+	lowerTapeBuffer := bufio.NewWriterSize(drive, recordSize)
 
-	// This is the buffer that will be used to maintain structure of tar while writing to tape
-	tapeWriter := bufio.NewWriter(lowerTapeBuffer)
+	// This is the buffer that will be used to maintain structure of tar while writing to tape. It is no
+	// larger than a record: a bufio.Writer passes the writes larger than its buffer on as they are, and the
+	// lower buffer would pass them to the drive as records larger than recordSize
+	tapeWriter := bufio.NewWriterSize(lowerTapeBuffer, recordSize)
 
 	return &Config{
 		TapePath:        tapePath,
 		RecordSize:      recordSize,
-		Tape:            tape,
+		Drive:           drive,
 		TapeWriter:      tapeWriter,
 		lowerTapeBuffer: lowerTapeBuffer,
-	}, nil
+	}
 }
 
 func (ConfigVar *Config) DeepCopy(tapePath string) error {
-	temp, err := New(tapePath, ConfigVar.RecordSize)
+	// The tape loaded instead is opened the same way
+	temp, err := open(tapePath, ConfigVar.RecordSize, ConfigVar.ReadOnly)
 	if err != nil {
 		return err
 	}
 	ConfigVar.lowerTapeBuffer = temp.lowerTapeBuffer
-	ConfigVar.Tape = temp.Tape
+	ConfigVar.Drive = temp.Drive
 	ConfigVar.TapeWriter = temp.TapeWriter
 	ConfigVar.TapePath = temp.TapePath
 
@@ -76,23 +79,137 @@ func (ConfigVar *Config) FlushBuffers() error {
 	return ConfigVar.lowerTapeBuffer.Flush()
 }
 
+// Buffered returns the number of bytes written with TapeWriter that haven't reached the drive yet
+func (ConfigVar *Config) Buffered() int {
+	buffered := ConfigVar.TapeWriter.Buffered()
+	// bufio.NewWriterSize returns the lower buffer itself when it is already as large as a record
+	if ConfigVar.lowerTapeBuffer != ConfigVar.TapeWriter {
+		buffered += ConfigVar.lowerTapeBuffer.Buffered()
+	}
+	return buffered
+}
+
 func (ConfigVar *Config) CloseTape() error {
-	return ConfigVar.Tape.Close()
+	return ConfigVar.Drive.Close()
 }
 
 func (ConfigVar *Config) WriteEOF() error {
-	return mtio.DoOp(ConfigVar.Tape, mtio.NewMtOp(mtio.WithOperation(mtio.MTWEOF)))
+	return ConfigVar.Drive.WriteFileMark()
 }
 
 func (ConfigVar *Config) JumpToEOM() error {
-	return mtio.DoOp(ConfigVar.Tape, mtio.NewMtOp(mtio.WithOperation(mtio.MTEOM)))
+	return ConfigVar.Drive.SpaceToEOM()
 }
 
 func (ConfigVar *Config) GetFileMarkNum() int {
-	struc, _ := mtio.GetStatus(ConfigVar.Tape)
-	return int(struc.FileNo)
+	fileMarkNum, _ := ConfigVar.Drive.FileMarkNum()
+	return fileMarkNum
+}
+
+// EarlyWarning reports whether the tape is past its early warning, near its end
+func (ConfigVar *Config) EarlyWarning() bool {
+	earlyWarning, _ := ConfigVar.Drive.EarlyWarning()
+	return earlyWarning
 }
 
 func (ConfigVar *Config) RetensionOfTape() error {
-	return mtio.DoOp(ConfigVar.Tape, mtio.NewMtOp(mtio.WithOperation(mtio.MTRETEN)))
+	return ConfigVar.Drive.Retension()
+}
+
+// Rewind positions the tape at the beginning of the medium
+func (ConfigVar *Config) Rewind() error {
+	return ConfigVar.Drive.Rewind()
+}
+
+// Erase rewinds the tape and discards everything on it
+func (ConfigVar *Config) Erase() error {
+	if err := ConfigVar.Rewind(); err != nil {
+		return err
+	}
+	return ConfigVar.Drive.Erase()
+}
+
+// SpaceToFileMark leaves the tape at the start of the file that GetFileMarkNum reported when it was
+// written. It spaces forward from the current position when the file is ahead, and rewinds otherwise
+func (ConfigVar *Config) SpaceToFileMark(fileMarkNum int) error {
+	current := ConfigVar.GetFileMarkNum()
+	if current >= fileMarkNum {
+		if err := ConfigVar.Rewind(); err != nil {
+			return err
+		}
+		current = 0
+	}
+	if current == fileMarkNum {
+		return nil
+	}
+	return ConfigVar.Drive.SpaceFileMarks(fileMarkNum - current)
+}
+
+// NewReader returns a reader that reads the tape one record at a time from the current position; it
+// returns io.EOF when the next file mark is reached
+func (ConfigVar *Config) NewReader() io.Reader {
+	return bufio.NewReaderSize(ConfigVar.Drive, ConfigVar.RecordSize)
+}
+
+// ArchiveReader reads a tape file from its start, and skips forward to offsets in it by spacing over the
+// records in between rather than reading them. The file must have been written in records of RecordSize
+type ArchiveReader struct {
+	config *Config
+	reader *bufio.Reader
+	// records is the number of records read or spaced over, offset the offset of the next byte read
+	records int64
+	offset  int64
+}
+
+// NewArchiveReader positions the tape at the start of the file that GetFileMarkNum reported when it was
+// written, and returns a reader of the file
+func (ConfigVar *Config) NewArchiveReader(fileMarkNum int) (*ArchiveReader, error) {
+	if err := ConfigVar.SpaceToFileMark(fileMarkNum); err != nil {
+		return nil, err
+	}
+	archive := &ArchiveReader{config: ConfigVar}
+	archive.reader = bufio.NewReaderSize(recordCounter{archive}, ConfigVar.RecordSize)
+	return archive, nil
+}
+
+// recordCounter counts the records the buffer of an ArchiveReader reads from the drive
+type recordCounter struct {
+	archive *ArchiveReader
+}
+
+func (counter recordCounter) Read(p []byte) (int, error) {
+	n, err := counter.archive.config.Drive.Read(p)
+	if n > 0 {
+		counter.archive.records++
+	}
+	return n, err
+}
+
+func (archive *ArchiveReader) Read(p []byte) (int, error) {
+	n, err := archive.reader.Read(p)
+	archive.offset += int64(n)
+	return n, err
+}
+
+// Offset returns the offset in the file of the next byte read
+func (archive *ArchiveReader) Offset() int64 {
+	return archive.offset
+}
+
+// SkipTo moves forward to an offset of the file; the records before the one holding it aren't read
+func (archive *ArchiveReader) SkipTo(offset int64) error {
+	if offset < archive.offset {
+		return fmt.Errorf("can't move back from offset %d to %d of the file", archive.offset, offset)
+	}
+	recordSize := int64(archive.config.RecordSize)
+	if record := offset / recordSize; record > archive.records {
+		if err := archive.config.Drive.SpaceRecords(int(record - archive.records)); err != nil {
+			return err
+		}
+		archive.records = record
+		archive.offset = record * recordSize
+		archive.reader.Reset(recordCounter{archive})
+	}
+	_, err := io.CopyN(ioutil.Discard, archive, offset-archive.offset)
+	return err
 }
@@ -0,0 +1,321 @@
+package tape
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// The first bytes of every virtual tape file
+var virtualMagic = []byte("VTAPE001")
+
+// The size of the virtual tape header: the magic followed by the capacity
+var virtualHeaderSize = int64(len(virtualMagic) + 8)
+
+// The capacity of a virtual tape created by opening an empty file
+var DefaultVirtualCapacity int64 = 1 << 30
+
+const (
+	virtualRecord   = 'R'
+	virtualFileMark = 'M'
+)
+
+// virtualEntry is a record or a file mark stored in the virtual tape file
+type virtualEntry struct {
+	kind   byte
+	offset int64 // offset of the record's data in the file
+	length int   // length of the record's data
+}
+
+// VirtualDrive is a tape emulated in a regular file. The file holds the capacity of the tape followed by
+// the records and file marks in the order they were written; every entry is a kind byte, and records
+// have their length and data after it. Writing anywhere but at the end discards what follows, like on
+// a real tape. Like the st driver, the first write past the early warning fails with ErrFull, and the
+// following ones succeed until the capacity is reached.
+type VirtualDrive struct {
+	file     *os.File
+	capacity int64
+	used     int64
+	entries  []virtualEntry
+	position int
+	// warned is whether a write past the early warning was refused already
+	warned bool
+	// readOnly is whether the tape was opened for reading only
+	readOnly bool
+}
+
+// earlyWarning returns the number of bytes after which the tape is past its early warning: what is
+// left for closing the archives is a 32nd of the tape, between 64 KiB and a quarter of it
+func (drive *VirtualDrive) earlyWarning() int64 {
+	reserve := drive.capacity / 32
+	if reserve < 64<<10 {
+		reserve = 64 << 10
+	}
+	if reserve > drive.capacity/4 {
+		reserve = drive.capacity / 4
+	}
+	return drive.capacity - reserve
+}
+
+// fail returns the error of a failed operation
+func (drive *VirtualDrive) fail(op string, condition error, errno syscall.Errno) error {
+	return &Error{Op: op, Path: drive.file.Name(), Condition: condition, Err: errno}
+}
+
+// CreateVirtual creates an empty virtual tape file with the given capacity in bytes
+func CreateVirtual(tapePath string, capacity int64) error {
+	file, err := os.OpenFile(tapePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := writeVirtualHeader(file, capacity); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// OpenVirtual opens the virtual tape file at tapePath, positioned at the beginning of the tape. An empty
+// file becomes a blank tape of DefaultVirtualCapacity
+func OpenVirtual(tapePath string) (*VirtualDrive, error) {
+	return openVirtual(tapePath, false)
+}
+
+// OpenVirtualReadOnly opens the virtual tape file at tapePath for reading only. Like on a drive opened
+// read-only, writing to it fails with EBADF
+func OpenVirtualReadOnly(tapePath string) (*VirtualDrive, error) {
+	return openVirtual(tapePath, true)
+}
+
+func openVirtual(tapePath string, readOnly bool) (*VirtualDrive, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(tapePath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// The st driver lets a drive be opened once at a time, and refuses the other opens with EBUSY. The tape
+	// is locked while it is open in the same way, until Close
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = syscall.EBUSY
+		}
+		return nil, &Error{Op: "open", Path: tapePath, Err: err}
+	}
+	drive := &VirtualDrive{file: file, readOnly: readOnly}
+	if err := drive.load(); err != nil {
+		file.Close()
+		return nil, errors.New(err.Error() + "; " + tapePath + " is not a virtual tape")
+	}
+	return drive, nil
+}
+
+func writeVirtualHeader(file *os.File, capacity int64) error {
+	header := make([]byte, virtualHeaderSize)
+	copy(header, virtualMagic)
+	binary.BigEndian.PutUint64(header[len(virtualMagic):], uint64(capacity))
+	_, err := file.WriteAt(header, 0)
+	return err
+}
+
+// load reads the header and indexes the entries of the file
+func (drive *VirtualDrive) load() error {
+	info, err := drive.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		drive.capacity = DefaultVirtualCapacity
+		return writeVirtualHeader(drive.file, drive.capacity)
+	}
+
+	header := make([]byte, virtualHeaderSize)
+	if _, err := drive.file.ReadAt(header, 0); err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:len(virtualMagic)], virtualMagic) {
+		return errors.New("bad magic")
+	}
+	drive.capacity = int64(binary.BigEndian.Uint64(header[len(virtualMagic):]))
+
+	offset := virtualHeaderSize
+	entryHeader := make([]byte, 5)
+	for offset < info.Size() {
+		if _, err := drive.file.ReadAt(entryHeader[:1], offset); err != nil {
+			return err
+		}
+		switch entryHeader[0] {
+		case virtualFileMark:
+			drive.entries = append(drive.entries, virtualEntry{kind: virtualFileMark, offset: offset + 1})
+			offset++
+		case virtualRecord:
+			if _, err := drive.file.ReadAt(entryHeader, offset); err != nil {
+				return err
+			}
+			length := int(binary.BigEndian.Uint32(entryHeader[1:]))
+			drive.entries = append(drive.entries, virtualEntry{kind: virtualRecord, offset: offset + 5, length: length})
+			drive.used += int64(length)
+			offset += 5 + int64(length)
+		default:
+			return errors.New("corrupt entry")
+		}
+	}
+	return nil
+}
+
+// truncate discards every entry from the current position onwards, so that a new entry can be appended
+func (drive *VirtualDrive) truncate() error {
+	if drive.readOnly {
+		return drive.fail("write", nil, syscall.EBADF)
+	}
+	if drive.position == len(drive.entries) {
+		return nil
+	}
+	end := drive.entries[drive.position].offset - 1
+	if drive.entries[drive.position].kind == virtualRecord {
+		end -= 4
+	}
+	for _, entry := range drive.entries[drive.position:] {
+		drive.used -= int64(entry.length)
+	}
+	drive.entries = drive.entries[:drive.position]
+	if drive.used < drive.earlyWarning() {
+		drive.warned = false
+	}
+	return drive.file.Truncate(end)
+}
+
+// end returns the offset in the file after the last entry
+func (drive *VirtualDrive) end() int64 {
+	if len(drive.entries) == 0 {
+		return virtualHeaderSize
+	}
+	last := drive.entries[len(drive.entries)-1]
+	return last.offset + int64(last.length)
+}
+
+// Write writes p as one record
+func (drive *VirtualDrive) Write(p []byte) (int, error) {
+	if err := drive.truncate(); err != nil {
+		return 0, err
+	}
+	if drive.used+int64(len(p)) > drive.capacity || (drive.used >= drive.earlyWarning() && !drive.warned) {
+		drive.warned = true
+		return 0, drive.fail("write", ErrFull, syscall.ENOSPC)
+	}
+
+	offset := drive.end()
+	record := make([]byte, 5+len(p))
+	record[0] = virtualRecord
+	binary.BigEndian.PutUint32(record[1:], uint32(len(p)))
+	copy(record[5:], p)
+	if _, err := drive.file.WriteAt(record, offset); err != nil {
+		return 0, err
+	}
+
+	drive.entries = append(drive.entries, virtualEntry{kind: virtualRecord, offset: offset + 5, length: len(p)})
+	drive.used += int64(len(p))
+	drive.position++
+	return len(p), nil
+}
+
+// Read reads the next record into p. Like the st driver, it fails if the record doesn't fit in p, and
+// returns io.EOF after moving past a file mark or when there's no more data
+func (drive *VirtualDrive) Read(p []byte) (int, error) {
+	if drive.position == len(drive.entries) {
+		return 0, io.EOF
+	}
+	entry := drive.entries[drive.position]
+	if entry.kind == virtualFileMark {
+		drive.position++
+		return 0, io.EOF
+	}
+	if entry.length > len(p) {
+		return 0, drive.fail("read", nil, syscall.ENOMEM)
+	}
+	n, err := drive.file.ReadAt(p[:entry.length], entry.offset)
+	if err != nil {
+		return n, err
+	}
+	drive.position++
+	return n, nil
+}
+
+func (drive *VirtualDrive) WriteFileMark() error {
+	if err := drive.truncate(); err != nil {
+		return err
+	}
+	offset := drive.end()
+	if _, err := drive.file.WriteAt([]byte{virtualFileMark}, offset); err != nil {
+		return err
+	}
+	drive.entries = append(drive.entries, virtualEntry{kind: virtualFileMark, offset: offset + 1})
+	drive.position++
+	return nil
+}
+
+func (drive *VirtualDrive) Rewind() error {
+	drive.position, drive.warned = 0, false
+	return nil
+}
+
+func (drive *VirtualDrive) SpaceFileMarks(count int) error {
+	for count > 0 {
+		if drive.position == len(drive.entries) {
+			return drive.fail("space", ErrIO, syscall.EIO)
+		}
+		if drive.entries[drive.position].kind == virtualFileMark {
+			count--
+		}
+		drive.position++
+	}
+	return nil
+}
+
+// SpaceRecords fails with EIO at a file mark or the end of the data, like the st driver
+func (drive *VirtualDrive) SpaceRecords(count int) error {
+	for ; count > 0; count-- {
+		if drive.position == len(drive.entries) || drive.entries[drive.position].kind == virtualFileMark {
+			return drive.fail("space", ErrIO, syscall.EIO)
+		}
+		drive.position++
+	}
+	return nil
+}
+
+func (drive *VirtualDrive) SpaceToEOM() error {
+	drive.position = len(drive.entries)
+	return nil
+}
+
+func (drive *VirtualDrive) Retension() error {
+	return drive.Rewind()
+}
+
+func (drive *VirtualDrive) Erase() error {
+	return drive.truncate()
+}
+
+func (drive *VirtualDrive) FileMarkNum() (int, error) {
+	fileMarkNum := 0
+	for _, entry := range drive.entries[:drive.position] {
+		if entry.kind == virtualFileMark {
+			fileMarkNum++
+		}
+	}
+	return fileMarkNum, nil
+}
+
+func (drive *VirtualDrive) EarlyWarning() (bool, error) {
+	return drive.used >= drive.earlyWarning(), nil
+}
+
+func (drive *VirtualDrive) Close() error {
+	return drive.file.Close()
+}
@@ -0,0 +1,321 @@
+package tape
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// createVirtual creates a virtual tape of the capacity in a temporary directory, and returns it opened
+// with the function that removes it
+func createVirtual(t *testing.T, capacity int64) (*VirtualDrive, string, func()) {
+	dir, err := ioutil.TempDir("", "tape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tapePath := filepath.Join(dir, "tape0")
+	if err := CreateVirtual(tapePath, capacity); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	drive, err := OpenVirtual(tapePath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return drive, tapePath, func() {
+		drive.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// record returns a record of the size filled with the byte
+func record(b byte, size int) []byte {
+	return bytes.Repeat([]byte{b}, size)
+}
+
+// readRecord reads the next record of the drive, and fails the test unless it is want
+func readRecord(t *testing.T, drive Drive, want []byte) {
+	t.Helper()
+	buffer := make([]byte, 64<<10)
+	n, err := drive.Read(buffer)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(buffer[:n], want) {
+		t.Fatalf("read %d bytes, want %d bytes of %q", n, len(want), want[:1])
+	}
+}
+
+// readEOF reads the next record of the drive, and fails the test unless it is a file mark or the end of
+// the data
+func readEOF(t *testing.T, drive Drive) {
+	t.Helper()
+	if n, err := drive.Read(make([]byte, 64<<10)); n != 0 || err != io.EOF {
+		t.Fatalf("read = %d, %v, want 0, EOF", n, err)
+	}
+}
+
+func TestVirtualRecordsAndFileMarks(t *testing.T) {
+	drive, tapePath, cleanup := createVirtual(t, 1<<20)
+	defer cleanup()
+
+	// Two files of records of different sizes, like two archives
+	for _, r := range [][]byte{record('a', 4096), record('b', 512), nil, record('c', 10240)} {
+		if r == nil {
+			if err := drive.WriteFileMark(); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if n, err := drive.Write(r); n != len(r) || err != nil {
+			t.Fatalf("write = %d, %v", n, err)
+		}
+	}
+	if err := drive.WriteFileMark(); err != nil {
+		t.Fatal(err)
+	}
+	if fileMarkNum, _ := drive.FileMarkNum(); fileMarkNum != 2 {
+		t.Errorf("FileMarkNum() = %d at the end of the data, want 2", fileMarkNum)
+	}
+
+	// The tape reads back the same whether it was just written or reopened
+	check := func(drive *VirtualDrive) {
+		if err := drive.Rewind(); err != nil {
+			t.Fatal(err)
+		}
+		readRecord(t, drive, record('a', 4096))
+		readRecord(t, drive, record('b', 512))
+		readEOF(t, drive)
+		if fileMarkNum, _ := drive.FileMarkNum(); fileMarkNum != 1 {
+			t.Errorf("FileMarkNum() = %d after the first file mark, want 1", fileMarkNum)
+		}
+		readRecord(t, drive, record('c', 10240))
+		readEOF(t, drive)
+		readEOF(t, drive)
+	}
+	check(drive)
+	drive.Close()
+	reopened, err := OpenVirtual(tapePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+
+	// Like the st driver, a record larger than the buffer is an error and isn't skipped
+	reopened.Rewind()
+	if _, err := reopened.Read(make([]byte, 512)); !errors.Is(err, syscall.ENOMEM) {
+		t.Errorf("read of a 4096 bytes record in 512 bytes = %v, want ENOMEM", err)
+	}
+	readRecord(t, reopened, record('a', 4096))
+}
+
+func TestVirtualSpacing(t *testing.T) {
+	drive, _, cleanup := createVirtual(t, 1<<20)
+	defer cleanup()
+	for _, b := range []byte{'a', 'b', 'c'} {
+		drive.Write(record(b, 512))
+		drive.Write(record(b, 512))
+		drive.WriteFileMark()
+	}
+
+	drive.Rewind()
+	if err := drive.SpaceFileMarks(2); err != nil {
+		t.Fatal(err)
+	}
+	readRecord(t, drive, record('c', 512))
+
+	drive.Rewind()
+	if err := drive.SpaceRecords(1); err != nil {
+		t.Fatal(err)
+	}
+	readRecord(t, drive, record('a', 512))
+	// Spacing records stops at a file mark
+	if err := drive.SpaceRecords(1); !IsIOError(err) {
+		t.Errorf("SpaceRecords() over a file mark = %v, want an I/O error", err)
+	}
+
+	drive.Rewind()
+	if err := drive.SpaceFileMarks(4); !IsIOError(err) {
+		t.Errorf("SpaceFileMarks() past the end of the data = %v, want an I/O error", err)
+	}
+}
+
+func TestVirtualOverwrite(t *testing.T) {
+	drive, tapePath, cleanup := createVirtual(t, 1<<20)
+	defer cleanup()
+	for _, b := range []byte{'a', 'b', 'c'} {
+		drive.Write(record(b, 512))
+		drive.WriteFileMark()
+	}
+
+	// Writing after the first file discards the others, like on a real tape
+	drive.Rewind()
+	drive.SpaceFileMarks(1)
+	drive.Write(record('d', 1024))
+	drive.WriteFileMark()
+	drive.Close()
+
+	reopened, err := OpenVirtual(tapePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	readRecord(t, reopened, record('a', 512))
+	readEOF(t, reopened)
+	readRecord(t, reopened, record('d', 1024))
+	readEOF(t, reopened)
+	readEOF(t, reopened)
+	if reopened.used != 512+1024 {
+		t.Errorf("used = %d, want %d", reopened.used, 512+1024)
+	}
+}
+
+func TestVirtualCapacity(t *testing.T) {
+	const capacity = 1 << 20
+	drive, _, cleanup := createVirtual(t, capacity)
+	defer cleanup()
+	// A 32nd of a small tape is less than the 64 KiB kept at least
+	earlyWarning := drive.earlyWarning()
+	if earlyWarning != capacity-64<<10 {
+		t.Fatalf("early warning at %d of a %d bytes tape, want %d", earlyWarning, capacity, capacity-64<<10)
+	}
+
+	// The first write past the early warning fails with ENOSPC
+	written := int64(0)
+	for written < earlyWarning {
+		if _, err := drive.Write(record('a', 4096)); err != nil {
+			t.Fatalf("write at %d before the early warning at %d: %v", written, earlyWarning, err)
+		}
+		written += 4096
+	}
+	if warning, _ := drive.EarlyWarning(); !warning {
+		t.Error("EarlyWarning() = false past the early warning")
+	}
+	_, err := drive.Write(record('b', 4096))
+	if !IsFull(err) || !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("write past the early warning = %v, want ENOSPC", err)
+	}
+
+	// The following writes succeed up to the capacity, which is never exceeded
+	for written+4096 <= capacity {
+		if _, err := drive.Write(record('c', 4096)); err != nil {
+			t.Fatalf("write at %d after the early warning: %v", written, err)
+		}
+		written += 4096
+	}
+	if _, err := drive.Write(record('d', 4096)); !IsFull(err) {
+		t.Fatalf("write past the capacity = %v, want ENOSPC", err)
+	}
+	if _, err := drive.Write(record('d', 4096)); !IsFull(err) {
+		t.Fatalf("second write past the capacity = %v, want ENOSPC", err)
+	}
+	// File marks take no room
+	if err := drive.WriteFileMark(); err != nil {
+		t.Fatal(err)
+	}
+	if drive.used != capacity {
+		t.Errorf("used = %d, want the capacity %d", drive.used, capacity)
+	}
+
+	// Rewriting the tape from its start gives the room back
+	drive.Rewind()
+	if _, err := drive.Write(record('e', 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if warning, _ := drive.EarlyWarning(); warning {
+		t.Error("EarlyWarning() = true at the start of a rewritten tape")
+	}
+}
+
+func TestVirtualOpenedOnce(t *testing.T) {
+	drive, tapePath, cleanup := createVirtual(t, 1<<20)
+	defer cleanup()
+
+	// Like the st driver, a drive that is open can't be opened again, eg by a second backup of its pool
+	if second, err := OpenVirtual(tapePath); !errors.Is(err, syscall.EBUSY) {
+		if err == nil {
+			second.Close()
+		}
+		t.Fatalf("second OpenVirtual() = %v, want EBUSY", err)
+	}
+	drive.Close()
+	reopened, err := OpenVirtual(tapePath)
+	if err != nil {
+		t.Fatalf("OpenVirtual() once the drive is closed: %v", err)
+	}
+	reopened.Close()
+}
+
+func TestVirtualReadOnly(t *testing.T) {
+	drive, tapePath, cleanup := createVirtual(t, 1<<20)
+	defer cleanup()
+	drive.Write(record('a', 1024))
+	drive.WriteFileMark()
+	drive.Write(record('b', 1024))
+	drive.Close()
+
+	readOnly, err := OpenVirtualReadOnly(tapePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	if err := readOnly.SpaceFileMarks(1); err != nil {
+		t.Fatal(err)
+	}
+	readRecord(t, readOnly, record('b', 1024))
+
+	// Nothing is written, nor discarded
+	readOnly.Rewind()
+	if _, err := readOnly.Write(record('c', 1024)); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Write() = %v, want EBADF", err)
+	}
+	if err := readOnly.WriteFileMark(); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("WriteFileMark() = %v, want EBADF", err)
+	}
+	if err := readOnly.Erase(); !errors.Is(err, syscall.EBADF) {
+		t.Errorf("Erase() = %v, want EBADF", err)
+	}
+	readRecord(t, readOnly, record('a', 1024))
+	readEOF(t, readOnly)
+	readRecord(t, readOnly, record('b', 1024))
+	readEOF(t, readOnly)
+}
+
+func TestOpenVirtual(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tape")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An empty file is a blank tape of the default capacity
+	blank := filepath.Join(dir, "blank")
+	if err := ioutil.WriteFile(blank, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	drive, err := OpenVirtual(blank)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drive.capacity != DefaultVirtualCapacity {
+		t.Errorf("capacity = %d, want %d", drive.capacity, DefaultVirtualCapacity)
+	}
+	readEOF(t, drive)
+	drive.Close()
+
+	notTape := filepath.Join(dir, "notTape")
+	if err := ioutil.WriteFile(notTape, []byte("#!/bin/sh\necho hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if drive, err := OpenVirtual(notTape); err == nil {
+		drive.Close()
+		t.Error("OpenVirtual() of a script succeeded")
+	}
+}